@@ -1,55 +1,169 @@
 package main
 
 import (
+	"context"
+	sqldriver "database/sql/driver"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"reflect"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 )
 
+// maxReadRetries bounds how many times a page interrupted by a lost connection is read again
+const maxReadRetries = 3
+
 // Batching reads rows from ClickHouse and sends them to the callback function
-func Batching(table Table, conn driver.Conn, batchSize int, onBatch func([][]interface{}) error) (int, error) {
+func Batching(config Config, table Table, conn Reader, onBatch func([][]interface{}) error) (int, error) {
+	return BatchingKeys(config, table, conn, func(batch [][]interface{}, _ *BatchKey) error {
+		return onBatch(batch)
+	})
+}
+
+// BatchingKeys reads rows like Batching, also sending the order key of the last row of every batch,
+// which a checkpoint resumes from. It starts past the key of the table checkpoint, if any.
+func BatchingKeys(config Config, table Table, conn Reader, onBatch func([][]interface{}, *BatchKey) error) (int, error) {
+	batchSize := config.BatchSize
+
 	query := fmt.Sprintf(
-		"SELECT %s FROM %s FINAL",
-		strings.Join(table.GetSourceColumns(), ", "),
-		table.Source,
+		"SELECT %s FROM %s",
+		strings.Join(table.GetSelectExpressions(), ", "),
+		table.GetSourceExpression(),
 	)
 
-	if table.Cursor.Column != "" && !table.Cursor.LastSync.IsZero() {
-		query = fmt.Sprintf("%s WHERE %s > '%s'", query, table.Cursor.Column, table.Cursor.LastSync.Format(time.DateTime))
+	conditions := []string{}
+	args := []interface{}{}
+	if table.Where != "" {
+		conditions = append(conditions, fmt.Sprintf("(%s)", table.Where))
+	}
+
+	if table.Cursor.Column != "" && table.Cursor.IsSequence() && table.Cursor.LastValue != 0 {
+		conditions = append(conditions, fmt.Sprintf("%s > @lastValue", table.Cursor.Column))
+		args = append(args, clickhouse.Named("lastValue", table.Cursor.LastValue))
+	}
+
+	// Rows past the saved sequence end would be read again by the next run
+	if table.Cursor.Column != "" && table.Cursor.IsSequence() && table.Cursor.UntilValue != 0 {
+		conditions = append(conditions, fmt.Sprintf("%s <= @untilValue", table.Cursor.Column))
+		args = append(args, clickhouse.Named("untilValue", table.Cursor.UntilValue))
+	}
+
+	if table.Cursor.Column != "" && !table.Cursor.IsSequence() && !table.Cursor.LastSync.IsZero() {
+		// Late rows within the lookback are read again, the upsert making it idempotent
+		since := table.Cursor.LastSync.Add(-table.Cursor.Lookback)
+
+		// Bound with nanoseconds so DateTime64 cursors do not re-sync rows
+		conditions = append(conditions, fmt.Sprintf("%s > @lastSync", table.Cursor.Column))
+		args = append(args, clickhouse.DateNamed("lastSync", since, clickhouse.NanoSeconds))
+	}
+
+	if table.Cursor.Column != "" && !table.Cursor.Until.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("%s <= @until", table.Cursor.Column))
+		args = append(args, clickhouse.DateNamed("until", table.Cursor.Until, clickhouse.NanoSeconds))
+	}
+
+	if table.Partition != "" {
+		conditions = append(conditions, "_partition_id = @partition")
+		args = append(args, clickhouse.Named("partition", table.Partition))
+	}
+
+	// Rows are skipped by key rather than offset, so rows deleted or changed since the checkpoint
+	// cannot shift the rows left to read
+	if table.Checkpoint != nil {
+		condition, keyArgs := ResumeCondition(table)
+		conditions = append(conditions, condition)
+		args = append(args, keyArgs...)
+
+		log.WithField("key", table.Checkpoint.Key).Info("Resuming from checkpoint")
+	}
+
+	if len(conditions) > 0 {
+		query = fmt.Sprintf("%s WHERE %s", query, strings.Join(conditions, " AND "))
 	}
 
-	countQuery := fmt.Sprintf("SELECT COUNT(*) FROM (%s) AS subquery", query)
 	var count uint64
-	if err := conn.QueryRow(ctx, countQuery).Scan(&count); err != nil {
-		return 0, err
+	if table.EstimateCount {
+		estimate, err := EstimateRows(table, conn)
+		if err != nil {
+			return 0, fmt.Errorf("estimate count: %w", err)
+		}
+		count = estimate
+	} else {
+		countQuery := fmt.Sprintf("SELECT COUNT(*) FROM (%s) AS subquery", query)
+		if err := conn.QueryRow(TableContext(table), countQuery, args...).Scan(&count); err != nil {
+			return 0, fmt.Errorf("count: %w", err)
+		}
+	}
+
+	if count == 0 && !table.EstimateCount {
+		log.WithField("table", table.GetName()).Info("No rows to select")
+		return 0, nil
 	}
 
+	progress := NewProgress(table.GetName(), int(count), config.ProgressInterval)
+
 	var scannerVal []interface{}
+	var sourceTypes []string
+	names := table.GetSourceColumns()
+	nullAs := table.GetNullAs()
+	locations := table.GetLocations()
+	fixedStringAs := table.GetFixedStringAs()
+	keyIndexes := table.GetOrderIndexes()
 	total := 0
 	offset := 0
 
-	pk := ""
-	for _, col := range table.Columns {
-		if col.Primary {
-			pk = col.Source
-			break
+	orderBy := table.GetOrderBy()
+
+	// Pages are only stable if the order is unique, duplicates may be skipped or read twice.
+	// Estimated counts cannot tell, and checking would count the rows anyway.
+	if len(table.OrderBy) > 0 && !table.EstimateCount {
+		var unique uint64
+		uniqueQuery := fmt.Sprintf("SELECT uniqExact(%s) FROM (%s) AS subquery", strings.Join(table.GetOrderColumns(), ", "), query)
+		if err := conn.QueryRow(TableContext(table), uniqueQuery, args...).Scan(&unique); err != nil {
+			return 0, fmt.Errorf("check order_by: %w", err)
+		}
+
+		if unique < count {
+			log.WithFields(log.Fields{
+				"order_by":   orderBy,
+				"rows":       count,
+				"duplicates": count - unique,
+			}).Warn("order_by is not unique, rows may be skipped between batches")
 		}
 	}
 
-	for total < int(count) {
-		rows, err := conn.Query(ctx, fmt.Sprintf("%s ORDER BY %s LIMIT %d OFFSET %d", query, pk, batchSize, offset))
+	// readPage reads a whole page, so a page interrupted by a lost connection is read again from its start
+	readPage := func(offset int) ([][]interface{}, *BatchKey, error) {
+		rows, err := conn.Query(TableContext(table), fmt.Sprintf("%s ORDER BY %s LIMIT %d OFFSET %d", query, orderBy, batchSize, offset), args...)
 		if err != nil {
-			return 0, err
+			return nil, nil, fmt.Errorf("select at offset %d: %w", offset, err)
 		}
+		defer rows.Close()
 
 		batch := [][]interface{}{}
+		var last []interface{}
 		for rows.Next() {
 			if scannerVal == nil {
+				// Values are copied by position into the destination paired with each source
+				if err := CheckColumnOrder(table.GetSelectNames(), rows.Columns()); err != nil {
+					return nil, nil, err
+				}
+
 				scannerVal = GetScannerValues(rows.ColumnTypes())
+				CheckColumnTypes(table, rows.ColumnTypes())
+				for _, columnType := range rows.ColumnTypes() {
+					sourceTypes = append(sourceTypes, UnwrapType(columnType.DatabaseTypeName()))
+				}
 			}
 
 			values := make([]interface{}, len(scannerVal))
@@ -58,32 +172,332 @@ func Batching(table Table, conn driver.Conn, batchSize int, onBatch func([][]int
 			}
 
 			if err := rows.Scan(values...); err != nil {
-				return 0, err
+				return nil, nil, fmt.Errorf("scan at offset %d: %w", offset+len(batch), err)
+			}
+
+			// The key is kept as scanned, before the values are converted in place
+			last = slices.Clone(values)
+
+			for i := range values {
+				if values[i], err = ConvertValue(sourceTypes[i], values[i]); err != nil {
+					return nil, nil, fmt.Errorf("convert column %s at offset %d: %w", names[i], offset+len(batch), err)
+				}
+
+				if strings.HasPrefix(sourceTypes[i], "FixedString(") {
+					values[i] = ConvertFixedString(values[i], fixedStringAs[i])
+				}
+
+				if locations[i] != nil {
+					values[i] = InLocation(values[i], locations[i])
+				}
+
+				// pgx parses the string replacing a NULL as the destination type when copying
+				if nullAs[i] != nil && IsNull(values[i]) {
+					values[i] = *nullAs[i]
+				}
 			}
 
 			batch = append(batch, values)
 		}
 
+		if err := rows.Err(); err != nil {
+			return nil, nil, fmt.Errorf("read at offset %d: %w", offset+len(batch), err)
+		}
+
+		if last == nil || keyIndexes == nil {
+			return batch, nil, nil
+		}
+		return batch, RowKey(last, rows.ColumnTypes(), keyIndexes), nil
+	}
+
+	// Estimated counts only drive the progress, the read stopping at the first page not filled
+	for table.EstimateCount || total < int(count) {
+		batch, key, err := readPage(offset)
+		for attempt := 1; err != nil && IsConnectionError(err) && attempt <= maxReadRetries; attempt++ {
+			log.WithError(err).WithFields(log.Fields{
+				"offset":  offset,
+				"attempt": attempt,
+			}).Warn("Lost ClickHouse connection, reading the page again")
+
+			// The driver replaces the broken connection on the next query
+			time.Sleep(time.Duration(attempt) * time.Second)
+			batch, key, err = readPage(offset)
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		// Empty pages never reach the callback
 		if len(batch) > 0 {
 			total += len(batch)
+			progress.Add(len(batch))
+
+			config.Hooks.batch(table, batch)
+			config.Hooks.progress(table, total, int(count))
 
-			if err := onBatch(batch); err != nil {
+			if err := onBatch(batch, key); err != nil {
 				return 0, err
 			}
 		}
 
+		// A page not filled is the end of the data, ending the read without querying an empty page.
+		// Counted reads also stop there if rows were deleted since the count, rather than paging forever.
+		if len(batch) < batchSize {
+			if !table.EstimateCount && total < int(count) {
+				log.WithFields(log.Fields{
+					"table":   table.GetName(),
+					"read":    total,
+					"counted": count,
+				}).Warn("Source returned fewer rows than counted")
+			}
+			break
+		}
+
 		offset += batchSize
 	}
 
 	return total, nil
 }
 
+// ResumeCondition returns the condition reading the rows past the key of the table checkpoint,
+// compared as a tuple in the order direction
+func ResumeCondition(table Table) (string, []interface{}) {
+	operator := ">"
+	if strings.EqualFold(table.OrderDirection, "desc") {
+		operator = "<"
+	}
+
+	values := []string{}
+	args := []interface{}{}
+	for i, value := range table.Checkpoint.Key {
+		name := fmt.Sprintf("key%d", i)
+		values = append(values, fmt.Sprintf("CAST(@%s AS %s)", name, table.Checkpoint.KeyTypes[i]))
+		args = append(args, clickhouse.Named(name, value))
+	}
+
+	return fmt.Sprintf("(%s) %s (%s)", strings.Join(table.GetOrderColumns(), ", "), operator, strings.Join(values, ", ")), args
+}
+
+// RowKey returns the order key of a scanned row as text with its ClickHouse types,
+// nil if a key value is NULL or has no text form ClickHouse casts back
+func RowKey(values []interface{}, columnTypes []driver.ColumnType, indexes []int) *BatchKey {
+	key := &BatchKey{}
+	for _, i := range indexes {
+		chType := columnTypes[i].DatabaseTypeName()
+		text, ok := KeyText(values[i], UnwrapType(chType))
+		if !ok {
+			return nil
+		}
+
+		key.Values = append(key.Values, text)
+		key.Types = append(key.Types, chType)
+	}
+	return key
+}
+
+// KeyText formats a scanned key value the way ClickHouse parses it as its type
+func KeyText(value interface{}, chType string) (string, bool) {
+	v := reflect.ValueOf(value)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "", false
+		}
+		v = v.Elem()
+	}
+
+	switch value := v.Interface().(type) {
+	case time.Time:
+		// Times are scanned in the column timezone, which ClickHouse parses them in
+		if strings.HasPrefix(chType, "Date") && !strings.HasPrefix(chType, "DateTime") {
+			return value.Format("2006-01-02"), true
+		}
+		return value.Format("2006-01-02 15:04:05.999999999"), true
+	case fmt.Stringer:
+		return value.String(), true
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.String, reflect.Bool:
+		return fmt.Sprint(v.Interface()), true
+	}
+	return "", false
+}
+
+// CheckColumnOrder checks ClickHouse returned the selected source columns in order, the values being
+// copied by position. Expressions may be renamed by ClickHouse, so only a different count is an error.
+func CheckColumnOrder(names []string, columns []string) error {
+	if len(columns) != len(names) {
+		return fmt.Errorf("selected %d source columns, ClickHouse returned %d", len(names), len(columns))
+	}
+
+	for i, name := range names {
+		if strings.Trim(name, "`\"") != columns[i] {
+			log.WithFields(log.Fields{
+				"index":    i,
+				"source":   name,
+				"returned": columns[i],
+			}).Warn("Source column returned under another name, check the column mapping")
+		}
+	}
+	return nil
+}
+
+// IsConnectionError reports whether an error comes from a lost connection rather than from the query
+func IsConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, sqldriver.ErrBadConn) ||
+		errors.As(err, &netErr)
+}
+
+// CountDuplicates returns how many rows of a batch repeat the conflict key of a previous row
+func CountDuplicates(table Table, batch [][]interface{}) int {
+	indexes := []int{}
+	for _, name := range table.GetConflictColumns() {
+		if i := slices.Index(table.GetCopyColumns(), name); i >= 0 {
+			indexes = append(indexes, i)
+		}
+	}
+
+	seen := map[string]bool{}
+	duplicates := 0
+	for _, row := range batch {
+		key := make([]interface{}, len(indexes))
+		for k, i := range indexes {
+			// Values are scanned as pointers, the key compares what they point to
+			value := reflect.ValueOf(row[i])
+			for value.Kind() == reflect.Ptr && !value.IsNil() {
+				value = value.Elem()
+			}
+			key[k] = value
+		}
+
+		id := fmt.Sprint(key...)
+		if seen[id] {
+			duplicates++
+		}
+		seen[id] = true
+	}
+
+	return duplicates
+}
+
+// TableContext labels a ClickHouse query with the table being synchronized,
+// as a query ID prefix in system.processes and a comment in system.query_log,
+// and applies the table ClickHouse settings
+func TableContext(table Table) context.Context {
+	name := fmt.Sprintf("%s:%s", DefaultApplicationName, table.GetName())
+
+	settings := clickhouse.Settings{}
+	for key, value := range table.ClickHouseSettings {
+		settings[key] = value
+	}
+	settings["log_comment"] = name
+
+	return clickhouse.Context(ctx,
+		clickhouse.WithQueryID(fmt.Sprintf("%s:%s", name, uuid.New().String())),
+		clickhouse.WithSettings(settings),
+	)
+}
+
+// EstimateRows returns the row count of the active source parts, of the partition being read if any.
+// It ignores the where and cursor filters and the rows merged by FINAL, so it overestimates the rows to read.
+func EstimateRows(table Table, conn Reader) (uint64, error) {
+	database, name := splitQualified(table.GetSourceTable())
+
+	var rows uint64
+	err := conn.QueryRow(TableContext(table), `
+		SELECT sum(rows) FROM system.parts
+		WHERE active AND database = if(@database = '', currentDatabase(), @database) AND table = @table
+			AND (@partition = '' OR partition_id = @partition)
+	`,
+		clickhouse.Named("database", database),
+		clickhouse.Named("table", name),
+		clickhouse.Named("partition", table.Partition),
+	).Scan(&rows)
+	return rows, err
+}
+
+// CursorWindowEnd returns the upper cursor bound of a run limited by the cursor max window,
+// starting from the earliest source row on the first run
+func CursorWindowEnd(table Table, conn Reader) (time.Time, error) {
+	start := table.Cursor.LastSync
+	if start.IsZero() {
+		query := fmt.Sprintf("SELECT min(%s) FROM %s%s", table.Cursor.Column, table.GetSourceExpression(), table.GetWhereClause())
+		if err := conn.QueryRow(TableContext(table), query).Scan(&start); err != nil {
+			return time.Time{}, err
+		}
+
+		// An empty table has no window to bound
+		if start.Unix() == 0 {
+			return time.Time{}, nil
+		}
+	}
+
+	return start.Add(table.Cursor.MaxWindow), nil
+}
+
+// SequenceCursorEnd returns the highest value of a sequence cursor, checking the column is an integer
+// within the int64 range and did not go back since the last run, which would skip the rows below the saved value
+func SequenceCursorEnd(table Table, conn Reader) (int64, error) {
+	var sourceType, value string
+	query := fmt.Sprintf("SELECT toTypeName(max(%s)), toString(max(%s)) FROM %s%s", table.Cursor.Column, table.Cursor.Column, table.GetSourceExpression(), table.GetWhereClause())
+	if err := conn.QueryRow(TableContext(table), query).Scan(&sourceType, &value); err != nil {
+		return 0, err
+	}
+
+	if name := UnwrapType(sourceType); !strings.HasPrefix(name, "Int") && !strings.HasPrefix(name, "UInt") {
+		return 0, fmt.Errorf("sequence cursor column %s is %s, not an integer", table.Cursor.Column, sourceType)
+	}
+
+	// Read as text, as casting UInt64 values past the int64 range would wrap them to negative values
+	end, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("sequence cursor column %s max %s is out of the int64 range", table.Cursor.Column, value)
+	}
+
+	if end < table.Cursor.LastValue {
+		return 0, fmt.Errorf("sequence cursor column %s is not monotonic, its max went back from %d to %d", table.Cursor.Column, table.Cursor.LastValue, end)
+	}
+
+	return end, nil
+}
+
 // GetScannerValues guesses the scanner values from the column types
 func GetScannerValues(columnTypes []driver.ColumnType) []interface{} {
 	log.Info("Guessing scanner values")
 	scannerVal := make([]interface{}, len(columnTypes))
 	for i := range scannerVal {
-		scannerVal[i] = reflect.New(columnTypes[i].ScanType()).Interface()
+		// Columns of NULL literals have no concrete type, the driver leaving the value pointer nil, so NULL
+		if UnwrapType(columnTypes[i].DatabaseTypeName()) == "Nothing" {
+			log.WithFields(log.Fields{
+				"index": i,
+				"name":  columnTypes[i].Name(),
+			}).Warn("Column of type Nothing, scanning as a NULL string")
+
+			scannerVal[i] = new(string)
+			continue
+		}
+
+		scanType := columnTypes[i].ScanType()
+		if scanType == nil || scanType.Kind() == reflect.Interface {
+			// Unknown types are read as text rather than reflected into a value that could panic
+			log.WithFields(log.Fields{
+				"index":  i,
+				"name":   columnTypes[i].Name(),
+				"source": UnwrapType(columnTypes[i].DatabaseTypeName()),
+			}).Warn("Unknown scan type, scanning as string")
+
+			scannerVal[i] = new(string)
+			continue
+		}
+
+		scannerVal[i] = reflect.New(scanType).Interface()
 
 		value := reflect.ValueOf(scannerVal[i]).Elem().Kind()
 		if value == reflect.Ptr {
@@ -99,10 +513,11 @@ func GetScannerValues(columnTypes []driver.ColumnType) []interface{} {
 		}
 
 		log.WithFields(log.Fields{
-			"index": i,
-			"name":  columnTypes[i].Name(),
-			"type":  columnTypes[i].ScanType(),
-			"value": value,
+			"index":  i,
+			"name":   columnTypes[i].Name(),
+			"source": UnwrapType(columnTypes[i].DatabaseTypeName()),
+			"type":   columnTypes[i].ScanType(),
+			"value":  value,
 		}).Info("Guessed scanner value")
 	}
 	return scannerVal
@@ -0,0 +1,748 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+var metricColumns = []fakeColumn{
+	{name: "id", chType: "UInt32", scan: reflect.TypeOf(uint32(0))},
+	{name: "created_at", chType: "DateTime64(3)", scan: reflect.TypeOf(time.Time{})},
+}
+
+// metricsTable is a table of the metrics fake source with a time cursor
+func metricsTable() Table {
+	return Table{
+		Source:      "metrics",
+		Destination: "metrics",
+		Columns: []Column{
+			{Source: "id", Destination: "id", Type: "bigint", Primary: true},
+			{Source: "created_at", Destination: "created_at", Type: "timestamptz(3)"},
+		},
+		Cursor: Cursor{Column: "created_at"},
+	}
+}
+
+// readAll reads every batch of a table
+func readAll(t *testing.T, config Config, table Table, source Reader) [][]any {
+	t.Helper()
+
+	rows := [][]any{}
+	if _, err := Batching(config, table, source, func(batch [][]interface{}) error {
+		rows = append(rows, batch...)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestBatchingDateTime64(t *testing.T) {
+	created := time.Date(2024, 3, 1, 12, 30, 15, 123_000_000, time.UTC)
+	source := newFakeSource(metricColumns, [][]any{{uint32(1), created}})
+
+	table := metricsTable()
+	table.Cursor.LastSync = created.Add(-time.Millisecond)
+
+	rows := readAll(t, Config{BatchSize: 10}, table, source)
+	if len(rows) != 1 {
+		t.Fatalf("read %d rows, want 1", len(rows))
+	}
+	if value, ok := rows[0][1].(*time.Time); !ok || !value.Equal(created) {
+		t.Errorf("read created_at %#v, want %v", rows[0][1], created)
+	}
+
+	// The cursor keeps its milliseconds, so the row just after it is not filtered out nor read again
+	args := source.args[0]
+	if len(args) != 1 {
+		t.Fatalf("queried with %v, want the last sync", args)
+	}
+	lastSync, ok := args[0].(driver.NamedDateValue)
+	if !ok || !lastSync.Value.Equal(table.Cursor.LastSync) || lastSync.Scale != uint8(clickhouse.NanoSeconds) {
+		t.Errorf("last sync = %#v, want %v in nanoseconds", args[0], table.Cursor.LastSync)
+	}
+	if strings.Contains(source.queries[0], "2024") {
+		t.Errorf("query %q formats the cursor", source.queries[0])
+	}
+}
+
+// filteredSource fakes the metrics source, applying the cursor bounds of its queries
+// and answering the earliest cursor
+func filteredSource(rows [][]any) *fakeReader {
+	return &fakeReader{answer: func(query string, args []any) (*fakeRows, error) {
+		filtered := [][]any{}
+		for _, row := range rows {
+			created := row[1].(time.Time)
+			kept := true
+			for _, arg := range args {
+				bound, _ := arg.(driver.NamedDateValue)
+				switch bound.Name {
+				case "lastSync":
+					kept = kept && created.After(bound.Value)
+				case "until":
+					kept = kept && !created.After(bound.Value)
+				}
+			}
+			if kept {
+				filtered = append(filtered, row)
+			}
+		}
+
+		if strings.HasPrefix(query, "SELECT min(created_at)") {
+			return &fakeRows{rows: [][]any{{filtered[0][1]}}}, nil
+		}
+		return newFakeSource(metricColumns, filtered).answer(query, args)
+	}}
+}
+
+func TestBatchingCursorParameter(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	rows := [][]any{}
+	for i := 0; i < 5; i++ {
+		rows = append(rows, []any{uint32(i), start.Add(time.Duration(i) * time.Hour)})
+	}
+
+	table := metricsTable()
+	table.Cursor.LastSync = start.Add(90 * time.Minute)
+	source := filteredSource(rows)
+
+	read := readAll(t, Config{BatchSize: 2}, table, source)
+	if len(read) != 3 {
+		t.Fatalf("read %d rows, want the 3 rows after the last sync", len(read))
+	}
+	for _, row := range read {
+		if created := *row[1].(*time.Time); !created.After(table.Cursor.LastSync) {
+			t.Errorf("read a row created at %v, before the last sync", created)
+		}
+	}
+
+	// The count and every page are bound to the same parameter, never formatting the cursor
+	for i, query := range source.queries {
+		if !strings.Contains(query, "WHERE created_at > @lastSync") {
+			t.Errorf("query %q does not filter on the parameter", query)
+		}
+		if len(source.args[i]) != 1 || source.args[i][0].(driver.NamedDateValue).Name != "lastSync" {
+			t.Errorf("query %q bound to %v, want lastSync", query, source.args[i])
+		}
+	}
+}
+
+func TestBatchingLookback(t *testing.T) {
+	lastSync := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	rows := [][]any{
+		{uint32(1), lastSync.Add(-3 * time.Hour)},
+		// Late row inserted after the last sync, with an event time before it
+		{uint32(2), lastSync.Add(-30 * time.Minute)},
+		{uint32(3), lastSync.Add(time.Minute)},
+	}
+
+	table := metricsTable()
+	table.Cursor.LastSync = lastSync
+	if read := readAll(t, Config{BatchSize: 10}, table, filteredSource(rows)); len(read) != 1 {
+		t.Errorf("read %d rows without lookback, want 1", len(read))
+	}
+
+	table.Cursor.Lookback = time.Hour
+	source := filteredSource(rows)
+	read := readAll(t, Config{BatchSize: 10}, table, source)
+	if len(read) != 2 || **read[0][0].(**uint32) != 2 {
+		t.Errorf("read %d rows with a lookback, want the late row and the new one", len(read))
+	}
+	if since := source.args[0][0].(driver.NamedDateValue).Value; !since.Equal(lastSync.Add(-time.Hour)) {
+		t.Errorf("read since %v, want the last sync minus the lookback", since)
+	}
+}
+
+// queryLabels returns the query ID and settings a ClickHouse context applies, reading the driver options
+func queryLabels(ctx context.Context) (string, map[string]string) {
+	var queryID string
+	settings := map[string]string{}
+	clickhouse.Context(ctx, func(o *clickhouse.QueryOptions) error {
+		options := reflect.ValueOf(o).Elem()
+		queryID = options.FieldByName("queryID").String()
+
+		iter := options.FieldByName("settings").MapRange()
+		for iter.Next() {
+			settings[iter.Key().String()] = fmt.Sprint(iter.Value().Elem())
+		}
+		return nil
+	})
+	return queryID, settings
+}
+
+func TestTableContext(t *testing.T) {
+	table := Table{
+		Source:             "events",
+		Destination:        "public.events",
+		ClickHouseSettings: map[string]any{"max_threads": 4},
+	}
+
+	queryID, settings := queryLabels(TableContext(table))
+	if !strings.HasPrefix(queryID, "replication:events:") {
+		t.Errorf("query ID %s, want it prefixed by replication:events", queryID)
+	}
+	if settings["log_comment"] != "replication:events" || settings["max_threads"] != "4" {
+		t.Errorf("settings %v, want the log comment and the table settings", settings)
+	}
+
+	// Each query has its own ID
+	if other, _ := queryLabels(TableContext(table)); other == queryID {
+		t.Errorf("query ID %s reused", queryID)
+	}
+}
+
+func TestBatchingWhere(t *testing.T) {
+	rows := [][]any{{uint32(1), "active"}, {uint32(2), "archived"}, {uint32(3), "active"}}
+	active := [][]any{rows[0], rows[2]}
+
+	// The fake only applies the filter when the query carries it
+	source := &fakeReader{answer: func(query string, args []any) (*fakeRows, error) {
+		if strings.Contains(query, "(name = 'active')") {
+			return newFakeSource(eventColumns, active).answer(query, args)
+		}
+		return newFakeSource(eventColumns, rows).answer(query, args)
+	}}
+
+	table := eventsTable()
+	table.Where = "name = 'active'"
+	table.Cursor = Cursor{Column: "created_at", LastSync: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)}
+
+	read := readAll(t, Config{BatchSize: 10}, table, source)
+	if len(read) != 2 {
+		t.Errorf("read %d rows, want the 2 active ones", len(read))
+	}
+	for _, query := range source.queries {
+		if !strings.Contains(query, "WHERE (name = 'active') AND created_at > @lastSync") {
+			t.Errorf("query %q, want the filter ANDed with the cursor", query)
+		}
+	}
+
+	table.Where = "  "
+	if err := table.Validate(); err == nil {
+		t.Error("Validate() accepted a blank where")
+	}
+}
+
+func TestGetScannerValuesUnknownType(t *testing.T) {
+	hook := test.NewLocal(log.StandardLogger())
+	defer hook.Reset()
+
+	columns := []driver.ColumnType{
+		fakeColumn{name: "id", chType: "UInt32", scan: reflect.TypeOf(uint32(0))},
+		fakeColumn{name: "shape", chType: "Variant(String, UInt64)", scan: reflect.TypeOf((*any)(nil)).Elem()},
+		fakeColumn{name: "point", chType: "Point"},
+	}
+
+	values := GetScannerValues(columns)
+	if _, ok := values[0].(*uint32); !ok {
+		t.Errorf("id scanned into %T, want *uint32", values[0])
+	}
+	for i := 1; i < len(values); i++ {
+		if _, ok := values[i].(*string); !ok {
+			t.Errorf("%s scanned into %T, want *string", columns[i].Name(), values[i])
+		}
+	}
+
+	warned := []any{}
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Unknown scan type, scanning as string" {
+			warned = append(warned, entry.Data["name"])
+		}
+	}
+	if !reflect.DeepEqual(warned, []any{"shape", "point"}) {
+		t.Errorf("warned about %v, want shape and point", warned)
+	}
+}
+
+func TestBatchingOrderBy(t *testing.T) {
+	hook := test.NewLocal(log.StandardLogger())
+	defer hook.Reset()
+
+	table := metricsTable()
+	table.OrderBy = []string{"created_at"}
+
+	source := newFakeSource(metricColumns, [][]any{{uint32(1), time.Now()}, {uint32(2), time.Now()}})
+	readAll(t, Config{BatchSize: 10}, table, source)
+
+	if pages := source.Queries("ORDER BY created_at LIMIT 10 OFFSET 0"); len(pages) != 1 {
+		t.Errorf("read %q, want pages ordered by created_at", source.Queries("LIMIT"))
+	}
+	if len(source.Queries("SELECT uniqExact(created_at)")) != 1 {
+		t.Error("order_by uniqueness not checked")
+	}
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.WarnLevel {
+			t.Errorf("warned %q for a unique order", entry.Message)
+		}
+	}
+
+	// Duplicates in the order may skip rows between pages
+	answer := source.answer
+	source.answer = func(query string, args []any) (*fakeRows, error) {
+		if strings.HasPrefix(query, "SELECT uniqExact(") {
+			return &fakeRows{rows: [][]any{{uint64(1)}}}, nil
+		}
+		return answer(query, args)
+	}
+	readAll(t, Config{BatchSize: 10}, table, source)
+
+	var warning *log.Entry
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.WarnLevel {
+			warning = entry
+		}
+	}
+	if warning == nil {
+		t.Fatal("duplicates in the order not warned about")
+	}
+	if warning.Message != "order_by is not unique, rows may be skipped between batches" || warning.Data["duplicates"] != uint64(1) {
+		t.Errorf("warned %q with %v, want the duplicates in the order", warning.Message, warning.Data)
+	}
+}
+
+func TestBatchingOrderDirection(t *testing.T) {
+	// A descending window reads the most recent rows first, NULLs last
+	table := metricsTable()
+	table.OrderBy = []string{"created_at", "id"}
+	table.OrderDirection, table.OrderNulls = "desc", "last"
+	if err := table.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	source := newFakeSource(metricColumns, [][]any{{uint32(1), now}, {uint32(2), now}, {uint32(3), now}})
+	readAll(t, Config{BatchSize: 2}, table, source)
+
+	pages := source.Queries("ORDER BY created_at DESC NULLS LAST, id DESC NULLS LAST LIMIT 2")
+	if len(pages) != 2 {
+		t.Errorf("read %q, want 2 pages in descending order", source.Queries("LIMIT"))
+	}
+
+	// Uniqueness is checked on the columns alone
+	if len(source.Queries("SELECT uniqExact(created_at, id)")) != 1 {
+		t.Errorf("checked %q, want the uniqueness of the order columns", source.Queries("uniqExact"))
+	}
+
+	for _, invalid := range []func(*Table){
+		func(t *Table) { t.OrderDirection = "sideways" },
+		func(t *Table) { t.OrderNulls = "middle" },
+	} {
+		table := metricsTable()
+		invalid(&table)
+		if err := table.Validate(); err == nil {
+			t.Errorf("validated order direction %q and nulls %q", table.OrderDirection, table.OrderNulls)
+		}
+	}
+}
+
+func TestBatchingClickHouseSettings(t *testing.T) {
+	table := eventsTable()
+	table.ClickHouseSettings = map[string]any{"do_not_merge_across_partitions_select_final": 1}
+
+	source := newFakeSource(eventColumns, eventRows(3))
+	readAll(t, Config{BatchSize: 2}, table, source)
+
+	// The count and every page read with FINAL carry the settings
+	for i, query := range source.queries {
+		if !strings.Contains(query, "FROM events FINAL") {
+			t.Errorf("query %q without FINAL", query)
+		}
+		if _, settings := queryLabels(source.contexts[i]); settings["do_not_merge_across_partitions_select_final"] != "1" {
+			t.Errorf("query %q with settings %v", query, settings)
+		}
+	}
+	if len(source.queries) != 3 {
+		t.Errorf("ran %d queries, want the count and 2 pages", len(source.queries))
+	}
+}
+
+func TestCountDuplicates(t *testing.T) {
+	// Rows hold pointers as scanned, duplicates comparing the values
+	row := func(id uint32, email string) []interface{} {
+		idp, emailp := &id, &email
+		return []interface{}{&idp, &emailp, "name"}
+	}
+
+	users := usersTable()
+	batch := [][]interface{}{
+		row(1, "a@example.com"),
+		row(2, "a@example.com"),
+		row(3, "b@example.com"),
+		row(4, "a@example.com"),
+	}
+	if duplicates := CountDuplicates(users, batch); duplicates != 2 {
+		t.Errorf("CountDuplicates() = %d on email, want 2", duplicates)
+	}
+
+	users.ConflictColumns = nil
+	if duplicates := CountDuplicates(users, batch); duplicates != 0 {
+		t.Errorf("CountDuplicates() = %d on id, want 0", duplicates)
+	}
+}
+
+func TestSynchronizeTableReportDuplicates(t *testing.T) {
+	hook := test.NewLocal(log.StandardLogger())
+	defer hook.Reset()
+
+	table := eventsTable()
+	table.ReportDuplicates = true
+	rows := [][]any{{uint32(1), "a"}, {uint32(1), "b"}, {uint32(2), "c"}, {uint32(1), "d"}}
+
+	if _, err := SynchronizeTable(Config{BatchSize: 10}, table, newFakeSource(eventColumns, rows), newFakePool()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Batch has duplicate conflict keys, keeping one row per key" {
+			if entry.Data["duplicates"] != 2 {
+				t.Errorf("reported %v duplicates, want 2", entry.Data["duplicates"])
+			}
+			return
+		}
+	}
+	t.Error("duplicates not reported")
+}
+
+func TestBatchingNullAs(t *testing.T) {
+	columns := []fakeColumn{
+		{name: "id", chType: "UInt32", scan: reflect.TypeOf(uint32(0))},
+		{name: "name", chType: "Nullable(String)", scan: reflect.TypeOf((*string)(nil))},
+	}
+	named := "named"
+	rows := [][]any{{uint32(1), &named}, {uint32(2), (*string)(nil)}}
+
+	empty := ""
+	table := eventsTable()
+	table.Columns[1].NullAs = &empty
+
+	read := readAll(t, Config{BatchSize: 10}, table, newFakeSource(columns, rows))
+	if len(read) != 2 {
+		t.Fatalf("read %d rows, want 2", len(read))
+	}
+	if value, ok := read[0][1].(**string); !ok || **value != "named" {
+		t.Errorf("read %#v, want the value kept", read[0][1])
+	}
+	if value, ok := read[1][1].(string); !ok || value != "" {
+		t.Errorf("read %#v for NULL, want the empty null_as", read[1][1])
+	}
+
+	// Without null_as, NULL is kept
+	read = readAll(t, Config{BatchSize: 10}, eventsTable(), newFakeSource(columns, rows))
+	if !IsNull(read[1][1]) {
+		t.Errorf("read %#v for NULL, want NULL", read[1][1])
+	}
+}
+
+func TestBatchingConnectionLost(t *testing.T) {
+	hook := test.NewLocal(log.StandardLogger())
+	defer hook.Reset()
+
+	// The second page breaks after its first row, once
+	source := newFakeSource(eventColumns, eventRows(5))
+	answer := source.answer
+	lost := false
+	source.answer = func(query string, args []any) (*fakeRows, error) {
+		rows, err := answer(query, args)
+		if strings.HasSuffix(query, "OFFSET 2") && !lost {
+			lost = true
+			rows.rows, rows.err = rows.rows[:1], io.ErrUnexpectedEOF
+		}
+		return rows, err
+	}
+
+	read := readAll(t, Config{BatchSize: 2}, eventsTable(), source)
+
+	// The page is read again from its offset, without losing or repeating rows
+	ids := []uint32{}
+	for _, row := range read {
+		ids = append(ids, **row[0].(**uint32))
+	}
+	if !reflect.DeepEqual(ids, []uint32{1, 2, 3, 4, 5}) {
+		t.Errorf("read ids %v, want 1 to 5 once", ids)
+	}
+	if queries := source.Queries("OFFSET 2"); len(queries) != 2 {
+		t.Errorf("read the broken page %d times, want twice", len(queries))
+	}
+
+	retried := false
+	for _, entry := range hook.AllEntries() {
+		retried = retried || entry.Message == "Lost ClickHouse connection, reading the page again"
+	}
+	if !retried {
+		t.Error("lost connection not logged")
+	}
+}
+
+func TestIsConnectionError(t *testing.T) {
+	for err, want := range map[error]bool{
+		io.EOF: true,
+		fmt.Errorf("read: %w", io.ErrUnexpectedEOF):         true,
+		errors.New("Code: 62. DB::Exception: Syntax error"): false,
+	} {
+		if IsConnectionError(err) != want {
+			t.Errorf("IsConnectionError(%v) = %t, want %t", err, !want, want)
+		}
+	}
+}
+
+func TestBatchingSourceDatabase(t *testing.T) {
+	tests := []struct {
+		source, database, want string
+	}{
+		{"events", "", "events"},
+		{"events", "analytics", "analytics.events"},
+		{"archive.events", "analytics", "archive.events"},
+	}
+
+	for _, test := range tests {
+		table := eventsTable()
+		table.Source, table.SourceDatabase = test.source, test.database
+
+		source := newFakeSource(eventColumns, eventRows(3))
+		if read := readAll(t, Config{BatchSize: 10}, table, source); len(read) != 3 {
+			t.Errorf("read %d rows of %s, want 3", len(read), test.source)
+		}
+
+		// Every query reads the qualified table
+		queries := source.Queries("FROM")
+		if len(queries) == 0 {
+			t.Fatalf("source %s never queried", test.source)
+		}
+		for _, query := range queries {
+			if !strings.Contains(query, "FROM "+test.want+" FINAL") {
+				t.Errorf("source %s in database %q queried %q, want %s", test.source, test.database, query, test.want)
+			}
+		}
+		if describe := table.GetDescribeTarget(); describe != "TABLE "+test.want {
+			t.Errorf("source %s in database %q described %s, want %s", test.source, test.database, describe, test.want)
+		}
+	}
+}
+
+// sequenceSource is the events fake source answering the max of its id sequence cursor
+func sequenceSource(rows [][]any, idType string, max int64) *fakeReader {
+	source := newFakeSource(eventColumns, rows)
+	answer := source.answer
+	source.answer = func(query string, args []any) (*fakeRows, error) {
+		if strings.HasPrefix(query, "SELECT toTypeName(max(id))") {
+			return &fakeRows{rows: [][]any{{idType, fmt.Sprint(max)}}}, nil
+		}
+		return answer(query, args)
+	}
+	return source
+}
+
+func TestReplicateSequenceCursor(t *testing.T) {
+	table := eventsTable()
+	table.Cursor = Cursor{Column: "id", Type: CursorTypeSequence}
+	if err := table.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{BatchSize: 10, Tables: []Table{table}}
+
+	// The first run reads every row and saves the highest id
+	source := sequenceSource(eventRows(3), "UInt32", 3)
+	if failed := Replicate(config, RunOptions{Issues: &Issues{}}, fakeSources{"": source}, fakeDestinations{"": newFakePool()}); failed != 0 {
+		t.Fatalf("%d tables failed", failed)
+	}
+	if cursor := config.Tables[0].Cursor; cursor.LastValue != 3 || !cursor.LastSync.IsZero() {
+		t.Errorf("cursor saved at %d and %s, want the id 3 only", cursor.LastValue, cursor.LastSync)
+	}
+	if filtered := source.Queries("id > @lastValue"); len(filtered) != 0 {
+		t.Errorf("first run filtered with %q", filtered)
+	}
+
+	// The next one only reads the ids past it
+	source = sequenceSource([][]any{{uint32(4), "event"}, {uint32(5), "event"}}, "UInt32", 5)
+	if failed := Replicate(config, RunOptions{Issues: &Issues{}}, fakeSources{"": source}, fakeDestinations{"": newFakePool()}); failed != 0 {
+		t.Fatalf("%d tables failed", failed)
+	}
+	filtered := source.Queries("WHERE id > @lastValue")
+	if len(filtered) == 0 {
+		t.Fatalf("read %q, want the ids past the cursor", source.Queries("SELECT"))
+	}
+	if !slices.ContainsFunc(source.args[slices.Index(source.queries, filtered[0])], func(arg any) bool {
+		named, ok := arg.(driver.NamedValue)
+		return ok && named.Name == "lastValue" && named.Value == int64(3)
+	}) {
+		t.Errorf("lastValue not bound to 3")
+	}
+	if cursor := config.Tables[0].Cursor; cursor.LastValue != 5 {
+		t.Errorf("cursor saved at %d, want 5", cursor.LastValue)
+	}
+
+	// The read stops at the saved end, so rows inserted meanwhile are left to the next run
+	if !strings.Contains(filtered[0], "id <= @untilValue") || !slices.ContainsFunc(source.args[slices.Index(source.queries, filtered[0])], func(arg any) bool {
+		named, ok := arg.(driver.NamedValue)
+		return ok && named.Name == "untilValue" && named.Value == int64(5)
+	}) {
+		t.Errorf("read %q, want the ids bounded by 5", filtered[0])
+	}
+
+	// UInt64 values past the int64 range would wrap to negative values
+	overflow := sequenceSource(nil, "UInt64", 0)
+	answer := overflow.answer
+	overflow.answer = func(query string, args []any) (*fakeRows, error) {
+		if strings.HasPrefix(query, "SELECT toTypeName(max(id))") {
+			return &fakeRows{rows: [][]any{{"UInt64", "18446744073709551615"}}}, nil
+		}
+		return answer(query, args)
+	}
+	if _, err := SequenceCursorEnd(config.Tables[0], overflow); err == nil || !strings.Contains(err.Error(), "out of the int64 range") {
+		t.Errorf("SequenceCursorEnd = %v, want the UInt64 max rejected", err)
+	}
+
+	// Sequences going back, not made of integers or out of range fail the table
+	for _, source := range []*fakeReader{sequenceSource(nil, "UInt32", 4), sequenceSource(nil, "String", 6), overflow} {
+		if failed := Replicate(config, RunOptions{Issues: &Issues{}}, fakeSources{"": source}, fakeDestinations{"": newFakePool()}); failed != 1 {
+			t.Errorf("%d tables failed, want the sequence rejected", failed)
+		}
+		if cursor := config.Tables[0].Cursor; cursor.LastValue != 5 {
+			t.Errorf("cursor moved to %d by a failed run", cursor.LastValue)
+		}
+	}
+}
+
+func TestBatchingColumnMisalignment(t *testing.T) {
+	hook := test.NewLocal(log.StandardLogger())
+	defer hook.Reset()
+
+	// A source returning another column set would copy values into the wrong destinations
+	columns := append(slices.Clone(eventColumns), fakeColumn{name: "extra", chType: "String", scan: reflect.TypeOf("")})
+	source := newFakeSource(columns, [][]any{{uint32(1), "event", "extra"}})
+	_, err := Batching(Config{BatchSize: 10}, eventsTable(), source, func([][]interface{}) error {
+		t.Error("misaligned batch copied")
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "selected 2 source columns, ClickHouse returned 3") {
+		t.Errorf("Batching = %v, want the column count mismatch", err)
+	}
+
+	// Renamed columns are only warned about, expressions being named by ClickHouse
+	if err := CheckColumnOrder([]string{"id", "`name`"}, []string{"id", "name"}); err != nil || len(hook.AllEntries()) != 0 {
+		t.Errorf("CheckColumnOrder of quoted names = %v", err)
+	}
+	if err := CheckColumnOrder([]string{"id", "name"}, []string{"name", "id"}); err != nil {
+		t.Errorf("CheckColumnOrder of swapped names = %v, want a warning only", err)
+	}
+	if entry := hook.LastEntry(); entry == nil || entry.Level != log.WarnLevel || entry.Data["source"] != "name" {
+		t.Errorf("swapped columns logged %v, want a warning", entry)
+	}
+
+	// Destinations are paired one to one with the sources
+	for _, columns := range [][]Column{
+		{{Source: "id", Destination: "id", Primary: true}, {Source: "name"}},
+		{{Source: "id", Destination: "id", Primary: true}, {Source: "name", Destination: "id"}},
+	} {
+		table := Table{Source: "events", Destination: "events", Columns: columns}
+		if err := table.Validate(); err == nil {
+			t.Errorf("validated columns %+v", columns)
+		}
+	}
+}
+
+func TestBatchingNoEmptyBatch(t *testing.T) {
+	tests := []struct {
+		name string
+		// count is the row count answered, rows being deleted after being counted if above 4
+		count    uint64
+		estimate bool
+		pages    int
+	}{
+		{"counted", 4, false, 2},
+		{"deleted since counted", 6, false, 3},
+		{"estimated", 4, true, 3},
+	}
+
+	for _, test := range tests {
+		table := eventsTable()
+		table.EstimateCount = test.estimate
+
+		source := newFakeSource(eventColumns, eventRows(4))
+		answer := source.answer
+		source.answer = func(query string, args []any) (*fakeRows, error) {
+			if strings.HasPrefix(query, "SELECT COUNT(*)") || strings.Contains(query, "system.parts") {
+				return &fakeRows{rows: [][]any{{test.count}}}, nil
+			}
+			return answer(query, args)
+		}
+
+		batches := 0
+		total, err := Batching(Config{BatchSize: 2}, table, source, func(batch [][]interface{}) error {
+			if len(batch) == 0 {
+				t.Errorf("%s: empty batch passed to the callback", test.name)
+			}
+			batches++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Only the reads not knowing where the data ends query a page past it
+		if total != 4 || batches != 2 {
+			t.Errorf("%s: read %d rows in %d batches, want 4 in 2", test.name, total, batches)
+		}
+		if pages := source.Queries("LIMIT"); len(pages) != test.pages {
+			t.Errorf("%s: read %d pages, want %d", test.name, len(pages), test.pages)
+		}
+	}
+}
+
+func TestBatchingNothingColumn(t *testing.T) {
+	hook := test.NewLocal(log.StandardLogger())
+	defer hook.Reset()
+
+	// SELECT id, NULL AS note has a column without a concrete type nor scan type
+	columns := []fakeColumn{
+		{name: "id", chType: "UInt32", scan: reflect.TypeOf(uint32(0))},
+		{name: "note", chType: "Nullable(Nothing)"},
+	}
+	table := Table{
+		Source:      "events",
+		Destination: "events",
+		SourceQuery: "SELECT id, NULL AS note FROM events",
+		Columns: []Column{
+			{Source: "id", Destination: "id", Type: "bigint", Primary: true},
+			{Source: "note", Destination: "note"},
+		},
+	}
+	source := newFakeSource(columns, [][]any{{uint32(1), nil}, {uint32(2), nil}})
+
+	if err := InferColumnTypes(&table, source); err != nil {
+		t.Fatal(err)
+	}
+	if table.Columns[1].Type != "text" {
+		t.Errorf("note inferred as %s, want text", table.Columns[1].Type)
+	}
+
+	read := readAll(t, Config{BatchSize: 10}, table, source)
+	if len(read) != 2 {
+		t.Fatalf("read %d rows, want 2", len(read))
+	}
+	for _, row := range read {
+		if !IsNull(row[1]) {
+			t.Errorf("read note %#v, want NULL", row[1])
+		}
+	}
+
+	warned := false
+	for _, entry := range hook.AllEntries() {
+		warned = warned || entry.Message == "Column of type Nothing, scanning as a NULL string" && entry.Data["name"] == "note"
+	}
+	if !warned {
+		t.Error("Nothing column not warned about")
+	}
+}
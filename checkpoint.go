@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Checkpoint records the order key of the last committed row of an interrupted table sync
+type Checkpoint struct {
+	// Key is the text of the order columns of the last committed row, cast back to KeyTypes when resuming
+	Key      []string  `yaml:"key"`
+	KeyTypes []string  `yaml:"key_types"`
+	LastSync time.Time `yaml:"last_sync"`
+	Until    time.Time `yaml:"until,omitempty"`
+	// LastValue is the sequence cursor position the checkpoint was taken from
+	LastValue int64 `yaml:"last_value,omitempty"`
+	// NewCursor and NewValue are saved by the interrupted sync, so the rows changed since it started
+	// are read again by the next run
+	NewCursor time.Time `yaml:"new_cursor"`
+	NewValue  int64     `yaml:"new_value,omitempty"`
+}
+
+// ResumeCheckpoint returns the checkpoint to resume from, if it was taken for the same cursor bounds
+func (t *Table) ResumeCheckpoint() *Checkpoint {
+	// A key taken with other order columns cannot be compared with them
+	if t.Checkpoint == nil || len(t.Checkpoint.Key) != len(t.GetOrderColumns()) || len(t.Checkpoint.KeyTypes) != len(t.Checkpoint.Key) {
+		return nil
+	}
+
+	if !t.Checkpoint.LastSync.Equal(t.Cursor.LastSync) || !t.Checkpoint.Until.Equal(t.Cursor.Until) || t.Checkpoint.LastValue != t.Cursor.LastValue {
+		return nil
+	}
+
+	return t.Checkpoint
+}
+
+// BatchKey is the order key of the last row of a batch, nil if it cannot be resumed from
+type BatchKey struct {
+	Values []string
+	Types  []string
+}
+
+// Checkpointer saves the key below which every batch has been committed
+type Checkpointer struct {
+	mu          sync.Mutex
+	config      Config
+	destination string
+	checkpoint  Checkpoint
+	next        int
+	keys        map[int]*BatchKey
+}
+
+// NewCheckpointer creates the checkpointer of a table sync started from the cursor bounds,
+// saving the cursor of its result
+func NewCheckpointer(config Config, destination string, cursor Cursor, result SyncResult) *Checkpointer {
+	return &Checkpointer{
+		config:      config,
+		destination: destination,
+		checkpoint: Checkpoint{
+			LastSync:  cursor.LastSync,
+			Until:     cursor.Until,
+			LastValue: cursor.LastValue,
+			NewCursor: result.NewCursor,
+			NewValue:  result.NewValue,
+		},
+		keys: map[int]*BatchKey{},
+	}
+}
+
+// Commit marks a batch as committed and saves the checkpoint if the contiguous batches moved past a key,
+// a nil checkpointer standing for a sync that is not checkpointed
+func (c *Checkpointer) Commit(index int, key *BatchKey) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.keys[index] = key
+
+	var last *BatchKey
+	for {
+		key, ok := c.keys[c.next]
+		if !ok {
+			break
+		}
+
+		delete(c.keys, c.next)
+		c.next++
+		if key != nil {
+			last = key
+		}
+	}
+
+	if last == nil {
+		return
+	}
+
+	checkpoint := c.checkpoint
+	checkpoint.Key = last.Values
+	checkpoint.KeyTypes = last.Types
+
+	if err := c.config.SaveCheckpoint(c.destination, &checkpoint); err != nil {
+		log.WithError(err).Warn("Failed to save checkpoint")
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/google/uuid"
+)
+
+func TestCheckpointerCommitNil(t *testing.T) {
+	var checkpointer *Checkpointer
+
+	// Partitioned and single merge syncs have no checkpointer, committing must not panic
+	checkpointer.Commit(0, &BatchKey{Values: []string{"10"}, Types: []string{"UInt32"}})
+}
+
+func TestCheckpointerCommitContiguous(t *testing.T) {
+	config := Config{Tables: []Table{{Destination: "events"}}}
+	lastSync := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	newCursor := lastSync.Add(time.Hour)
+	checkpointer := NewCheckpointer(config, "events", Cursor{LastSync: lastSync}, SyncResult{NewCursor: newCursor})
+	key := func(id string) *BatchKey {
+		return &BatchKey{Values: []string{id}, Types: []string{"UInt32"}}
+	}
+	saved := func() []string {
+		if config.Tables[0].Checkpoint == nil {
+			return nil
+		}
+		return config.Tables[0].Checkpoint.Key
+	}
+
+	checkpointer.Commit(1, key("20"))
+	if saved() != nil {
+		t.Fatalf("saved key %v after an out of order batch, want none", saved())
+	}
+
+	checkpointer.Commit(0, key("10"))
+	if !slices.Equal(saved(), []string{"20"}) {
+		t.Fatalf("saved key %v, want 20", saved())
+	}
+
+	// Batches without a key are passed over, the checkpoint moving on with the next key
+	checkpointer.Commit(3, nil)
+	checkpointer.Commit(2, key("30"))
+	if !slices.Equal(saved(), []string{"30"}) {
+		t.Fatalf("saved key %v, want 30", saved())
+	}
+
+	checkpoint := config.Tables[0].Checkpoint
+	if !checkpoint.LastSync.Equal(lastSync) || !checkpoint.NewCursor.Equal(newCursor) || !slices.Equal(checkpoint.KeyTypes, []string{"UInt32"}) {
+		t.Errorf("checkpoint %+v, want the bounds and cursor of the sync", checkpoint)
+	}
+}
+
+// keyedSource fakes the events source, applying the checkpoint key of its queries
+func keyedSource(rows [][]any) *fakeReader {
+	return &fakeReader{answer: func(query string, args []any) (*fakeRows, error) {
+		filtered := rows
+		for _, arg := range args {
+			if named, ok := arg.(driver.NamedValue); ok && named.Name == "key0" {
+				key, err := strconv.ParseUint(named.Value.(string), 10, 32)
+				if err != nil {
+					return nil, err
+				}
+				filtered = slices.DeleteFunc(slices.Clone(rows), func(row []any) bool {
+					return row[0].(uint32) <= uint32(key)
+				})
+			}
+		}
+		return newFakeSource(eventColumns, filtered).answer(query, args)
+	}}
+}
+
+func ptr[T any](value T) *T {
+	return &value
+}
+
+// writeConfig writes a configuration file of the events table and parses it
+func writeConfig(t *testing.T, contents string) (string, Config) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var config Config
+	if err := config.Parse(path); err != nil {
+		t.Fatal(err)
+	}
+	return path, config
+}
+
+const eventsConfig = `
+batch_size: 2
+workers: 1
+staging_run_names: true
+tables:
+  - source: events
+    destination: events
+    columns:
+      - source: id
+        destination: id
+        type: bigint
+        primary: true
+      - source: name
+        destination: name
+        type: text
+`
+
+func TestResumeAfterCrash(t *testing.T) {
+	path, config := writeConfig(t, eventsConfig)
+	config.RunID = "1"
+
+	// The sync crashes at the fourth batch, half of the rows being committed
+	pool := newFakePool()
+	pool.failures["events_run1_b3_tmp"] = errors.New("connection lost")
+	if _, err := SynchronizeTable(config, config.Tables[0], newFakeSource(eventColumns, eventRows(12)), pool); err == nil {
+		t.Fatal("SynchronizeTable succeeded despite the crash")
+	}
+
+	var resumed Config
+	if err := resumed.Parse(path); err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoint := resumed.Tables[0].Checkpoint
+	if checkpoint == nil || !slices.Equal(checkpoint.Key, []string{"6"}) || !slices.Equal(checkpoint.KeyTypes, []string{"UInt32"}) {
+		t.Fatalf("checkpoint %+v, want the key 6", checkpoint)
+	}
+
+	// A committed row deleted meanwhile does not shift the rows left to read
+	rows := slices.Delete(eventRows(12), 2, 3)
+	source := keyedSource(rows)
+	pool = newFakePool()
+	result, err := SynchronizeTable(resumed, resumed.Tables[0], source, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.RowsRead != 6 {
+		t.Errorf("resume read %d rows, want the remaining 6", result.RowsRead)
+	}
+	if pages := source.Queries("WHERE (id) > (CAST(@key0 AS UInt32))"); len(pages) == 0 {
+		t.Errorf("read %q, want the rows past the checkpoint key", source.Queries("SELECT"))
+	}
+
+	ids := []uint32{}
+	for _, row := range pool.Copied("events_") {
+		ids = append(ids, **row[0].(**uint32))
+	}
+	slices.Sort(ids)
+	if !slices.Equal(ids, []uint32{7, 8, 9, 10, 11, 12}) {
+		t.Errorf("resume copied ids %v, want 7 to 12", ids)
+	}
+}
+
+func TestResumeKeepsCursor(t *testing.T) {
+	lastSync := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	interrupted := lastSync.Add(time.Hour)
+	table := metricsTable()
+	table.Cursor.LastSync = lastSync
+	table.Checkpoint = &Checkpoint{Key: []string{"2"}, KeyTypes: []string{"UInt32"}, LastSync: lastSync, NewCursor: interrupted}
+
+	// The rows changed since the interrupted sync started are left to the next run
+	source := filteredSource([][]any{{uint32(3), lastSync.Add(time.Minute)}})
+	result, err := SynchronizeTable(Config{BatchSize: 10}, table, source, newFakePool())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.NewCursor.Equal(interrupted) {
+		t.Errorf("resume saved the cursor %v, want the start of the interrupted sync %v", result.NewCursor, interrupted)
+	}
+	if len(source.Queries("(id) > (CAST(@key0 AS UInt32))")) == 0 {
+		t.Errorf("read %q, want the rows past the checkpoint key", source.Queries("SELECT"))
+	}
+
+	// A checkpoint of other bounds is not resumed from
+	table.Cursor.LastSync = interrupted
+	source = filteredSource([][]any{{uint32(3), interrupted.Add(time.Minute)}})
+	result, err = SynchronizeTable(Config{BatchSize: 10}, table, source, newFakePool())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.NewCursor.Equal(interrupted) || len(source.Queries("@key0")) != 0 {
+		t.Errorf("resumed from the checkpoint of other bounds, saving %v", result.NewCursor)
+	}
+}
+
+func TestKeyText(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	id := uuid.MustParse("7d444840-9dc0-11d1-b245-5ffdce74fad2")
+	at := time.Date(2024, 7, 1, 14, 30, 0, 123000000, paris)
+	var null *uint32
+	tests := []struct {
+		value  any
+		chType string
+		text   string
+		ok     bool
+	}{
+		{ptr(uint32(7)), "UInt32", "7", true},
+		{ptr("sneaker"), "String", "sneaker", true},
+		{ptr(at), "DateTime64(3, 'Europe/Paris')", "2024-07-01 14:30:00.123", true},
+		{ptr(at), "Date", "2024-07-01", true},
+		{ptr(id), "UUID", "7d444840-9dc0-11d1-b245-5ffdce74fad2", true},
+		{&null, "Nullable(UInt32)", "", false},
+		{ptr([]string{"a"}), "Array(String)", "", false},
+	}
+
+	for _, test := range tests {
+		text, ok := KeyText(test.value, UnwrapType(test.chType))
+		if text != test.text || ok != test.ok {
+			t.Errorf("KeyText of %s = %q, %t, want %q, %t", test.chType, text, ok, test.text, test.ok)
+		}
+	}
+}
+
+func TestSaveReplacesFile(t *testing.T) {
+	path, config := writeConfig(t, eventsConfig)
+
+	config.Tables[0].Checkpoint = &Checkpoint{Key: []string{"4"}, KeyTypes: []string{"UInt32"}}
+	if err := config.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files in the configuration directory, want the temporary file renamed", len(entries))
+	}
+
+	var saved Config
+	if err := saved.Parse(path); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Tables[0].Checkpoint == nil || !slices.Equal(saved.Tables[0].Checkpoint.Key, []string{"4"}) {
+		t.Errorf("saved checkpoint %+v, want the key 4", saved.Tables[0].Checkpoint)
+	}
+}
+
+func TestResetCursors(t *testing.T) {
+	path, config := writeConfig(t, `
+tables:
+  - source: events
+    destination: events
+    columns:
+      - source: id
+        destination: id
+        type: bigint
+        primary: true
+    cursor:
+      column: created_at
+      last_sync: 2024-03-01T00:00:00Z
+    checkpoint:
+      key: ["100"]
+      key_types: [UInt64]
+      last_sync: 2024-03-01T00:00:00Z
+  - source: users
+    destination: users
+    columns:
+      - source: id
+        destination: id
+        type: bigint
+        primary: true
+    cursor:
+      column: updated_at
+      last_sync: 2024-03-01T00:00:00Z
+`)
+
+	if err := ResetCursors(&config, "events"); err != nil {
+		t.Fatal(err)
+	}
+
+	var saved Config
+	if err := saved.Parse(path); err != nil {
+		t.Fatal(err)
+	}
+
+	events, users := saved.Tables[0], saved.Tables[1]
+	if !events.Cursor.IsZero() || events.Checkpoint != nil {
+		t.Errorf("events saved with cursor %+v and checkpoint %+v, want them cleared", events.Cursor, events.Checkpoint)
+	}
+	if events.Cursor.Column != "created_at" {
+		t.Errorf("events cursor column %q, want it kept", events.Cursor.Column)
+	}
+	if users.Cursor.IsZero() {
+		t.Error("users cursor cleared without matching")
+	}
+}
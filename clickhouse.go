@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// Reader is the part of a ClickHouse connection reading the sources, so fakes can stand in for it
+type Reader interface {
+	Query(ctx context.Context, query string, args ...any) (driver.Rows, error)
+	QueryRow(ctx context.Context, query string, args ...any) driver.Row
+}
+
+// Sources opens the ClickHouse sources of the tables by name, so fakes can stand in for them
+type Sources interface {
+	Get(name string) (Reader, error)
+}
+
+// ClickHouseConfig describes the ClickHouse connection, CLICKHOUSE_DSN being used when no host is set
+type ClickHouseConfig struct {
+	// Host is a host:port address, or several separated by commas
+	Host     string `yaml:"host,omitempty"`
+	Database string `yaml:"database,omitempty"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	Secure   bool   `yaml:"secure,omitempty"`
+	// Compression compresses the blocks sent by ClickHouse, lz4 or zstd, saving bandwidth on slow links.
+	// The HTTP interface also accepts gzip, deflate and br.
+	Compression string `yaml:"compression,omitempty"`
+	// Protocol is native (default) or http, for servers only exposing the HTTP interface
+	Protocol string `yaml:"protocol,omitempty"`
+}
+
+const (
+	ClickHouseProtocolNative = "native"
+	ClickHouseProtocolHTTP   = "http"
+)
+
+// Validate checks the protocol and its compression method
+func (c ClickHouseConfig) Validate() error {
+	switch c.Protocol {
+	case "", ClickHouseProtocolNative, ClickHouseProtocolHTTP:
+	default:
+		return fmt.Errorf("unknown protocol %s", c.Protocol)
+	}
+
+	switch c.Compression {
+	case "", "none", "lz4", "zstd":
+	case "gzip", "deflate", "br":
+		if c.Protocol != ClickHouseProtocolHTTP {
+			return fmt.Errorf("compression %s requires the http protocol", c.Compression)
+		}
+	default:
+		return fmt.Errorf("unknown compression %s", c.Compression)
+	}
+	return nil
+}
+
+// DSN builds a connection URL from the structured configuration
+func (c ClickHouseConfig) DSN() string {
+	scheme := "clickhouse"
+	if c.Protocol == ClickHouseProtocolHTTP {
+		scheme = "http"
+		if c.Secure {
+			scheme = "https"
+		}
+	}
+
+	dsn := url.URL{
+		Scheme: scheme,
+		Host:   c.Host,
+		Path:   "/" + c.Database,
+	}
+
+	if c.Password != "" {
+		dsn.User = url.UserPassword(c.Username, c.Password)
+	} else if c.Username != "" {
+		dsn.User = url.User(c.Username)
+	}
+
+	query := url.Values{}
+	if c.Secure {
+		query.Set("secure", "true")
+	}
+	if c.Compression != "" {
+		query.Set("compress", c.Compression)
+	}
+	dsn.RawQuery = query.Encode()
+
+	return dsn.String()
+}
+
+// ClickHouseConns opens the ClickHouse connections of the tables by source name on first use
+// and reuses them, tables without a source connection reading from the clickhouse block or CLICKHOUSE_DSN
+type ClickHouseConns struct {
+	mu      sync.Mutex
+	primary ClickHouseConfig
+	dsns    map[string]string
+	conns   map[string]driver.Conn
+}
+
+// NewClickHouseConns creates the connections registry of the primary and named sources
+func NewClickHouseConns(primary ClickHouseConfig, dsns map[string]string) *ClickHouseConns {
+	return &ClickHouseConns{
+		primary: primary,
+		dsns:    dsns,
+		conns:   map[string]driver.Conn{},
+	}
+}
+
+// Get returns the connection of a named source, opening it if needed
+func (c *ClickHouseConns) Get(name string) (Reader, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if conn, ok := c.conns[name]; ok {
+		return conn, nil
+	}
+
+	dsn := os.Getenv("CLICKHOUSE_DSN")
+	if c.primary.Host != "" {
+		dsn = c.primary.DSN()
+	}
+
+	if name != "" {
+		named, ok := c.dsns[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown source connection %s", name)
+		}
+		dsn = os.ExpandEnv(named)
+	}
+
+	conn, err := OpenClickHouse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("source connection %q: %w", name, err)
+	}
+
+	c.conns[name] = conn
+	return conn, nil
+}
+
+// Ping checks every opened connection
+func (c *ClickHouseConns) Ping() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for name, conn := range c.conns {
+		if err := conn.Ping(ctx); err != nil {
+			return fmt.Errorf("source connection %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Close closes every opened connection
+func (c *ClickHouseConns) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+	c.conns = map[string]driver.Conn{}
+}
+
+// OpenClickHouse opens a ClickHouse connection labelled with the application name
+func OpenClickHouse(dsn string) (driver.Conn, error) {
+	options, err := clickhouse.ParseDSN(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("parse DSN: %w", err)
+	}
+
+	options.ClientInfo.Products = append(options.ClientInfo.Products, struct {
+		Name    string
+		Version string
+	}{Name: DefaultApplicationName})
+
+	return clickhouse.Open(options)
+}
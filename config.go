@@ -1,47 +1,759 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Tables    []Table `yaml:"tables"`
-	BatchSize int     `yaml:"batch_size"`
+	Tables     []Table          `yaml:"tables"`
+	Postgres   PostgresConfig   `yaml:"postgres,omitempty"`
+	ClickHouse ClickHouseConfig `yaml:"clickhouse,omitempty"`
+	// Destinations names Postgres connections tables can write to besides the postgres block
+	Destinations map[string]PostgresConfig `yaml:"destinations,omitempty"`
+	// Sources names ClickHouse DSNs tables can read from, environment variables being expanded
+	Sources          map[string]string `yaml:"sources,omitempty"`
+	BatchSize        int               `yaml:"batch_size"`
+	ProgressInterval time.Duration     `yaml:"progress_interval,omitempty"`
+	// CopyChunkSize splits the copy of a batch in chunks committed one by one
+	CopyChunkSize int `yaml:"copy_chunk_size,omitempty"`
+	// InsertMethod writes batches with copy (default) or insert, for proxies not permitting COPY
+	InsertMethod string `yaml:"insert_method,omitempty"`
+	// Workers bounds the batches inserted concurrently, defaulting to the Postgres pool size
+	Workers int `yaml:"workers,omitempty"`
+	// Prefetch buffers batches read ahead while every worker is busy
+	Prefetch int `yaml:"prefetch,omitempty"`
+	// StagingSchema holds regular staging tables instead of temporary ones when set
+	StagingSchema string `yaml:"staging_schema,omitempty"`
+	// StagingRunNames names staging tables after the run ID and batch index
+	StagingRunNames bool   `yaml:"staging_run_names,omitempty"`
+	RunID           string `yaml:"-"`
+	Hooks           Hooks  `yaml:"-"`
+	// NewID generates the random part of staging table names, which is a UUID prefix unless set,
+	// so generated statements can be made deterministic
+	NewID func() string `yaml:"-"`
+
+	files []configFile
+}
+
+// configFile keeps the settings of a parsed file to save its tables back to it
+type configFile struct {
+	path   string
+	config Config
 }
 
-func (c *Config) Parse(path string) error {
-	b, err := os.ReadFile(path)
+// Parse reads a configuration file, or merges every YAML file of a directory or glob pattern
+func (c *Config) Parse(pattern string) error {
+	paths, err := configPaths(pattern)
 	if err != nil {
 		return err
 	}
 
-	return yaml.Unmarshal(b, c)
+	destinations := map[string]string{}
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		var part Config
+		if err := yaml.Unmarshal(b, &part); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		for _, table := range part.Tables {
+			if other, ok := destinations[table.Destination]; ok {
+				return fmt.Errorf("duplicate destination %s in %s and %s", table.Destination, other, path)
+			}
+			destinations[table.Destination] = path
+
+			table.file = path
+			c.Tables = append(c.Tables, table)
+		}
+
+		if c.Postgres.Host == "" {
+			c.Postgres = part.Postgres
+		}
+		if c.ClickHouse.Host == "" {
+			c.ClickHouse = part.ClickHouse
+		}
+		for name, destination := range part.Destinations {
+			if c.Destinations == nil {
+				c.Destinations = map[string]PostgresConfig{}
+			}
+			if _, ok := c.Destinations[name]; !ok {
+				c.Destinations[name] = destination
+			}
+		}
+		for name, dsn := range part.Sources {
+			if c.Sources == nil {
+				c.Sources = map[string]string{}
+			}
+			if _, ok := c.Sources[name]; !ok {
+				c.Sources[name] = dsn
+			}
+		}
+		if c.BatchSize == 0 {
+			c.BatchSize = part.BatchSize
+		}
+		if c.ProgressInterval == 0 {
+			c.ProgressInterval = part.ProgressInterval
+		}
+		if c.CopyChunkSize == 0 {
+			c.CopyChunkSize = part.CopyChunkSize
+		}
+		if c.InsertMethod == "" {
+			c.InsertMethod = part.InsertMethod
+		}
+		if c.Workers == 0 {
+			c.Workers = part.Workers
+		}
+		if c.Prefetch == 0 {
+			c.Prefetch = part.Prefetch
+		}
+		if c.StagingSchema == "" {
+			c.StagingSchema = part.StagingSchema
+		}
+		c.StagingRunNames = c.StagingRunNames || part.StagingRunNames
+
+		part.Tables = nil
+		c.files = append(c.files, configFile{path: path, config: part})
+	}
+
+	return c.Validate()
 }
 
-func (c *Config) Save(path string) error {
-	b, err := yaml.Marshal(&c)
+// configPaths resolves a file, a directory or a glob pattern to configuration files
+func configPaths(pattern string) ([]string, error) {
+	info, err := os.Stat(pattern)
+	if err == nil && !info.IsDir() {
+		return []string{pattern}, nil
+	}
+
+	if err == nil {
+		pattern = filepath.Join(pattern, "*.yml")
+	}
+
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no configuration file matches %s", pattern)
+	}
+
+	return paths, nil
+}
+
+// Validate checks the tables for inconsistent settings, reporting every problem found
+func (c *Config) Validate() error {
+	errs := []error{}
+	switch c.InsertMethod {
+	case "", InsertMethodCopy, InsertMethodInsert:
+	default:
+		errs = append(errs, fmt.Errorf("unknown insert method %s", c.InsertMethod))
+	}
+
+	if err := c.ClickHouse.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("clickhouse: %w", err))
+	}
+
+	for _, table := range c.Tables {
+		if err := table.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("table %s: %w", table.Destination, err))
+		}
+
+		if _, ok := c.Sources[table.SourceConn]; table.SourceConn != "" && !ok {
+			errs = append(errs, fmt.Errorf("table %s: unknown source_conn %s", table.Destination, table.SourceConn))
+		}
+
+		if _, ok := c.Destinations[table.DestinationConn]; table.DestinationConn != "" && !ok {
+			errs = append(errs, fmt.Errorf("table %s: unknown destination_conn %s", table.Destination, table.DestinationConn))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// HasMatch reports whether at least one table matches a glob pattern
+func (c *Config) HasMatch(pattern string) bool {
+	for _, table := range c.Tables {
+		if table.Matches(pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// Save writes every table back to the file it was parsed from
+func (c *Config) Save() error {
+	for _, file := range c.files {
+		part := file.config
+		for _, table := range c.Tables {
+			if table.file == file.path {
+				part.Tables = append(part.Tables, table)
+			}
+		}
+
+		b, err := yaml.Marshal(&part)
+		if err != nil {
+			return err
+		}
+
+		if err := writeFileAtomic(file.path, b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeFileAtomic replaces a file by renaming a complete copy over it, so a crash while writing,
+// which checkpoints make likely, cannot leave the file truncated
+func writeFileAtomic(name string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.tmp")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(tmp.Name())
 
-	return os.WriteFile(path, b, 0644)
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), name)
+}
+
+// SaveCheckpoint stores the checkpoint of a table and saves the configuration it was parsed from
+func (c *Config) SaveCheckpoint(destination string, checkpoint *Checkpoint) error {
+	for i := range c.Tables {
+		if c.Tables[i].Destination == destination {
+			c.Tables[i].Checkpoint = checkpoint
+		}
+	}
+
+	return c.Save()
 }
 
 type Table struct {
-	Source      string   `yaml:"source"`
-	Destination string   `yaml:"destination"`
-	Indexes     []Index  `yaml:"indexes"`
-	Columns     []Column `yaml:"columns"`
-	Cursor      Cursor   `yaml:"cursor"`
+	Source      string `yaml:"source"`
+	Destination string `yaml:"destination"`
+	// SourceDatabase qualifies the source table when it is not a db.table name,
+	// the connection database being used otherwise
+	SourceDatabase string `yaml:"source_database,omitempty"`
+	// SourceConn names the ClickHouse source to read from, CLICKHOUSE_DSN being used when empty
+	SourceConn string `yaml:"source_conn,omitempty"`
+	// DestinationConn names the Postgres destination to write to, the postgres block being used when empty
+	DestinationConn string `yaml:"destination_conn,omitempty"`
+	// SourceQuery replicates the result of a ClickHouse query instead of the source table
+	SourceQuery string `yaml:"source_query,omitempty"`
+	// Where filters the replicated source rows, ANDed with the cursor bounds
+	Where string `yaml:"where,omitempty"`
+	// ClickHouseSettings are attached to the queries reading the source, such as
+	// do_not_merge_across_partitions_select_final to speed up FINAL
+	ClickHouseSettings map[string]interface{} `yaml:"clickhouse_settings,omitempty"`
+	// OrderBy lists the source columns paginating the source, defaulting to the primary key
+	OrderBy []string `yaml:"order_by,omitempty"`
+	// OrderDirection is either asc (default) or desc, and OrderNulls either first or last,
+	// nullable order columns paging stably only with an explicit NULLS placement
+	OrderDirection string `yaml:"order_direction,omitempty"`
+	OrderNulls     string `yaml:"order_nulls,omitempty"`
+	// CreateIndexes creates the indexes with the table (before_load, default), once the rows are loaded
+	// (after_load) or never, the unique index targeted by the upsert being always created with the table
+	CreateIndexes string `yaml:"create_indexes,omitempty"`
+	// RebuildIndexes drops the indexes not targeted by the upsert before full loads and recreates them after,
+	// as RebuildPrimaryKey does with the primary key of append-only tables
+	RebuildIndexes    bool `yaml:"rebuild_indexes,omitempty"`
+	RebuildPrimaryKey bool `yaml:"rebuild_primary_key,omitempty"`
+	// PrimaryKeyMode enforces the primary columns with a primary key constraint (default), a unique index,
+	// or nothing, upserts then needing conflict_columns backed by a unique index
+	PrimaryKeyMode string `yaml:"primary_key_mode,omitempty"`
+	// IncludeColumns and ExcludeColumns discover the source columns not configured,
+	// only the included ones if set and without the excluded ones
+	IncludeColumns []string `yaml:"include_columns,omitempty"`
+	ExcludeColumns []string `yaml:"exclude_columns,omitempty"`
+	Indexes        []Index  `yaml:"indexes"`
+	Columns        []Column `yaml:"columns"`
+	Cursor         Cursor   `yaml:"cursor"`
+	Verify         bool     `yaml:"verify,omitempty"`
+	// VerifyBatches fails a batch whose copied row count differs from the rows read, before it is merged
+	VerifyBatches bool `yaml:"verify_batches,omitempty"`
+	// Checkpoint is set while a table sync is in progress to resume it after a crash
+	Checkpoint *Checkpoint `yaml:"checkpoint,omitempty"`
+	// AutoMigrate renames and adds destination columns to match the configuration
+	AutoMigrate bool `yaml:"auto_migrate,omitempty"`
+	// CopyComments applies the ClickHouse column comments to the Postgres columns
+	CopyComments bool `yaml:"copy_comments,omitempty"`
+	// MigrateDrops also drops destination columns no longer configured
+	MigrateDrops bool `yaml:"migrate_drops,omitempty"`
+	// Mode is either upsert (default) or append, which inserts rows without merging them
+	Mode string `yaml:"mode,omitempty"`
+	// ConflictColumns overrides the primary key as the upsert conflict target,
+	// it must match an existing unique constraint or index
+	ConflictColumns []string `yaml:"conflict_columns,omitempty"`
+	// ConflictAction is either update (default) or nothing
+	ConflictAction string `yaml:"conflict_action,omitempty"`
+	// ExcludeFromUpdate lists destination columns left untouched on conflict
+	ExcludeFromUpdate []string `yaml:"exclude_from_update,omitempty"`
+	// DedupInMerge keeps one row per conflict key when merging (default), an arbitrary one among the rows sharing it,
+	// which tables unique per batch can disable to skip the sort, a repeated key then failing the merge
+	DedupInMerge *bool `yaml:"dedup_in_merge,omitempty"`
+	// SkipUnchanged only updates conflicting rows when a column differs
+	SkipUnchanged bool `yaml:"skip_unchanged,omitempty"`
+	// ReportDuplicates counts the rows of a batch sharing a conflict key, deduplicated on merge
+	ReportDuplicates bool `yaml:"report_duplicates,omitempty"`
+	// Interval overrides how often a daemon synchronizes the table
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// Partitioned reads the source partition by partition, from PartitionsFrom if set
+	Partitioned    bool   `yaml:"partitioned,omitempty"`
+	PartitionsFrom string `yaml:"partitions_from,omitempty"`
+	// Partition is the partition ID being read, if any
+	Partition string `yaml:"-"`
+	// PartitionBy range partitions the destination, partitions being created as rows reach them
+	PartitionBy *PartitionBy `yaml:"partition_by,omitempty"`
+	// SingleMerge copies every batch into one staging table merged once at the end
+	SingleMerge bool `yaml:"single_merge,omitempty"`
+	// EstimateCount estimates the rows to read from system.parts for the progress, instead of counting them,
+	// the read stopping at the end of the data
+	EstimateCount bool `yaml:"estimate_count,omitempty"`
+	// Retention deletes the destination rows whose cursor is older than this after each sync,
+	// following the TTL of the source
+	Retention time.Duration `yaml:"retention,omitempty"`
+
+	file string
+}
+
+// MaxColumns is the Postgres limit of columns per table
+const MaxColumns = 1600
+
+// WideColumns is the column count above which batches may use a lot of memory
+const WideColumns = 250
+
+const (
+	InsertMethodCopy   = "copy"
+	InsertMethodInsert = "insert"
+)
+
+const (
+	ModeUpsert = "upsert"
+	ModeAppend = "append"
+)
+
+const (
+	PrimaryKeyModeConstraint  = "constraint"
+	PrimaryKeyModeUniqueIndex = "unique_index"
+	PrimaryKeyModeNone        = "none"
+)
+
+const (
+	ConflictActionUpdate  = "update"
+	ConflictActionNothing = "nothing"
+)
+
+// Validate checks the conflict settings against the table columns
+func (t *Table) Validate() error {
+	switch t.ConflictAction {
+	case "", ConflictActionUpdate, ConflictActionNothing:
+	default:
+		return fmt.Errorf("unknown conflict action %s", t.ConflictAction)
+	}
+
+	if t.Source == "" && t.SourceQuery == "" {
+		return errors.New("source or source_query is required")
+	}
+
+	if t.Where != "" && strings.TrimSpace(t.Where) == "" {
+		return errors.New("where cannot be blank")
+	}
+
+	if t.SourceQuery != "" && t.Partitioned {
+		return errors.New("source_query cannot be partitioned")
+	}
+
+	if t.SourceQuery != "" && t.Mode != ModeAppend && len(t.GetPrimaryKey()) == 0 && len(t.OrderBy) == 0 {
+		return errors.New("source_query requires a primary column or order_by to order its result")
+	}
+
+	if t.PartitionBy != nil {
+		if err := t.PartitionBy.Validate(t); err != nil {
+			return err
+		}
+	}
+
+	if t.EstimateCount && t.SourceQuery != "" {
+		return errors.New("estimate_count requires a source table")
+	}
+
+	if t.Retention > 0 && (t.Cursor.Column == "" || t.Cursor.IsSequence()) {
+		return errors.New("retention requires a time cursor")
+	}
+
+	for _, name := range t.ExcludeColumns {
+		if name == t.Cursor.Column {
+			return fmt.Errorf("cursor column %s cannot be excluded", name)
+		}
+
+		for _, column := range t.Columns {
+			if column.Source == name {
+				return fmt.Errorf("configured column %s cannot be excluded", name)
+			}
+		}
+	}
+
+	if t.RebuildPrimaryKey && t.Mode != ModeAppend {
+		return errors.New("rebuild_primary_key requires append mode, upserts relying on the primary key")
+	}
+
+	// Appended rows read again are inserted twice
+	if t.Cursor.Lookback > 0 && t.Mode == ModeAppend {
+		return errors.New("lookback cannot be used with append mode, rows read again being inserted twice")
+	}
+
+	switch t.Cursor.Type {
+	case "", CursorTypeTime:
+	case CursorTypeSequence:
+		if t.Cursor.Lookback > 0 || t.Cursor.MaxWindow > 0 {
+			return errors.New("lookback and max_window only apply to time cursors")
+		}
+	default:
+		return fmt.Errorf("unknown cursor type %s", t.Cursor.Type)
+	}
+
+	switch t.PrimaryKeyMode {
+	case "", PrimaryKeyModeConstraint, PrimaryKeyModeUniqueIndex:
+	case PrimaryKeyModeNone:
+		if t.Mode != ModeAppend && len(t.ConflictColumns) == 0 {
+			return errors.New("primary_key_mode none requires conflict_columns backed by a unique index, or the append mode")
+		}
+	default:
+		return fmt.Errorf("unknown primary_key_mode %s", t.PrimaryKeyMode)
+	}
+
+	switch t.CreateIndexes {
+	case "", CreateIndexesBeforeLoad, CreateIndexesAfterLoad, CreateIndexesNever:
+	default:
+		return fmt.Errorf("unknown create_indexes %s", t.CreateIndexes)
+	}
+
+	switch strings.ToLower(t.OrderDirection) {
+	case "", "asc", "desc":
+	default:
+		return fmt.Errorf("unknown order direction %s", t.OrderDirection)
+	}
+
+	switch strings.ToLower(t.OrderNulls) {
+	case "", "first", "last":
+	default:
+		return fmt.Errorf("unknown order nulls %s", t.OrderNulls)
+	}
+
+	for _, name := range t.OrderBy {
+		if !slices.Contains(t.GetSourceColumns(), name) {
+			return fmt.Errorf("order_by column %s is not a source column", name)
+		}
+	}
+
+	if len(t.Columns) > MaxColumns {
+		return fmt.Errorf("%d columns exceed the Postgres limit of %d", len(t.Columns), MaxColumns)
+	}
+
+	switch t.Mode {
+	case "", ModeUpsert, ModeAppend:
+	default:
+		return fmt.Errorf("unknown mode %s", t.Mode)
+	}
+
+	// Each column pairs its source with its destination, copied by destination name,
+	// so a missing or repeated destination would misalign the copied values
+	destinations := map[string]bool{}
+	for _, column := range t.Columns {
+		if column.Destination == "" {
+			return fmt.Errorf("column %s has no destination", column.Source)
+		}
+		if destinations[column.Destination] {
+			return fmt.Errorf("duplicate destination column %s", column.Destination)
+		}
+		destinations[column.Destination] = true
+	}
+
+	for _, column := range t.Columns {
+		if column.Source == "" && column.Primary {
+			return fmt.Errorf("destination-only column %s cannot be primary", column.Destination)
+		}
+
+		if column.Type != "" {
+			base, collation, err := ParseColumnType(column.Type)
+			if err != nil {
+				return fmt.Errorf("column %s: %w", column.Destination, err)
+			}
+
+			if family := postgresFamilies[base]; collation != "" && family != "" && family != "text" {
+				return fmt.Errorf("column %s: collations only apply to text types, not %s", column.Destination, base)
+			}
+		}
+
+		if column.Timezone != "" {
+			if _, err := time.LoadLocation(column.Timezone); err != nil {
+				return fmt.Errorf("column %s: %w", column.Source, err)
+			}
+		}
+
+		switch column.EnumAs {
+		case "", EnumAsText, EnumAsNumber:
+		default:
+			return fmt.Errorf("unknown enum_as %s for column %s", column.EnumAs, column.Source)
+		}
+
+		switch column.FixedStringAs {
+		case "", FixedStringAsText, FixedStringAsChar, FixedStringAsBytea:
+		default:
+			return fmt.Errorf("unknown fixed_string_as %s for column %s", column.FixedStringAs, column.Source)
+		}
+	}
+
+	if t.Mode != ModeAppend && len(t.GetConflictColumns()) == 0 {
+		return errors.New("no primary key or conflict columns to upsert on, use the append mode instead")
+	}
+
+	for _, name := range t.ConflictColumns {
+		found := false
+		for _, column := range t.Columns {
+			if column.Destination == name {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("unknown conflict column %s", name)
+		}
+	}
+	return nil
+}
+
+// GetName returns the source name, or the destination for query sources
+func (t *Table) GetName() string {
+	if t.Source != "" {
+		return t.Source
+	}
+	return t.Destination
+}
+
+// DiscoversColumns reports whether the source columns not configured are replicated too
+func (t *Table) DiscoversColumns() bool {
+	return len(t.IncludeColumns) > 0 || len(t.ExcludeColumns) > 0
+}
+
+// Discovers reports whether a source column not configured is replicated
+func (t *Table) Discovers(name string) bool {
+	if !t.DiscoversColumns() || slices.Contains(t.ExcludeColumns, name) {
+		return false
+	}
+
+	if len(t.IncludeColumns) > 0 && !slices.Contains(t.IncludeColumns, name) {
+		return false
+	}
+
+	for _, column := range t.Columns {
+		if column.Source == name {
+			return false
+		}
+	}
+
+	return true
+}
+
+// GetWhereClause returns the WHERE clause applying the table filter, if any
+func (t *Table) GetWhereClause() string {
+	if t.Where == "" {
+		return ""
+	}
+	return fmt.Sprintf(" WHERE (%s)", t.Where)
+}
+
+// GetSourceTable returns the source table, qualified with the source database unless it already is
+func (t *Table) GetSourceTable() string {
+	if t.SourceDatabase == "" || strings.Contains(t.Source, ".") {
+		return t.Source
+	}
+	return fmt.Sprintf("%s.%s", t.SourceDatabase, t.Source)
+}
+
+// GetSourceExpression returns the FROM expression reading the source, merged with FINAL for tables
+func (t *Table) GetSourceExpression() string {
+	if t.SourceQuery != "" {
+		return fmt.Sprintf("(%s) AS src", t.SourceQuery)
+	}
+	return fmt.Sprintf("%s FINAL", t.GetSourceTable())
+}
+
+// GetDescribeTarget returns the target of a DESCRIBE statement on the source
+func (t *Table) GetDescribeTarget() string {
+	if t.SourceQuery != "" {
+		return fmt.Sprintf("(%s)", t.SourceQuery)
+	}
+	return fmt.Sprintf("TABLE %s", t.GetSourceTable())
+}
+
+// Matches reports whether the table source or destination matches a glob pattern
+func (t *Table) Matches(pattern string) bool {
+	for _, name := range []string{t.Source, t.Destination} {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSelectExpressions returns the expressions selecting the columns from ClickHouse
+func (t *Table) GetSelectExpressions() []string {
+	expressions := []string{}
+	for _, column := range t.Columns {
+		if column.Source != "" {
+			expressions = append(expressions, column.GetSelectExpression())
+		}
+	}
+	return expressions
+}
+
+// GetSelectNames returns the names ClickHouse returns the selected columns under, in select order
+func (t *Table) GetSelectNames() []string {
+	names := []string{}
+	for _, column := range t.Columns {
+		if column.Source != "" {
+			names = append(names, column.GetSelectName())
+		}
+	}
+	return names
+}
+
+// GetLocations returns the timezone of every source column, in select order
+func (t *Table) GetLocations() []*time.Location {
+	locations := []*time.Location{}
+	for _, column := range t.Columns {
+		if column.Source == "" {
+			continue
+		}
+
+		var location *time.Location
+		if column.Timezone != "" {
+			// Timezones are checked when validating the configuration
+			location, _ = time.LoadLocation(column.Timezone)
+		}
+		locations = append(locations, location)
+	}
+	return locations
+}
+
+// GetFixedStringAs returns how every source column is replicated if it is a FixedString, in select order
+func (t *Table) GetFixedStringAs() []string {
+	values := []string{}
+	for _, column := range t.Columns {
+		if column.Source != "" {
+			values = append(values, column.FixedStringAs)
+		}
+	}
+	return values
+}
+
+// GetNullAs returns the NULL replacement of every source column, in select order
+func (t *Table) GetNullAs() []*string {
+	values := []*string{}
+	for _, column := range t.Columns {
+		if column.Source != "" {
+			values = append(values, column.NullAs)
+		}
+	}
+	return values
 }
 
 func (t *Table) GetSourceColumns() []string {
 	names := []string{}
 	for _, column := range t.Columns {
-		names = append(names, column.Source)
+		if column.Source != "" {
+			names = append(names, column.Source)
+		}
+	}
+	return names
+}
+
+// GetOrderColumns returns the columns paginating the source: the order_by columns, the first primary
+// column, or every source column for append-only tables without a primary key
+func (t *Table) GetOrderColumns() []string {
+	if len(t.OrderBy) > 0 {
+		return t.OrderBy
+	}
+
+	for _, column := range t.Columns {
+		if column.Primary {
+			return []string{column.Source}
+		}
+	}
+
+	return t.GetSourceColumns()
+}
+
+// GetOrderIndexes returns the select index of every order column, nil if one is not a selected source column
+func (t *Table) GetOrderIndexes() []int {
+	names := t.GetSourceColumns()
+	indexes := []int{}
+	for _, column := range t.GetOrderColumns() {
+		i := slices.Index(names, column)
+		if i < 0 {
+			return nil
+		}
+		indexes = append(indexes, i)
+	}
+	return indexes
+}
+
+// GetOrderBy returns the ORDER BY expression paginating the source, with the configured direction
+// and NULLS placement applied to every column
+func (t *Table) GetOrderBy() string {
+	suffix := ""
+	if t.OrderDirection != "" {
+		suffix += " " + strings.ToUpper(t.OrderDirection)
+	}
+	if t.OrderNulls != "" {
+		suffix += " NULLS " + strings.ToUpper(t.OrderNulls)
+	}
+
+	columns := []string{}
+	for _, column := range t.GetOrderColumns() {
+		columns = append(columns, column+suffix)
+	}
+	return strings.Join(columns, ", ")
+}
+
+// GetCopyColumns returns the destination columns copied from ClickHouse, in select order
+func (t *Table) GetCopyColumns() []string {
+	names := []string{}
+	for _, column := range t.Columns {
+		if column.Source != "" {
+			names = append(names, column.Destination)
+		}
 	}
 	return names
 }
@@ -64,19 +776,216 @@ func (t *Table) GetPrimaryKey() []string {
 	return names
 }
 
+// GetUpdateColumns returns the destination columns updated on conflict
+func (t *Table) GetUpdateColumns() []string {
+	names := []string{}
+	for _, name := range t.GetDestinationColumns() {
+		if !slices.Contains(t.ExcludeFromUpdate, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// GetConflictColumns returns the upsert conflict target, defaulting to the primary key
+func (t *Table) GetConflictColumns() []string {
+	if len(t.ConflictColumns) > 0 {
+		return t.ConflictColumns
+	}
+	return t.GetPrimaryKey()
+}
+
+// GetCursorDestination returns the destination column mapped to the cursor, if any
+func (t *Table) GetCursorDestination() string {
+	// Destination-only columns have no source, which an unset cursor column would match
+	if t.Cursor.Column == "" {
+		return ""
+	}
+
+	for _, column := range t.Columns {
+		if column.Source == t.Cursor.Column {
+			return column.Destination
+		}
+	}
+	return ""
+}
+
 type Column struct {
 	Source      string `yaml:"source"`
 	Destination string `yaml:"destination"`
 	Type        string `yaml:"type"`
 	Primary     bool   `yaml:"primary"`
+	// Default is the SQL default of the destination column, destination-only columns
+	// without a source are filled with it
+	Default string `yaml:"default,omitempty"`
+	// EnumAs replicates enums as their text label (default) or their number
+	EnumAs string `yaml:"enum_as,omitempty"`
+	// NullAs replaces NULL source values, parsed as the destination type, for NOT NULL columns
+	NullAs *string `yaml:"null_as,omitempty"`
+	// Timezone converts times before copying them, setting the wall clock stored by timestamp columns
+	Timezone string `yaml:"timezone,omitempty"`
+	// FixedStringAs replicates FixedString(N) values trimmed of their NUL padding as text (default) or char(N),
+	// or padded as bytea
+	FixedStringAs string `yaml:"fixed_string_as,omitempty"`
+}
+
+const (
+	EnumAsText   = "text"
+	EnumAsNumber = "number"
+)
+
+const (
+	FixedStringAsText  = "text"
+	FixedStringAsChar  = "char"
+	FixedStringAsBytea = "bytea"
+)
+
+// GetDefinition returns the column definition used to create it in Postgres
+func (c *Column) GetDefinition() string {
+	if c.Default != "" {
+		return fmt.Sprintf("%s %s DEFAULT %s", QuoteIdentifier(c.Destination), c.Type, c.Default)
+	}
+	return fmt.Sprintf("%s %s", QuoteIdentifier(c.Destination), c.Type)
+}
+
+// GetSelectExpression returns the expression selecting the column from ClickHouse
+func (c *Column) GetSelectExpression() string {
+	if castType := c.castType(); castType != "" {
+		return fmt.Sprintf("CAST(%s AS %s) AS %s", c.Source, castType, c.GetSelectName())
+	}
+	return c.Source
+}
+
+// GetSelectName returns the name ClickHouse returns the column under. Cast columns are aliased apart
+// from their source, as ClickHouse resolves aliases in WHERE and ORDER BY.
+func (c *Column) GetSelectName() string {
+	if c.castType() != "" {
+		return fmt.Sprintf("`%s_cast`", strings.Trim(c.Source, "`\""))
+	}
+	return c.Source
+}
+
+// castType returns the ClickHouse type the column is cast to when selected, if any
+func (c *Column) castType() string {
+	if c.EnumAs == EnumAsNumber {
+		return "Int16"
+	}
+
+	// Bool and UInt8 flags are scanned as bool so pgx can copy them into boolean columns
+	if c.Type == "boolean" {
+		return "Nullable(Bool)"
+	}
+	return ""
 }
 
 type Cursor struct {
-	Column   string    `yaml:"column"`
-	LastSync time.Time `yaml:"last_sync"`
+	Column string `yaml:"column"`
+	// Type is time for date cursors or sequence for monotonically increasing integer cursors
+	Type     string        `yaml:"type,omitempty"`
+	LastSync time.Time     `yaml:"last_sync"`
+	Lookback time.Duration `yaml:"lookback,omitempty"`
+	// LastValue is the highest sequence value synchronized
+	LastValue int64 `yaml:"last_value,omitempty"`
+	// MaxWindow caps how far a single run advances the cursor
+	MaxWindow time.Duration `yaml:"max_window,omitempty"`
+	// Until is the upper cursor bound of the current run, if any
+	Until time.Time `yaml:"-"`
+	// UntilValue is the upper sequence bound of the current run, if any
+	UntilValue int64 `yaml:"-"`
+}
+
+const (
+	CursorTypeTime     = "time"
+	CursorTypeSequence = "sequence"
+)
+
+// IsSequence reports whether the cursor is an integer sequence rather than a date
+func (c *Cursor) IsSequence() bool {
+	return c.Type == CursorTypeSequence
+}
+
+// IsZero reports whether the cursor has no position yet
+func (c *Cursor) IsZero() bool {
+	if c.IsSequence() {
+		return c.LastValue == 0
+	}
+	return c.LastSync.IsZero()
+}
+
+// Reset clears the cursor position so the next run synchronizes in full
+func (c *Cursor) Reset() {
+	c.LastSync = time.Time{}
+	c.LastValue = 0
 }
 
 type Index struct {
 	Name    string   `yaml:"name"`
 	Columns []string `yaml:"columns"`
+	Unique  bool     `yaml:"unique,omitempty"`
+	// FullName overrides the generated <destination>_<name> index name
+	FullName string `yaml:"full_name,omitempty"`
+}
+
+// GetIndexName returns the name of an index, prefixed by the destination table name without its schema
+// as indexes live in the schema of their table
+func (t *Table) GetIndexName(index Index) string {
+	if index.FullName != "" {
+		return index.FullName
+	}
+
+	_, name := splitQualified(t.Destination)
+	return TruncateIdentifier(fmt.Sprintf("%s_%s", name, index.Name))
+}
+
+// GetPrimaryKeyIndex returns the unique index standing for the primary key with the unique_index mode
+func (t *Table) GetPrimaryKeyIndex() Index {
+	return Index{Name: "pkey", Columns: t.GetPrimaryKey(), Unique: true}
+}
+
+// GetQualifiedIndexName returns the index name qualified with the destination schema, if any
+func (t *Table) GetQualifiedIndexName(index Index) string {
+	schema, _ := splitQualified(t.Destination)
+	if schema == "" {
+		return t.GetIndexName(index)
+	}
+	return fmt.Sprintf("%s.%s", schema, t.GetIndexName(index))
+}
+
+// splitQualified splits a schema qualified name, the schema being empty if unqualified
+func splitQualified(name string) (string, string) {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
+
+const (
+	CreateIndexesBeforeLoad = "before_load"
+	CreateIndexesAfterLoad  = "after_load"
+	CreateIndexesNever      = "never"
+)
+
+// IsFullLoad reports whether the table is synchronized in full, having no cursor or no last sync yet
+func (t *Table) IsFullLoad() bool {
+	return t.Cursor.Column == "" || t.Cursor.IsZero()
+}
+
+// DefersIndex reports whether an index is not created with the table, which the unique index
+// targeted by the upsert always is
+func (t *Table) DefersIndex(index Index) bool {
+	if t.CreateIndexes != CreateIndexesAfterLoad && t.CreateIndexes != CreateIndexesNever {
+		return false
+	}
+
+	if index.Unique && t.Mode != ModeAppend {
+		conflict := slices.Clone(t.GetConflictColumns())
+		columns := slices.Clone(index.Columns)
+		slices.Sort(conflict)
+		slices.Sort(columns)
+		if slices.Equal(conflict, columns) {
+			return false
+		}
+	}
+
+	return true
 }
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTableMatches(t *testing.T) {
+	table := Table{Source: "analytics.events", Destination: "public.events"}
+
+	tests := []struct {
+		pattern string
+		want    bool
+	}{
+		{"analytics.events", true},
+		{"public.events", true},
+		{"analytics.*", true},
+		{"public.*", true},
+		{"*.events", true},
+		{"*", true},
+		{"analytics.ev?nts", true},
+		{"analytics.[ef]vents", true},
+		{"events", false},
+		{"private.*", false},
+		{"analytics", false},
+		{"[", false},
+	}
+
+	for _, test := range tests {
+		if got := table.Matches(test.pattern); got != test.want {
+			t.Errorf("Matches(%q) = %v, want %v", test.pattern, got, test.want)
+		}
+	}
+}
+
+func TestConfigHasMatch(t *testing.T) {
+	config := Config{Tables: []Table{
+		{Source: "analytics.events", Destination: "public.events"},
+		{Source: "analytics.users", Destination: "crm.users"},
+	}}
+
+	for pattern, want := range map[string]bool{
+		"crm.*":         true,
+		"analytics.us*": true,
+		"public.users":  false,
+		"billing.*":     false,
+	} {
+		if got := config.HasMatch(pattern); got != want {
+			t.Errorf("HasMatch(%q) = %v, want %v", pattern, got, want)
+		}
+	}
+}
+
+// syncedTable is the events table with a destination-only column filled by its default
+func syncedTable() Table {
+	table := eventsTable()
+	table.Columns = append(table.Columns, Column{Destination: "synced_at", Type: "timestamptz", Default: "now()"})
+	return table
+}
+
+func TestDestinationOnlyColumn(t *testing.T) {
+	table := syncedTable()
+	if err := table.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if columns := table.GetCopyColumns(); !slices.Equal(columns, []string{"id", "name"}) {
+		t.Errorf("copy columns %v, want the source columns only", columns)
+	}
+
+	db := newFakeDB()
+	if err := CreatePostgresTable(table, db); err != nil {
+		t.Fatal(err)
+	}
+	if want := "CREATE TABLE IF NOT EXISTS events (id bigint, name text, synced_at timestamptz DEFAULT now())"; db.statements[0] != want {
+		t.Errorf("created the table with %q, want %q", db.statements[0], want)
+	}
+}
+
+func TestGetCursorDestination(t *testing.T) {
+	table := syncedTable()
+	if cursor := table.GetCursorDestination(); cursor != "" {
+		t.Errorf("cursor destination %q without a cursor, want none", cursor)
+	}
+
+	table.Columns = append(table.Columns, Column{Source: "UpdatedAt", Destination: "updated_at", Type: "timestamptz"})
+	table.Cursor.Column = "UpdatedAt"
+	if cursor := table.GetCursorDestination(); cursor != "updated_at" {
+		t.Errorf("cursor destination %q, want updated_at", cursor)
+	}
+}
+
+func TestGetSelectExpressionsAlias(t *testing.T) {
+	table := Table{Source: "accounts", Where: "status = 'active' AND active", Columns: []Column{
+		{Source: "id", Destination: "id", Type: "bigint", Primary: true},
+		{Source: "status", Destination: "status", EnumAs: EnumAsNumber},
+		{Source: "active", Destination: "active", Type: "boolean"},
+	}}
+
+	// Cast columns are aliased apart, so the where and order still see the source columns
+	want := []string{"id", "CAST(status AS Int16) AS `status_cast`", "CAST(active AS Nullable(Bool)) AS `active_cast`"}
+	if expressions := table.GetSelectExpressions(); !slices.Equal(expressions, want) {
+		t.Errorf("select expressions %q, want %q", expressions, want)
+	}
+
+	if names := table.GetSelectNames(); !slices.Equal(names, []string{"id", "`status_cast`", "`active_cast`"}) {
+		t.Errorf("select names %q", names)
+	}
+	if err := CheckColumnOrder(table.GetSelectNames(), []string{"id", "status_cast", "active_cast"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConfigParseValidates(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		want     []string
+	}{
+		{"valid", eventsConfig, nil},
+		{"unknown insert method", "insert_method: upload\n" + eventsConfig, []string{"unknown insert method upload"}},
+		{"missing source", `
+tables:
+  - destination: events
+    conflict_action: ignore
+  - destination: users
+`, []string{"table events: unknown conflict action ignore", "table users: source or source_query is required"}},
+		{"unknown source", `
+tables:
+  - source: events
+    destination: events
+    source_conn: archive
+`, []string{"unknown source_conn archive"}},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "config.yml")
+		if err := os.WriteFile(path, []byte(test.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var config Config
+		err := config.Parse(path)
+		if test.want == nil && err != nil {
+			t.Errorf("%s: Parse() = %v, want no error", test.name, err)
+		}
+		if test.want != nil && err == nil {
+			t.Errorf("%s: Parse() succeeded, want %q", test.name, test.want)
+		}
+
+		// Every problem is reported at once
+		for _, want := range test.want {
+			if err != nil && !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: Parse() = %v, want %q", test.name, err, want)
+			}
+		}
+	}
+}
+
+func TestConfigParseDirectory(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"events.yml": `
+batch_size: 100
+tables:
+  - source: events
+    destination: events
+    columns:
+      - source: id
+        destination: id
+        primary: true
+    cursor:
+      column: created_at
+`,
+		"users.yml": `
+batch_size: 500
+workers: 2
+tables:
+  - source: users
+    destination: users
+    columns:
+      - source: id
+        destination: id
+        primary: true
+`,
+		"notes.txt": "not a configuration",
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var config Config
+	if err := config.Parse(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.Tables) != 2 || config.Tables[0].Destination != "events" || config.Tables[1].Destination != "users" {
+		t.Fatalf("parsed tables %+v, want events and users", config.Tables)
+	}
+	if config.BatchSize != 100 || config.Workers != 2 {
+		t.Errorf("batch size %d and workers %d, want the first set: 100 and 2", config.BatchSize, config.Workers)
+	}
+
+	// Each table is saved back to the file it came from
+	config.Tables[0].Cursor.LastSync = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	if err := config.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	var events, users Config
+	if err := events.Parse(filepath.Join(dir, "events.yml")); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Parse(filepath.Join(dir, "users.yml")); err != nil {
+		t.Fatal(err)
+	}
+	if len(events.Tables) != 1 || events.Tables[0].Cursor.LastSync.IsZero() || events.BatchSize != 100 {
+		t.Errorf("events.yml saved as %+v", events)
+	}
+	if len(users.Tables) != 1 || users.Tables[0].Destination != "users" || users.BatchSize != 500 {
+		t.Errorf("users.yml saved as %+v", users)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "copy.yml"), []byte(files["users.yml"]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var duplicated Config
+	if err := duplicated.Parse(dir); err == nil || !strings.Contains(err.Error(), "duplicate destination users") {
+		t.Errorf("Parse() = %v, want a duplicate destination error", err)
+	}
+}
+
+func TestTableValidatePrimaryKey(t *testing.T) {
+	table := Table{
+		Source:      "logs",
+		Destination: "logs",
+		Columns: []Column{
+			{Source: "message", Destination: "message", Type: "text"},
+		},
+	}
+
+	if err := table.Validate(); err == nil || !strings.Contains(err.Error(), "no primary key or conflict columns") {
+		t.Errorf("Validate() = %v, want an error on the missing primary key", err)
+	}
+
+	table.Mode = ModeAppend
+	if err := table.Validate(); err != nil {
+		t.Errorf("Validate() = %v in append mode, want no error", err)
+	}
+
+	db := newFakeDB()
+	if err := MoveTemporaryTable(table, db, "logs_tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if want := "INSERT INTO logs SELECT * FROM logs_tmp"; db.statements[0] != want {
+		t.Errorf("moved with %q, want %q", db.statements[0], want)
+	}
+}
+
+func TestGetIndexName(t *testing.T) {
+	table := Table{Destination: "analytics.customer_lifetime_value_by_acquisition_channel_daily"}
+	first := table.GetIndexName(Index{Name: "acquisition_channel_and_first_order_date"})
+	second := table.GetIndexName(Index{Name: "acquisition_channel_and_last_order_date"})
+
+	// Long names are truncated to a valid identifier, a hash keeping them apart
+	for _, name := range []string{first, second} {
+		if len(name) > maxIdentifierLength {
+			t.Errorf("index name %s has %d characters, over the limit of %d", name, len(name), maxIdentifierLength)
+		}
+		if !strings.HasPrefix(name, "customer_lifetime_value_by_acquisition_channel_daily_") {
+			t.Errorf("index name %s, want the destination prefix without its schema", name)
+		}
+	}
+	if first == second {
+		t.Errorf("indexes sharing a long prefix named %s alike", first)
+	}
+	if again := table.GetIndexName(Index{Name: "acquisition_channel_and_first_order_date"}); again != first {
+		t.Errorf("index named %s then %s", first, again)
+	}
+	if qualified := table.GetQualifiedIndexName(Index{Name: "acquisition_channel_and_first_order_date"}); qualified != "analytics."+first {
+		t.Errorf("qualified index name %s, want it in the analytics schema", qualified)
+	}
+
+	// Short names are kept and overrides are used as is
+	short := Table{Destination: "events"}
+	if name := short.GetIndexName(Index{Name: "name"}); name != "events_name" {
+		t.Errorf("index name %s, want events_name", name)
+	}
+	if name := table.GetIndexName(Index{Name: "channel", FullName: "clv_channel"}); name != "clv_channel" {
+		t.Errorf("index name %s, want the clv_channel override", name)
+	}
+}
@@ -0,0 +1,20 @@
+-- Source table of the development configuration, with a cursor column and rows to upsert
+CREATE TABLE IF NOT EXISTS default.products
+(
+    Id UInt64,
+    Name String,
+    Price Decimal(10, 2),
+    Size Enum8('S' = 1, 'M' = 2, 'L' = 3),
+    UpdatedAt DateTime64(3)
+)
+ENGINE = ReplacingMergeTree(UpdatedAt)
+ORDER BY Id;
+
+INSERT INTO default.products
+SELECT
+    number,
+    concat('product-', toString(number)),
+    toDecimal64(number / 100, 2),
+    ['S', 'M', 'L'][number % 3 + 1],
+    now64(3) - toIntervalSecond(number)
+FROM numbers(10000);
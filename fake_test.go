@@ -0,0 +1,621 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// assign stores values into scan destinations, allocating the pointers of nullable destinations
+// as the drivers do
+func assign(dest []any, values []any) error {
+	if len(dest) != len(values) {
+		return fmt.Errorf("scanning %d values into %d destinations", len(values), len(dest))
+	}
+
+	for i := range dest {
+		target := reflect.ValueOf(dest[i]).Elem()
+		if values[i] == nil {
+			target.Set(reflect.Zero(target.Type()))
+			continue
+		}
+
+		value := reflect.ValueOf(values[i])
+		if target.Kind() == reflect.Ptr && value.Type() != target.Type() {
+			pointer := reflect.New(target.Type().Elem())
+			pointer.Elem().Set(value.Convert(target.Type().Elem()))
+			target.Set(pointer)
+			continue
+		}
+
+		target.Set(value.Convert(target.Type()))
+	}
+	return nil
+}
+
+// fakeColumn describes a column returned by a fake ClickHouse source
+type fakeColumn struct {
+	name   string
+	chType string
+	scan   reflect.Type
+}
+
+func (c fakeColumn) Name() string             { return c.name }
+func (c fakeColumn) Nullable() bool           { return strings.HasPrefix(c.chType, "Nullable(") }
+func (c fakeColumn) ScanType() reflect.Type   { return c.scan }
+func (c fakeColumn) DatabaseTypeName() string { return c.chType }
+
+// fakeRows iterates over fixed ClickHouse rows
+type fakeRows struct {
+	columns []fakeColumn
+	rows    [][]any
+	index   int
+	err     error
+}
+
+func (r *fakeRows) Next() bool {
+	r.index++
+	return r.index <= len(r.rows)
+}
+
+func (r *fakeRows) Scan(dest ...any) error {
+	return assign(dest, r.rows[r.index-1])
+}
+
+func (r *fakeRows) ScanStruct(any) error { return errors.New("not implemented") }
+func (r *fakeRows) Totals(...any) error  { return errors.New("not implemented") }
+
+func (r *fakeRows) ColumnTypes() []driver.ColumnType {
+	types := make([]driver.ColumnType, len(r.columns))
+	for i, column := range r.columns {
+		types[i] = column
+	}
+	return types
+}
+
+func (r *fakeRows) Columns() []string {
+	names := make([]string, len(r.columns))
+	for i, column := range r.columns {
+		names[i] = column.name
+	}
+	return names
+}
+
+func (r *fakeRows) Close() error { return nil }
+func (r *fakeRows) Err() error   { return r.err }
+
+// fakeRow is a single ClickHouse or Postgres row
+type fakeRow struct {
+	values []any
+	err    error
+}
+
+func (r fakeRow) Err() error { return r.err }
+
+func (r fakeRow) Scan(dest ...any) error {
+	if r.err != nil {
+		return r.err
+	}
+	return assign(dest, r.values)
+}
+
+func (r fakeRow) ScanStruct(any) error { return errors.New("not implemented") }
+
+// fakeReader is a ClickHouse source answering queries with fixed rows
+type fakeReader struct {
+	mu      sync.Mutex
+	queries []string
+	args    [][]any
+	// contexts are the contexts of the queries, carrying their ClickHouse settings
+	contexts []context.Context
+	// answer returns the rows of a query, nil answering with no rows
+	answer func(query string, args []any) (*fakeRows, error)
+}
+
+func (r *fakeReader) record(ctx context.Context, query string, args []any) (*fakeRows, error) {
+	r.mu.Lock()
+	r.queries = append(r.queries, query)
+	r.args = append(r.args, args)
+	r.contexts = append(r.contexts, ctx)
+	r.mu.Unlock()
+
+	rows, err := r.answer(query, args)
+	if rows == nil {
+		rows = &fakeRows{}
+	}
+	return rows, err
+}
+
+func (r *fakeReader) Query(ctx context.Context, query string, args ...any) (driver.Rows, error) {
+	rows, err := r.record(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (r *fakeReader) QueryRow(ctx context.Context, query string, args ...any) driver.Row {
+	rows, err := r.record(ctx, query, args)
+	if err != nil {
+		return fakeRow{err: err}
+	}
+	if len(rows.rows) == 0 {
+		return fakeRow{err: errors.New("no rows")}
+	}
+	return fakeRow{values: rows.rows[0]}
+}
+
+// Queries returns the queries read so far containing a substring
+func (r *fakeReader) Queries(substring string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	queries := []string{}
+	for _, query := range r.queries {
+		if strings.Contains(query, substring) {
+			queries = append(queries, query)
+		}
+	}
+	return queries
+}
+
+var pageClause = regexp.MustCompile(`LIMIT (\d+) OFFSET (\d+)$`)
+
+// newFakeSource fakes a ClickHouse table, answering its description, counts and pages.
+// Cursor and where filters are not applied, tests checking the query instead.
+func newFakeSource(columns []fakeColumn, rows [][]any) *fakeReader {
+	return &fakeReader{answer: func(query string, args []any) (*fakeRows, error) {
+		switch {
+		case strings.HasPrefix(query, "DESCRIBE"):
+			description := &fakeRows{columns: []fakeColumn{{name: "name"}, {name: "type"}}}
+			for _, column := range columns {
+				description.rows = append(description.rows, []any{column.name, column.chType})
+			}
+			return description, nil
+		case strings.HasPrefix(query, "SELECT COUNT(*)"), strings.HasPrefix(query, "SELECT uniqExact("):
+			return &fakeRows{rows: [][]any{{uint64(len(rows))}}}, nil
+		}
+
+		if match := pageClause.FindStringSubmatch(query); match != nil {
+			limit, _ := strconv.Atoi(match[1])
+			offset, _ := strconv.Atoi(match[2])
+			page := &fakeRows{columns: columns}
+			if offset < len(rows) {
+				page.rows = rows[offset:min(offset+limit, len(rows))]
+			}
+			return page, nil
+		}
+
+		return nil, nil
+	}}
+}
+
+// fakeDB records the statements run on a fake Postgres pool, connection or transaction
+type fakeDB struct {
+	mu         sync.Mutex
+	statements []string
+	args       [][]any
+	// copied holds the rows copied into each table
+	copied map[string][][]any
+	// failures fail the statements containing a key with its error
+	failures map[string]error
+	// panics panic on the statements containing a key, as a bug in a conversion would
+	panics map[string]any
+	// rows answer the queries containing a key
+	rows map[string][][]any
+	// dropped rows are silently skipped at the end of every copy
+	dropped int
+	// delay slows every copy down, as a busy database would
+	delay time.Duration
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{
+		copied:   map[string][][]any{},
+		failures: map[string]error{},
+		panics:   map[string]any{},
+		rows:     map[string][][]any{},
+	}
+}
+
+func (db *fakeDB) record(sql string, args ...any) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.statements = append(db.statements, sql)
+	db.args = append(db.args, args)
+	for key, err := range db.failures {
+		if strings.Contains(sql, key) {
+			return err
+		}
+	}
+	for key, value := range db.panics {
+		if strings.Contains(sql, key) {
+			panic(value)
+		}
+	}
+	return nil
+}
+
+func (db *fakeDB) answer(sql string) [][]any {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for key, rows := range db.rows {
+		if strings.Contains(sql, key) {
+			return rows
+		}
+	}
+	return nil
+}
+
+func (db *fakeDB) Exec(_ context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	if err := db.record(sql, args...); err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	return pgconn.NewCommandTag("OK"), nil
+}
+
+func (db *fakeDB) Query(_ context.Context, sql string, args ...any) (pgx.Rows, error) {
+	if err := db.record(sql, args...); err != nil {
+		return nil, err
+	}
+	return &fakePgRows{rows: db.answer(sql)}, nil
+}
+
+func (db *fakeDB) QueryRow(_ context.Context, sql string, args ...any) pgx.Row {
+	if err := db.record(sql, args...); err != nil {
+		return fakeRow{err: err}
+	}
+
+	rows := db.answer(sql)
+	if len(rows) == 0 {
+		return fakeRow{err: pgx.ErrNoRows}
+	}
+	return fakeRow{values: rows[0]}
+}
+
+func (db *fakeDB) CopyFrom(_ context.Context, tableName pgx.Identifier, _ []string, rowSrc pgx.CopyFromSource) (int64, error) {
+	name := strings.Join(tableName, ".")
+	if err := db.record("COPY " + name); err != nil {
+		return 0, err
+	}
+	time.Sleep(db.delay)
+
+	rows := [][]any{}
+	for rowSrc.Next() {
+		values, err := rowSrc.Values()
+		if err != nil {
+			return 0, err
+		}
+		rows = append(rows, values)
+	}
+	rows = rows[:max(len(rows)-db.dropped, 0)]
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.copied[name] = append(db.copied[name], rows...)
+	return int64(len(rows)), rowSrc.Err()
+}
+
+// Args returns the arguments of the statements run so far containing a substring
+func (db *fakeDB) Args(substring string) [][]any {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	args := [][]any{}
+	for i, statement := range db.statements {
+		if strings.Contains(statement, substring) {
+			args = append(args, db.args[i])
+		}
+	}
+	return args
+}
+
+// Statements returns the statements run so far containing a substring
+func (db *fakeDB) Statements(substring string) []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	statements := []string{}
+	for _, statement := range db.statements {
+		if strings.Contains(statement, substring) {
+			statements = append(statements, statement)
+		}
+	}
+	return statements
+}
+
+// Copied returns every row copied into the tables whose name contains a substring
+func (db *fakeDB) Copied(substring string) [][]any {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	rows := [][]any{}
+	for name, copied := range db.copied {
+		if strings.Contains(name, substring) {
+			rows = append(rows, copied...)
+		}
+	}
+	return rows
+}
+
+// fakePgRows iterates over fixed Postgres rows, other methods being left unimplemented
+type fakePgRows struct {
+	pgx.Rows
+	rows  [][]any
+	index int
+}
+
+func (r *fakePgRows) Next() bool {
+	r.index++
+	return r.index <= len(r.rows)
+}
+
+func (r *fakePgRows) Scan(dest ...any) error { return assign(dest, r.rows[r.index-1]) }
+func (r *fakePgRows) Close()                 {}
+func (r *fakePgRows) Err() error             { return nil }
+
+// fakeTx is a transaction of a fake Postgres database, aborted by its first failed statement
+// as Postgres transactions are, until rolled back to a savepoint
+type fakeTx struct {
+	pgx.Tx
+	db      *fakeDB
+	parent  *fakeTx
+	aborted bool
+	done    bool
+	// release gives the connection of a pool transaction back once it ends
+	release func()
+}
+
+func (tx *fakeTx) check(sql string, args ...any) error {
+	if tx.aborted {
+		tx.db.record(sql, args...)
+		return &pgconn.PgError{Code: "25P02", Message: "current transaction is aborted"}
+	}
+	if err := tx.db.record(sql, args...); err != nil {
+		tx.abort()
+		return err
+	}
+	return nil
+}
+
+func (tx *fakeTx) abort() {
+	for t := tx; t != nil; t = t.parent {
+		t.aborted = true
+	}
+}
+
+func (tx *fakeTx) Exec(_ context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	if err := tx.check(sql, args...); err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	return pgconn.NewCommandTag("OK"), nil
+}
+
+func (tx *fakeTx) Query(_ context.Context, sql string, args ...any) (pgx.Rows, error) {
+	if err := tx.check(sql, args...); err != nil {
+		return nil, err
+	}
+	return &fakePgRows{rows: tx.db.answer(sql)}, nil
+}
+
+func (tx *fakeTx) QueryRow(_ context.Context, sql string, args ...any) pgx.Row {
+	if err := tx.check(sql, args...); err != nil {
+		return fakeRow{err: err}
+	}
+
+	rows := tx.db.answer(sql)
+	if len(rows) == 0 {
+		return fakeRow{err: pgx.ErrNoRows}
+	}
+	return fakeRow{values: rows[0]}
+}
+
+func (tx *fakeTx) CopyFrom(ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource) (int64, error) {
+	if tx.aborted {
+		return 0, tx.check("COPY " + strings.Join(tableName, "."))
+	}
+
+	copied, err := tx.db.CopyFrom(ctx, tableName, columnNames, rowSrc)
+	if err != nil {
+		tx.abort()
+	}
+	return copied, err
+}
+
+// Begin starts a savepoint, rolling it back clearing the abort of its parent
+func (tx *fakeTx) Begin(context.Context) (pgx.Tx, error) {
+	if err := tx.check("SAVEPOINT"); err != nil {
+		return nil, err
+	}
+	return &fakeTx{db: tx.db, parent: tx}, nil
+}
+
+func (tx *fakeTx) end() {
+	tx.done = true
+	if tx.release != nil {
+		tx.release()
+	}
+}
+
+func (tx *fakeTx) Commit(context.Context) error {
+	if tx.done {
+		return pgx.ErrTxClosed
+	}
+	tx.end()
+
+	statement := "COMMIT"
+	if tx.parent != nil {
+		statement = "RELEASE SAVEPOINT"
+	}
+
+	if tx.aborted {
+		tx.db.record("ROLLBACK")
+		return pgx.ErrTxCommitRollback
+	}
+	return tx.db.record(statement)
+}
+
+func (tx *fakeTx) Rollback(context.Context) error {
+	if tx.done {
+		return pgx.ErrTxClosed
+	}
+	tx.end()
+
+	if tx.parent != nil {
+		for t := tx.parent; t != nil; t = t.parent {
+			t.aborted = false
+		}
+		return tx.db.record("ROLLBACK TO SAVEPOINT")
+	}
+	return tx.db.record("ROLLBACK")
+}
+
+// fakeConn is a connection acquired from a fake pool
+type fakeConn struct {
+	*fakeDB
+	pool *fakePool
+}
+
+func (c *fakeConn) Begin(context.Context) (pgx.Tx, error) {
+	if err := c.record("BEGIN"); err != nil {
+		return nil, err
+	}
+	return &fakeTx{db: c.fakeDB}, nil
+}
+
+func (c *fakeConn) Release() {
+	c.pool.release()
+}
+
+// fakePool is a Postgres pool of at most maxConns connections sharing one fake database,
+// statements run on the pool itself holding a connection while they run
+type fakePool struct {
+	*fakeDB
+	maxConns int32
+
+	mu       sync.Mutex
+	slots    chan struct{}
+	acquired int
+	peak     int
+}
+
+func newFakePool() *fakePool {
+	return &fakePool{fakeDB: newFakeDB(), maxConns: 4}
+}
+
+func (p *fakePool) acquire() {
+	p.mu.Lock()
+	if p.slots == nil {
+		p.slots = make(chan struct{}, p.maxConns)
+	}
+	slots := p.slots
+	p.mu.Unlock()
+
+	slots <- struct{}{}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.acquired++
+	p.peak = max(p.peak, p.acquired)
+}
+
+func (p *fakePool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.acquired--
+	<-p.slots
+}
+
+func (p *fakePool) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	p.acquire()
+	defer p.release()
+	return p.fakeDB.Exec(ctx, sql, args...)
+}
+
+func (p *fakePool) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	p.acquire()
+	defer p.release()
+	return p.fakeDB.Query(ctx, sql, args...)
+}
+
+func (p *fakePool) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	p.acquire()
+	defer p.release()
+	return p.fakeDB.QueryRow(ctx, sql, args...)
+}
+
+func (p *fakePool) CopyFrom(ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource) (int64, error) {
+	p.acquire()
+	defer p.release()
+	return p.fakeDB.CopyFrom(ctx, tableName, columnNames, rowSrc)
+}
+
+func (p *fakePool) Begin(context.Context) (pgx.Tx, error) {
+	p.acquire()
+	if err := p.record("BEGIN"); err != nil {
+		p.release()
+		return nil, err
+	}
+	return &fakeTx{db: p.fakeDB, release: p.release}, nil
+}
+
+func (p *fakePool) Acquire(context.Context) (PoolConn, error) {
+	p.acquire()
+	return &fakeConn{fakeDB: p.fakeDB, pool: p}, nil
+}
+
+func (p *fakePool) MaxConns() int32 {
+	return p.maxConns
+}
+
+// Acquired returns how many connections are not released
+func (p *fakePool) Acquired() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.acquired
+}
+
+// Peak returns the most connections held at once
+func (p *fakePool) Peak() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.peak
+}
+
+// fakeSources are ClickHouse sources by name, the missing ones failing to connect
+type fakeSources map[string]*fakeReader
+
+func (s fakeSources) Get(name string) (Reader, error) {
+	source, ok := s[name]
+	if !ok {
+		return nil, fmt.Errorf("source connection %q: connection refused", name)
+	}
+	return source, nil
+}
+
+// fakeDestinations are Postgres pools by name, the missing ones failing to connect
+type fakeDestinations map[string]*fakePool
+
+func (d fakeDestinations) Get(name string) (Pool, error) {
+	pool, ok := d[name]
+	if !ok {
+		return nil, fmt.Errorf("destination connection %q: connection refused", name)
+	}
+	return pool, nil
+}
+
+func (d fakeDestinations) Config(name string) (PostgresConfig, error) {
+	return PostgresConfig{ApplicationName: name}, nil
+}
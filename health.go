@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Health serves the liveness and readiness of a daemon
+type Health struct {
+	mu           sync.Mutex
+	sources      *ClickHouseConns
+	pools        *PostgresPools
+	maxStaleness time.Duration
+	started      time.Time
+	synced       map[string]time.Time
+}
+
+// NewHealth tracks the last successful sync of the given tables, which are stale
+// once not synchronized for longer than the max staleness, zero disabling the check
+func NewHealth(tables []Table, sources *ClickHouseConns, pools *PostgresPools, maxStaleness time.Duration) *Health {
+	h := &Health{
+		sources:      sources,
+		pools:        pools,
+		maxStaleness: maxStaleness,
+		started:      time.Now(),
+		synced:       map[string]time.Time{},
+	}
+
+	// Tables not synchronized yet are measured from the daemon start
+	for _, table := range tables {
+		h.synced[table.GetName()] = h.started
+	}
+
+	return h
+}
+
+// Synced records a successful table sync, to be used as the OnTableDone hook
+func (h *Health) Synced(_ context.Context, table Table, rows int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.synced[table.GetName()] = time.Now()
+}
+
+// Ready returns an error if a connection is down or a table is stale
+func (h *Health) Ready() error {
+	if err := h.sources.Ping(); err != nil {
+		return fmt.Errorf("clickhouse: %w", err)
+	}
+
+	if err := h.pools.Ping(); err != nil {
+		return fmt.Errorf("postgres: %w", err)
+	}
+
+	if h.maxStaleness <= 0 {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for name, synced := range h.synced {
+		if time.Since(synced) > h.maxStaleness {
+			return fmt.Errorf("table %s last synchronized %s ago", name, time.Since(synced).Round(time.Second))
+		}
+	}
+
+	return nil
+}
+
+// Handler serves /healthz while the process is alive and /readyz while it is ready
+func (h *Health) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := h.Ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
+
+// Serve listens on the address in the background
+func (h *Health) Serve(addr string) {
+	go func() {
+		if err := http.ListenAndServe(addr, h.Handler()); err != nil {
+			log.WithError(err).Errorln("Health server stopped")
+		}
+	}()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// downConn is a source connection which lost its server
+type downConn struct {
+	driver.Conn
+}
+
+func (downConn) Ping(context.Context) error {
+	return errors.New("connection refused")
+}
+
+// get returns the status code of a health endpoint
+func get(t *testing.T, handler http.Handler, path string) int {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	return recorder.Code
+}
+
+func TestHealth(t *testing.T) {
+	tables := []Table{{Destination: "events"}, {Destination: "users"}}
+	sources := NewClickHouseConns(ClickHouseConfig{}, nil)
+	pools := NewPostgresPools(PostgresConfig{}, nil)
+
+	health := NewHealth(tables, sources, pools, 20*time.Millisecond)
+	handler := health.Handler()
+	if code := get(t, handler, "/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz returned %d, want 200", code)
+	}
+	if code := get(t, handler, "/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz returned %d right after the start, want 200", code)
+	}
+
+	// Only the events table keeps being synchronized
+	time.Sleep(30 * time.Millisecond)
+	health.Synced(ctx, tables[0], 10)
+	if code := get(t, handler, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz returned %d with a stale users table, want 503", code)
+	}
+
+	health.Synced(ctx, tables[1], 10)
+	if code := get(t, handler, "/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz returned %d once every table synchronized, want 200", code)
+	}
+
+	// A lost connection fails the readiness but not the liveness
+	sources.conns["analytics"] = downConn{}
+	if code := get(t, handler, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz returned %d with a source down, want 503", code)
+	}
+	if code := get(t, handler, "/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz returned %d with a source down, want 200", code)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import "context"
+
+// Hooks are optional callbacks invoked during a table synchronization.
+// Each one receives the context of the table sync, cancelled once the sync failed or ended,
+// so callbacks doing network calls can stop with it.
+type Hooks struct {
+	// OnTableStart is called before a table starts synchronizing
+	OnTableStart func(ctx context.Context, table Table)
+	// OnBatch is called for every batch read from ClickHouse
+	OnBatch func(ctx context.Context, table Table, batch [][]interface{})
+	// OnProgress is called after every batch with the rows read so far
+	OnProgress func(ctx context.Context, table Table, done, total int)
+	// OnTableDone is called once a table has been synchronized
+	OnTableDone func(ctx context.Context, table Table, rows int)
+	// OnError is called for every error encountered while synchronizing
+	OnError func(ctx context.Context, table Table, err error)
+
+	// ctx is the context of the table being synchronized
+	ctx context.Context
+}
+
+// withContext returns the hooks bound to the context of a table sync
+func (h Hooks) withContext(ctx context.Context) Hooks {
+	h.ctx = ctx
+	return h
+}
+
+func (h Hooks) context() context.Context {
+	if h.ctx == nil {
+		return ctx
+	}
+	return h.ctx
+}
+
+func (h Hooks) tableStart(table Table) {
+	if h.OnTableStart != nil {
+		h.OnTableStart(h.context(), table)
+	}
+}
+
+func (h Hooks) batch(table Table, batch [][]interface{}) {
+	if h.OnBatch != nil {
+		h.OnBatch(h.context(), table, batch)
+	}
+}
+
+func (h Hooks) progress(table Table, done, total int) {
+	if h.OnProgress != nil {
+		h.OnProgress(h.context(), table, done, total)
+	}
+}
+
+func (h Hooks) tableDone(table Table, rows int) {
+	if h.OnTableDone != nil {
+		h.OnTableDone(h.context(), table, rows)
+	}
+}
+
+func (h Hooks) error(table Table, err error) {
+	if h.OnError != nil {
+		h.OnError(h.context(), table, err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordHooks returns hooks appending their calls to a list
+func recordHooks(calls *[]string) Hooks {
+	var mu sync.Mutex
+	record := func(call string) {
+		mu.Lock()
+		defer mu.Unlock()
+		*calls = append(*calls, call)
+	}
+
+	return Hooks{
+		OnTableStart: func(_ context.Context, table Table) { record("start " + table.Destination) },
+		OnBatch:      func(_ context.Context, _ Table, batch [][]interface{}) { record(fmt.Sprintf("batch %d", len(batch))) },
+		OnProgress:   func(_ context.Context, _ Table, done, total int) { record(fmt.Sprintf("progress %d/%d", done, total)) },
+		OnTableDone:  func(_ context.Context, _ Table, rows int) { record(fmt.Sprintf("done %d", rows)) },
+		OnError:      func(_ context.Context, _ Table, err error) { record("error") },
+	}
+}
+
+func TestHooksOrder(t *testing.T) {
+	calls := []string{}
+	config := Config{BatchSize: 2, Hooks: recordHooks(&calls)}
+
+	if _, err := SynchronizeTable(config, eventsTable(), newFakeSource(eventColumns, eventRows(3)), newFakePool()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"start events", "batch 2", "progress 2/3", "batch 1", "progress 3/3", "done 3"}
+	if !slices.Equal(calls, want) {
+		t.Errorf("hooks called %v, want %v", calls, want)
+	}
+}
+
+func TestHooksError(t *testing.T) {
+	calls := []string{}
+	config := Config{BatchSize: 2, Hooks: recordHooks(&calls)}
+
+	pool := newFakePool()
+	pool.failures["CREATE TABLE"] = errors.New("permission denied")
+	if _, err := SynchronizeTable(config, eventsTable(), newFakeSource(eventColumns, eventRows(3)), pool); err == nil {
+		t.Fatal("SynchronizeTable succeeded without a destination table")
+	}
+
+	if want := []string{"start events", "error"}; !slices.Equal(calls, want) {
+		t.Errorf("hooks called %v, want %v", calls, want)
+	}
+}
+
+func TestHooksCancelled(t *testing.T) {
+	// A hook publishing the second batch waits on the network until cancelled
+	var cancelled error
+	batches := 0
+	config := Config{BatchSize: 2, Hooks: Hooks{OnBatch: func(ctx context.Context, _ Table, _ [][]interface{}) {
+		if batches++; batches < 2 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			cancelled = ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}}}
+
+	// The first batch fails while the hook waits
+	pool := newFakePool()
+	pool.failures["INSERT INTO events"] = errors.New("deadlock detected")
+	if _, err := SynchronizeTable(config, eventsTable(), newFakeSource(eventColumns, eventRows(4)), pool); err == nil {
+		t.Fatal("SynchronizeTable succeeded with failing merges")
+	}
+	if !errors.Is(cancelled, context.Canceled) {
+		t.Errorf("hook context ended with %v, want it cancelled by the failure", cancelled)
+	}
+
+	// The context of a sync ends with it
+	var started context.Context
+	config = Config{BatchSize: 2, Hooks: Hooks{OnTableStart: func(ctx context.Context, _ Table) { started = ctx }}}
+	if _, err := SynchronizeTable(config, eventsTable(), newFakeSource(eventColumns, eventRows(4)), newFakePool()); err != nil {
+		t.Fatal(err)
+	}
+	if started == nil || started.Err() == nil {
+		t.Error("hook context still alive once the sync ended")
+	}
+}
@@ -0,0 +1,255 @@
+//go:build integration
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+)
+
+// startDatabases runs ClickHouse and Postgres containers for the test, removed once it ends
+func startDatabases(t *testing.T) (driver.Conn, Pool) {
+	t.Helper()
+
+	containers, err := dockertest.NewPool("")
+	if err != nil {
+		t.Fatalf("docker: %v", err)
+	}
+	containers.MaxWait = 2 * time.Minute
+
+	clickhouse := runContainer(t, containers, &dockertest.RunOptions{
+		Repository: "clickhouse/clickhouse-server",
+		Tag:        "24.8",
+		Env:        []string{"CLICKHOUSE_USER=default", "CLICKHOUSE_PASSWORD=", "CLICKHOUSE_DEFAULT_ACCESS_MANAGEMENT=1"},
+	})
+	postgres := runContainer(t, containers, &dockertest.RunOptions{
+		Repository: "postgres",
+		Tag:        "16",
+		Env:        []string{"POSTGRES_USER=replication", "POSTGRES_PASSWORD=replication", "POSTGRES_DB=replication"},
+	})
+
+	source := ClickHouseConfig{Host: clickhouse.GetHostPort("9000/tcp"), Database: "default", Username: "default"}
+
+	pools := NewPostgresPools(PostgresConfig{
+		Host:     "localhost",
+		Port:     mustPort(t, postgres.GetPort("5432/tcp")),
+		Database: "replication",
+		User:     "replication",
+		Password: "replication",
+		SSLMode:  "disable",
+	}, nil)
+	t.Cleanup(pools.Close)
+
+	var conn driver.Conn
+	var db Pool
+	err = containers.Retry(func() error {
+		if conn, err = OpenClickHouse(source.DSN()); err != nil {
+			return err
+		}
+		if err := conn.Ping(ctx); err != nil {
+			return err
+		}
+		if db, err = pools.Get(""); err != nil {
+			return err
+		}
+		return pools.Ping()
+	})
+	if err != nil {
+		t.Fatalf("databases not ready: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn, db
+}
+
+func runContainer(t *testing.T, pool *dockertest.Pool, options *dockertest.RunOptions) *dockertest.Resource {
+	t.Helper()
+
+	resource, err := pool.RunWithOptions(options, func(config *docker.HostConfig) {
+		config.AutoRemove = true
+		config.RestartPolicy = docker.RestartPolicy{Name: "no"}
+	})
+	if err != nil {
+		t.Fatalf("run %s: %v", options.Repository, err)
+	}
+
+	t.Cleanup(func() {
+		if err := pool.Purge(resource); err != nil {
+			t.Logf("purge %s: %v", options.Repository, err)
+		}
+	})
+	return resource
+}
+
+func mustPort(t *testing.T, port string) int {
+	t.Helper()
+
+	var n int
+	if _, err := fmt.Sscan(port, &n); err != nil {
+		t.Fatalf("port %q: %v", port, err)
+	}
+	return n
+}
+
+// destinationRows returns the names of the destination rows by id
+func destinationRows(t *testing.T, db Pool) map[uint64]string {
+	t.Helper()
+
+	rows, err := db.Query(ctx, "SELECT id, name FROM products")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	names := map[uint64]string{}
+	for rows.Next() {
+		var id uint64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			t.Fatal(err)
+		}
+		names[id] = name
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestIntegrationSynchronizeTable(t *testing.T) {
+	conn, db := startDatabases(t)
+
+	for _, statement := range []string{
+		`CREATE TABLE products (Id UInt64, Name String, UpdatedAt DateTime64(3))
+			ENGINE = ReplacingMergeTree(UpdatedAt) ORDER BY Id`,
+		`INSERT INTO products SELECT number, concat('product-', toString(number)), now64(3) - toIntervalHour(1)
+			FROM numbers(1, 5)`,
+	} {
+		if err := conn.Exec(ctx, statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := Config{BatchSize: 2, Workers: 2}
+	table := Table{
+		Source:      "products",
+		Destination: "products",
+		Verify:      true,
+		Cursor:      Cursor{Column: "UpdatedAt"},
+		Columns: []Column{
+			{Source: "Id", Destination: "id", Primary: true},
+			{Source: "Name", Destination: "name"},
+			{Source: "UpdatedAt", Destination: "updated_at"},
+		},
+	}
+	if err := table.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := SynchronizeTable(config, table, conn, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RowsRead != 5 || result.RowsInserted != 5 {
+		t.Errorf("first sync read %d and inserted %d rows, want 5", result.RowsRead, result.RowsInserted)
+	}
+
+	names := destinationRows(t, db)
+	if len(names) != 5 || names[1] != "product-1" {
+		t.Errorf("destination rows %v, want the 5 source rows", names)
+	}
+
+	if err := VerifyTable(table, conn, db); err != nil {
+		t.Errorf("verify after the first sync: %v", err)
+	}
+
+	// The next sync only reads the rows changed since the cursor, updating and adding rows
+	table.Cursor.LastSync = result.NewCursor
+	for _, statement := range []string{
+		`INSERT INTO products VALUES (1, 'renamed', now64(3)), (6, 'product-6', now64(3))`,
+	} {
+		if err := conn.Exec(ctx, statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err = SynchronizeTable(config, table, conn, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RowsRead != 2 {
+		t.Errorf("second sync read %d rows, want the 2 rows past the cursor", result.RowsRead)
+	}
+	if !result.NewCursor.After(table.Cursor.LastSync) {
+		t.Errorf("cursor moved from %s to %s, want it to advance", table.Cursor.LastSync, result.NewCursor)
+	}
+
+	names = destinationRows(t, db)
+	if len(names) != 6 || names[1] != "renamed" || names[6] != "product-6" {
+		t.Errorf("destination rows %v, want product 1 upserted and product 6 added", names)
+	}
+
+	if err := VerifyTable(table, conn, db); err != nil {
+		t.Errorf("verify after the second sync: %v", err)
+	}
+}
+
+func TestIntegrationConcurrentOverlappingMerges(t *testing.T) {
+	conn, db := startDatabases(t)
+
+	// Pages follow seq while ids are scattered, so every batch overlaps the keys of the others
+	for _, statement := range []string{
+		`CREATE TABLE counters (Seq UInt64, Id UInt64, Value UInt64) ENGINE = MergeTree ORDER BY Seq`,
+		`INSERT INTO counters SELECT number, (number * 7919) % 500, number FROM numbers(4000)`,
+	} {
+		if err := conn.Exec(ctx, statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := Config{BatchSize: 100, Workers: 4}
+	table := Table{
+		Source:      "counters",
+		Destination: "counters",
+		OrderBy:     []string{"Seq"},
+		Columns: []Column{
+			{Source: "Id", Destination: "id", Type: "bigint", Primary: true},
+			{Source: "Seq", Destination: "seq", Type: "bigint"},
+			{Source: "Value", Destination: "value", Type: "bigint"},
+		},
+	}
+	if err := table.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateSchema(&table, conn, db); err != nil {
+		t.Fatal(err)
+	}
+
+	// Several syncs of the same table hammer the same keys at once, which deadlocks unless
+	// every merge locks its rows in key order
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := SynchronizeTable(config, table, conn, db)
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("concurrent sync: %v", err)
+		}
+	}
+
+	var count int
+	if err := db.QueryRow(ctx, "SELECT count(*) FROM counters").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 500 {
+		t.Errorf("destination has %d rows, want the 500 keys", count)
+	}
+}
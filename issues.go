@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Issue is a warning or error logged during a run
+type Issue struct {
+	Table   string
+	Level   log.Level
+	Message string
+}
+
+// Issues collects the warnings and errors of a run as a logrus hook, attributed to the table being synchronized
+type Issues struct {
+	mu     sync.Mutex
+	table  string
+	issues []Issue
+}
+
+func (i *Issues) Levels() []log.Level {
+	return []log.Level{log.WarnLevel, log.ErrorLevel}
+}
+
+// Fire records a logged warning or error
+func (i *Issues) Fire(entry *log.Entry) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	message := entry.Message
+	if err, ok := entry.Data[log.ErrorKey]; ok {
+		message = fmt.Sprintf("%s: %v", message, err)
+	}
+
+	i.issues = append(i.issues, Issue{Table: i.table, Level: entry.Level, Message: message})
+	return nil
+}
+
+// SetTable attributes the next issues to a table
+func (i *Issues) SetTable(table string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.table = table
+}
+
+// Reset clears the collected issues for a new run
+func (i *Issues) Reset() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.table = ""
+	i.issues = nil
+}
+
+// Summary consolidates the collected issues, such as "1 errors and 2 warnings across 2 tables: ..."
+func (i *Issues) Summary() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if len(i.issues) == 0 {
+		return "no errors or warnings"
+	}
+
+	tables := map[string]bool{}
+	messages := []string{}
+	errors := 0
+	for _, issue := range i.issues {
+		if issue.Level <= log.ErrorLevel {
+			errors++
+		}
+
+		if issue.Table != "" {
+			tables[issue.Table] = true
+		}
+
+		prefix := issue.Table
+		if prefix == "" {
+			prefix = "run"
+		}
+		messages = append(messages, fmt.Sprintf("%s: %s", prefix, issue.Message))
+	}
+
+	return fmt.Sprintf("%d errors and %d warnings across %d tables: %s", errors, len(i.issues)-errors, len(tables), strings.Join(messages, "; "))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestIssuesSummary(t *testing.T) {
+	issues := &Issues{}
+	if summary := issues.Summary(); summary != "no errors or warnings" {
+		t.Errorf("summary %q of a clean run", summary)
+	}
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	logger.AddHook(issues)
+
+	logger.Info("Not an issue")
+	issues.SetTable("events")
+	logger.WithError(errors.New("permission denied")).Warn("Failed to create index")
+	logger.Error("Failed to move rows")
+	issues.SetTable("users")
+	logger.Warn("Failed to add primary key")
+
+	want := "1 errors and 2 warnings across 2 tables: events: Failed to create index: permission denied; events: Failed to move rows; users: Failed to add primary key"
+	if summary := issues.Summary(); summary != want {
+		t.Errorf("summary %q, want %q", summary, want)
+	}
+
+	issues.Reset()
+	if summary := issues.Summary(); summary != "no errors or warnings" {
+		t.Errorf("summary %q after a reset", summary)
+	}
+}
+
+func TestReplicateCollectsIssues(t *testing.T) {
+	hooks := log.StandardLogger().ReplaceHooks(log.LevelHooks{})
+	defer log.StandardLogger().ReplaceHooks(hooks)
+
+	issues := &Issues{}
+	log.AddHook(issues)
+
+	missing := eventsTable()
+	missing.SourceConn = "archive"
+	config := &Config{BatchSize: 10, Tables: []Table{eventsTable(), missing}}
+	sources := fakeSources{"": newFakeSource(eventColumns, eventRows(3))}
+	if failed := Replicate(config, RunOptions{Issues: issues}, sources, fakeDestinations{"": newFakePool()}); failed != 1 {
+		t.Fatalf("%d tables failed, want 1", failed)
+	}
+
+	summary := issues.Summary()
+	if !strings.HasPrefix(summary, "1 errors and 0 warnings across 1 tables: events: Failed to connect to ClickHouse") {
+		t.Errorf("summary %q, want the connection failure of the events table", summary)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// PrintTables writes the configured tables and their cursor state as a table
+func PrintTables(w io.Writer, tables []Table) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOURCE\tDESTINATION\tPRIMARY KEY\tCURSOR\tLAST SYNC")
+
+	for _, table := range tables {
+		cursor, lastSync := "-", "-"
+		if table.Cursor.Column != "" {
+			cursor = table.Cursor.Column
+			lastSync = "never"
+			if table.Cursor.IsSequence() && !table.Cursor.IsZero() {
+				lastSync = fmt.Sprint(table.Cursor.LastValue)
+			} else if !table.Cursor.IsZero() {
+				lastSync = table.Cursor.LastSync.Format(time.RFC3339)
+			}
+		}
+
+		source := table.GetSourceTable()
+		if table.SourceQuery != "" {
+			source = "(query)"
+		}
+
+		primaryKey := strings.Join(table.GetPrimaryKey(), ", ")
+		if primaryKey == "" {
+			primaryKey = "-"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", source, table.Destination, primaryKey, cursor, lastSync)
+	}
+
+	return tw.Flush()
+}
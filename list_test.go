@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrintTables(t *testing.T) {
+	events := metricsTable()
+	events.Cursor.LastSync = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	sequenced := eventsTable()
+	sequenced.Destination = "sequenced_events"
+	sequenced.Cursor = Cursor{Column: "id", Type: CursorTypeSequence, LastValue: 42}
+
+	fresh := metricsTable()
+	fresh.Destination = "fresh_metrics"
+
+	query := Table{SourceQuery: "SELECT 1 AS one", Destination: "ones", Mode: ModeAppend}
+
+	var b strings.Builder
+	if err := PrintTables(&b, []Table{events, sequenced, fresh, query}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := strings.Join([]string{
+		"SOURCE   DESTINATION       PRIMARY KEY  CURSOR      LAST SYNC",
+		"metrics  metrics           id           created_at  2024-03-01T12:00:00Z",
+		"events   sequenced_events  id           id          42",
+		"metrics  fresh_metrics     id           created_at  never",
+		"(query)  ones              -            -           -",
+		"",
+	}, "\n")
+	if b.String() != want {
+		t.Errorf("PrintTables() =\n%s\nwant\n%s", b.String(), want)
+	}
+}
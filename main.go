@@ -2,200 +2,985 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"path"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/ClickHouse/clickhouse-go/v2"
-	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgxpool"
 	log "github.com/sirupsen/logrus"
 )
 
 var ctx = context.Background()
 
 func main() {
-	only := flag.String("only", "", "Only replicate one table by name")
-	configPath := flag.String("config", "config.yml", "Path to the configuration file")
-	drop := flag.String("drop", "", "Drop a table by name")
+	only := flag.String("only", "", "Only replicate tables matching a name or glob pattern")
+	configPath := flag.String("config", "config.yml", "Path to the configuration file, directory or glob pattern")
+	drop := flag.String("drop", "", "Drop tables matching a name or glob pattern")
+	validateConfig := flag.Bool("validate-config", false, "Validate the configuration and exit without connecting")
+	failFast := flag.Bool("fail-fast", false, "Abort the run on the first table failure")
+	resetCursor := flag.String("reset-cursor", "", "Reset the cursor of tables matching a name or glob pattern, then exit")
+	list := flag.Bool("list", false, "List the configured tables and their cursor, then exit without connecting")
+	schemaOnly := flag.Bool("schema-only", false, "Create the destination tables and indexes without copying data")
+	interval := flag.Duration("interval", 0, "Run as a daemon, synchronizing the tables every interval")
+	fullInterval := flag.Duration("full-interval", 0, "As a daemon, synchronize the tables without a cursor every interval instead of only once")
+	healthAddr := flag.String("health-addr", "", "Serve /healthz and /readyz on this address, such as :8080")
+	maxStaleness := flag.Duration("max-staleness", 0, "Fail /readyz when a table was not synchronized for longer than this")
+	sqlLogPath := flag.String("sql-log", "", "Append every statement run against Postgres to this file")
+	since := flag.String("since", "", "Read the time cursor tables from this RFC 3339 time for this run, instead of their last sync")
+	until := flag.String("until", "", "Read the time cursor tables up to this RFC 3339 time, saving it as their last sync")
 	flag.Parse()
 
 	var config Config
 	if err := config.Parse(*configPath); err != nil {
-		log.Fatal("Failed to parse config", err)
+		log.WithError(err).Fatal("Failed to parse config")
 	}
 
-	dsn, err := clickhouse.ParseDSN(os.Getenv("CLICKHOUSE_DSN"))
-	if err != nil {
-		log.WithError(err).Fatal("Failed to parse ClickHouse DSN")
+	for _, pattern := range []string{*only, *drop, *resetCursor} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.WithError(err).WithField("pattern", pattern).Fatal("Invalid table pattern")
+		}
+
+		if pattern != "" && !config.HasMatch(pattern) {
+			log.WithField("pattern", pattern).Fatal("No table matches pattern")
+		}
 	}
 
-	conn, err := clickhouse.Open(dsn)
-	if err != nil {
-		log.WithError(err).Fatal("Failed to connect to ClickHouse")
+	var sinceTime, untilTime time.Time
+	if *since != "" {
+		parsed, err := time.Parse(time.RFC3339, *since)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid -since time")
+		}
+		sinceTime = parsed
 	}
-	defer conn.Close()
 
-	db, err := pgxpool.New(ctx, os.Getenv("DATABASE_URL"))
-	if err != nil {
-		log.WithError(err).Fatal("Failed to connect to Postgres")
+	if *until != "" {
+		parsed, err := time.Parse(time.RFC3339, *until)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid -until time")
+		}
+		untilTime = parsed
+	}
+
+	if !sinceTime.IsZero() && !untilTime.IsZero() && !sinceTime.Before(untilTime) {
+		log.Fatal("-since must be before -until")
+	}
+
+	if *resetCursor != "" {
+		if err := ResetCursors(&config, *resetCursor); err != nil {
+			log.WithError(err).Fatal("Failed to save config")
+		}
+		return
+	}
+
+	if *list {
+		if err := PrintTables(os.Stdout, config.Tables); err != nil {
+			log.WithError(err).Fatal("Failed to list tables")
+		}
+		return
+	}
+
+	if *validateConfig {
+		log.WithField("tables", len(config.Tables)).Info("Configuration is valid")
+		return
+	}
+
+	sources := NewClickHouseConns(config.ClickHouse, config.Sources)
+	defer sources.Close()
+
+	pools := NewPostgresPools(config.Postgres, config.Destinations)
+	defer pools.Close()
+
+	if *sqlLogPath != "" {
+		sqlLog, err := NewSQLLog(*sqlLogPath)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to open SQL log")
+		}
+		defer sqlLog.Close()
+
+		pools.Tracer = sqlLog
+	}
+
+	// Connections are checked before any table is created, so unreachable databases fail the run at once
+	if err := Preflight(config.Tables, *only, sources, pools); err != nil {
+		log.WithError(err).Fatal("Databases are unreachable")
+	}
+
+	if *healthAddr != "" {
+		// Tables only synchronized on the first run cannot become stale
+		tables := []Table{}
+		for _, table := range config.Tables {
+			if (*only == "" || table.Matches(*only)) && TableInterval(table, *interval, *fullInterval) > 0 {
+				tables = append(tables, table)
+			}
+		}
+
+		health := NewHealth(tables, sources, pools, *maxStaleness)
+		config.Hooks.OnTableDone = health.Synced
+		health.Serve(*healthAddr)
+	}
+
+	options := RunOptions{
+		Only:       *only,
+		Drop:       *drop,
+		FailFast:   *failFast,
+		SchemaOnly: *schemaOnly,
+		Since:      sinceTime,
+		Until:      untilTime,
 	}
 
+	// Warnings and errors are summarized at the end of each run, so they are not lost in a long log
+	issues := &Issues{}
+	log.AddHook(issues)
+	options.Issues = issues
+
+	if *interval <= 0 {
+		if failed := Replicate(&config, options, sources, pools); failed > 0 {
+			log.WithFields(log.Fields{
+				"failed": failed,
+				"issues": issues.Summary(),
+			}).Fatal("Replication completed with failures")
+		}
+
+		log.WithField("issues", issues.Summary()).Info("Replication completed")
+		return
+	}
+
+	// As a daemon, runs are finished before exiting on a signal
+	signals, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	schedule := NewSchedule(*interval, *fullInterval)
+	for {
+		options.Due = schedule.Due(config.Tables, time.Now())
+
+		if failed := Replicate(&config, options, sources, pools); failed > 0 {
+			log.WithFields(log.Fields{
+				"failed": failed,
+				"issues": issues.Summary(),
+			}).Errorln("Replication completed with failures")
+		} else {
+			log.WithField("issues", issues.Summary()).Info("Replication completed")
+		}
+
+		// Tables are only dropped, and read within overridden times, on the first run
+		options.Drop = ""
+		options.Since = time.Time{}
+		options.Until = time.Time{}
+
+		wake := schedule.Wake()
+		log.WithField("next", wake).Info("Waiting for the next run")
+
+		var timer <-chan time.Time
+		if !wake.IsZero() {
+			timer = time.After(time.Until(wake))
+		}
+
+		select {
+		case <-signals.Done():
+			log.Info("Stopping replication")
+			return
+		case <-timer:
+		}
+	}
+}
+
+// ResetCursors clears the cursor and checkpoint of the tables matching a pattern, so their next run
+// synchronizes them in full, and saves the configuration
+func ResetCursors(config *Config, pattern string) error {
 	for idx, table := range config.Tables {
+		if table.Matches(pattern) {
+			config.Tables[idx].Cursor.Reset()
+			config.Tables[idx].Checkpoint = nil
+			log.WithField("table", table.Source).Info("Reset cursor")
+		}
+	}
+
+	return config.Save()
+}
+
+// Preflight opens and pings the connections of the selected tables
+func Preflight(tables []Table, only string, sources *ClickHouseConns, pools *PostgresPools) error {
+	for _, table := range tables {
+		if only != "" && !table.Matches(only) {
+			continue
+		}
+
+		if _, err := sources.Get(table.SourceConn); err != nil {
+			return fmt.Errorf("connect to ClickHouse: %w", err)
+		}
+
+		if _, err := pools.Get(table.DestinationConn); err != nil {
+			return fmt.Errorf("connect to Postgres: %w", err)
+		}
+	}
+
+	if err := sources.Ping(); err != nil {
+		return fmt.Errorf("ClickHouse is unreachable: %w", err)
+	}
+
+	if err := pools.Ping(); err != nil {
+		return fmt.Errorf("Postgres is unreachable: %w", err)
+	}
+
+	return nil
+}
+
+// TableInterval returns how often a daemon synchronizes a table: its own interval if set, the full interval
+// for tables without a cursor, otherwise the daemon interval. Zero means only on the first run.
+func TableInterval(table Table, interval, fullInterval time.Duration) time.Duration {
+	if table.Interval > 0 {
+		return table.Interval
+	}
+
+	if table.Cursor.Column == "" {
+		return fullInterval
+	}
+
+	return interval
+}
+
+// RunOptions selects the tables of a run and how they are synchronized
+type RunOptions struct {
+	Only       string
+	Drop       string
+	FailFast   bool
+	SchemaOnly bool
+	// Issues collects the warnings of the run
+	Issues *Issues
+	// Due lists the destinations a daemon run synchronizes, every table being due when nil
+	Due map[string]bool
+	// Since overrides the last sync of the time cursors, saved only once a table synchronized
+	Since time.Time
+	// Until bounds the time cursors, saved as their last sync once a table synchronized
+	Until time.Time
+}
+
+// Replicate synchronizes every selected table once, saves the configuration and returns the number of failures
+func Replicate(config *Config, options RunOptions, sources Sources, pools Destinations) int {
+	options.Issues.Reset()
+
+	// Every run has its own ID, so the staging tables named after it do not collide between daemon runs
+	config.RunID = uuid.New().String()[:8]
+	log.WithField("run", config.RunID).Info("Starting replication")
+
+	failed := 0
+	for idx, table := range config.Tables {
+		options.Issues.SetTable("")
+
 		log.WithFields(log.Fields{
 			"source":      table.Source,
 			"destination": table.Destination,
 		}).Info("Replicating table")
 
-		if *only != "" && *only != table.Source {
-			log.Warn("Skipping this table")
+		if options.Only != "" && !table.Matches(options.Only) {
+			log.Info("Skipping this table")
+			continue
+		}
+
+		if options.Due != nil && !options.Due[table.Destination] {
+			log.Debug("Table is not due yet")
+			continue
+		}
+
+		options.Issues.SetTable(table.GetName())
+
+		conn, err := sources.Get(table.SourceConn)
+		if err != nil {
+			log.WithError(err).Errorln("Failed to connect to ClickHouse")
+			failed++
+
+			if options.FailFast {
+				break
+			}
+			continue
+		}
+
+		db, err := pools.Get(table.DestinationConn)
+		if err != nil {
+			log.WithError(err).Errorln("Failed to connect to Postgres")
+			failed++
+
+			if options.FailFast {
+				break
+			}
+			continue
+		}
+
+		// Connections are labelled and bounded by the settings of the table destination
+		tableConfig := *config
+		tableConfig.Postgres, err = pools.Config(table.DestinationConn)
+		if err != nil {
+			log.WithError(err).Errorln("Failed to configure Postgres")
+			failed++
+
+			if options.FailFast {
+				break
+			}
 			continue
 		}
 
 		start := time.Now()
 
+		dropped := options.Drop != "" && table.Matches(options.Drop)
+
 		if table.Cursor.Column != "" {
-			if table.Cursor.LastSync.IsZero() || *drop == table.Source {
-				log.Warn("No last sync date found, resetting cursor")
-				table.Cursor.LastSync = time.Time{}
+			if table.Cursor.IsZero() || dropped {
+				log.Warn("No last sync position found, resetting cursor")
+				table.Cursor.Reset()
+			}
+
+			// The table copy is overridden, the configuration keeping the last sync unless the table synchronizes
+			if !options.Since.IsZero() && !table.Cursor.IsSequence() {
+				log.WithField("since", options.Since).Info("Overriding last sync")
+				table.Cursor.LastSync = options.Since
+			}
+
+			if !options.Until.IsZero() && !table.Cursor.IsSequence() {
+				// Moving the cursor back to the bound would read the rows after it again on the next run
+				if !table.Cursor.LastSync.Before(options.Until) {
+					log.WithFields(log.Fields{
+						"lastSync": table.Cursor.LastSync,
+						"until":    options.Until,
+					}).Warn("Cursor already past -until, skipping table")
+					continue
+				}
+
+				log.WithField("until", options.Until).Info("Bounding cursor")
+				table.Cursor.Until = options.Until
 			}
 
 			log.WithFields(log.Fields{
-				"column":   table.Cursor.Column,
-				"lastSync": table.Cursor.LastSync,
+				"column":    table.Cursor.Column,
+				"lastSync":  table.Cursor.LastSync,
+				"lastValue": table.Cursor.LastValue,
 			}).Info("Resuming from cursor")
 		}
 
-		if *drop != "" && *drop == table.Source {
+		if dropped {
 			log.WithField("table", table.Source).Info("Dropping table")
+			table.Checkpoint = nil
 
-			if _, err := db.Exec(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", table.Destination)); err != nil {
+			if _, err := db.Exec(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", QuoteQualified(table.Destination))); err != nil {
 				log.WithError(err).Errorln("Failed to drop table")
+				failed++
+
+				if options.FailFast {
+					break
+				}
+				continue
+			}
+		}
+
+		if options.SchemaOnly {
+			if err := CreateSchema(&table, conn, db); err != nil {
+				log.WithError(err).Errorln("Failed to create schema")
+				failed++
+
+				if options.FailFast {
+					break
+				}
+				continue
+			}
+
+			// A dropped table is empty again, so the next run syncs it in full
+			if dropped {
+				config.Tables[idx].Cursor.Reset()
+				config.Tables[idx].Checkpoint = nil
 			}
+
+			log.WithField("destination", table.Destination).Info("Schema created")
+			continue
 		}
 
-		if err := SynchronizeTable(config, table, conn, db); err != nil {
+		result, err := SynchronizeTable(tableConfig, table, conn, db)
+		if err != nil {
 			log.WithError(err).Errorln("Failed to synchronize table")
+			failed++
+
+			if options.FailFast {
+				break
+			}
 			continue
 		}
 
+		config.Tables[idx].Checkpoint = nil
+
+		// Retention and verification run on synchronized data, so the run fails
+		// if they do but the cursor still moves on
+		if table.Retention > 0 {
+			if err := ApplyRetention(table, db); err != nil {
+				log.WithError(err).Errorln("Failed to apply retention")
+				failed++
+			}
+		}
+
+		// Rows inserted since the sync started are left to the next run, so both sides stop at the new cursor
+		if table.Verify {
+			table.Cursor.Until, table.Cursor.UntilValue = result.NewCursor, result.NewValue
+			if err := VerifyTable(table, conn, db); err != nil {
+				log.WithError(err).Errorln("Failed to verify table")
+				failed++
+			}
+		}
+
 		if table.Cursor.Column != "" {
-			now := time.Now()
-			config.Tables[idx].Cursor.LastSync = now
+			if table.Cursor.IsSequence() {
+				config.Tables[idx].Cursor.LastValue = result.NewValue
+			} else {
+				config.Tables[idx].Cursor.LastSync = result.NewCursor
+			}
 
 			log.WithFields(log.Fields{
-				"column":   table.Cursor.Column,
-				"lastSync": config.Tables[idx].Cursor.LastSync,
+				"column":    table.Cursor.Column,
+				"lastSync":  config.Tables[idx].Cursor.LastSync,
+				"lastValue": config.Tables[idx].Cursor.LastValue,
 			}).Info("Updated cursor")
 		}
 
 		log.WithFields(log.Fields{
 			"source":   table.Source,
+			"read":     result.RowsRead,
+			"inserted": result.RowsInserted,
 			"duration": time.Since(start),
 		}).Info("Table synchronized")
 	}
 
-	if err := config.Save(*configPath); err != nil {
-		log.WithError(err).Fatal("Failed to save config")
+	options.Issues.SetTable("")
+
+	if err := config.Save(); err != nil {
+		log.WithError(err).Errorln("Failed to save config")
+		failed++
 	}
 
-	log.Info("Replication completed")
+	return failed
+}
+
+// SyncResult summarizes a table synchronization
+type SyncResult struct {
+	RowsRead     int
+	RowsInserted int
+	Duration     time.Duration
+	// NewCursor is the time the synchronization started or the cursor window edge,
+	// to be saved as the last sync
+	NewCursor time.Time
+	// NewValue is the highest sequence value when the synchronization started, for sequence cursors
+	NewValue int64
 }
 
 // SynchronizeTable synchronizes a table from ClickHouse to Postgres
-func SynchronizeTable(config Config, table Table, conn driver.Conn, db *pgxpool.Pool) error {
-	if err := CreatePostgresTable(table, db); err != nil {
+func SynchronizeTable(config Config, table Table, conn Reader, db Pool) (SyncResult, error) {
+	start := time.Now()
+	result := SyncResult{NewCursor: start}
+
+	// Checkpoints record the cursor bounds the sync started from
+	bounds := table.Cursor
+
+	// An interrupted sync resumes with the cursor it would have saved, so the rows changed since it started
+	// are read again by the next run. Batches merged at the end and partitioned reads are not checkpointed.
+	table.Checkpoint = table.ResumeCheckpoint()
+	if table.SingleMerge || table.Partitioned {
+		table.Checkpoint = nil
+	}
+	if table.Checkpoint != nil {
+		result.NewCursor = table.Checkpoint.NewCursor
+	}
+
+	// Hooks are cancelled with the sync, once it failed or ended
+	hooksCtx, cancelHooks := context.WithCancel(ctx)
+	defer cancelHooks()
+	config.Hooks = config.Hooks.withContext(hooksCtx)
+	config.Hooks.tableStart(table)
+
+	// The first failure is returned with the table, batch and offset it happened at
+	var failure error
+	var failureMu sync.Mutex
+	fail := func(err error) error {
+		err = fmt.Errorf("table %s: %w", table.GetName(), err)
+		config.Hooks.error(table, err)
+
+		failureMu.Lock()
+		defer failureMu.Unlock()
+		if failure == nil {
+			failure = err
+			cancelHooks()
+		}
 		return err
 	}
 
-	columns := table.GetDestinationColumns()
-	batches := make(chan [][]interface{})
+	// Rows are copied, which has no parameter limit, but wide batches are held in memory
+	if len(table.Columns) > WideColumns {
+		log.WithFields(log.Fields{
+			"columns":    len(table.Columns),
+			"batch_size": config.BatchSize,
+		}).Warn("Wide table, consider lowering batch_size or setting copy_chunk_size")
+	}
+
+	// The read stops at the sequence end found here, saved so the next run continues past it
+	if table.Cursor.Column != "" && table.Cursor.IsSequence() {
+		end, err := SequenceCursorEnd(table, conn)
+		if err != nil {
+			return result, fail(fmt.Errorf("cursor sequence: %w", err))
+		}
+
+		// A resumed sync stops at the end of the interrupted one
+		if table.Checkpoint != nil {
+			end = table.Checkpoint.NewValue
+		}
+
+		table.Cursor.UntilValue = end
+		result.NewValue = end
+	}
+
+	// A bound set for the run is saved as the cursor, unless it lies in the future
+	if !table.Cursor.Until.IsZero() && table.Cursor.Until.Before(result.NewCursor) {
+		result.NewCursor = table.Cursor.Until
+	}
+
+	// Appended rows are never merged, so the read stops at the saved cursor rather than inserting
+	// the rows stamped after it twice
+	if table.Mode == ModeAppend && table.Cursor.Column != "" && !table.Cursor.IsSequence() && table.Cursor.Until.IsZero() {
+		table.Cursor.Until = result.NewCursor
+	}
+
+	if table.Cursor.Column != "" && table.Cursor.MaxWindow > 0 {
+		until, err := CursorWindowEnd(table, conn)
+		if err != nil {
+			return result, fail(fmt.Errorf("cursor window: %w", err))
+		}
+
+		// The cursor is saved at the window edge so the next run continues from there
+		if !until.IsZero() && until.Before(result.NewCursor) {
+			table.Cursor.Until = until
+			result.NewCursor = until
+
+			log.WithField("until", until).Info("Limiting run to cursor window")
+		}
+	}
+
+	if err := CreateSchema(&table, conn, db); err != nil {
+		return result, fail(err)
+	}
+
+	// Full reloads are faster without maintaining the secondary indexes, rebuilt once the rows are loaded
+	rebuildPrimaryKey := false
+	if table.IsFullLoad() && (table.RebuildIndexes || table.RebuildPrimaryKey) {
+		if table.RebuildIndexes && table.CreateIndexes != CreateIndexesNever {
+			table.CreateIndexes = CreateIndexesAfterLoad
+			if err := DropDeferredIndexes(table, db); err != nil {
+				return result, fail(fmt.Errorf("drop indexes: %w", err))
+			}
+		}
+
+		if table.RebuildPrimaryKey && len(table.GetPrimaryKey()) > 0 && table.PrimaryKeyMode != PrimaryKeyModeNone {
+			if err := DropPrimaryKey(table, db); err != nil {
+				return result, fail(fmt.Errorf("drop primary key: %w", err))
+			}
+			rebuildPrimaryKey = true
+		}
+	}
+
+	staging := ""
+	if table.SingleMerge {
+		tableName, err := MakeStagingTable(config, table, db)
+		if err != nil {
+			return result, fail(err)
+		}
+		defer DropStagingTable(db, tableName)
+
+		staging = tableName
+	}
+
+	// Batches merged at the end cannot be checkpointed one by one,
+	// and keys restart with every partition
+	var checkpointer *Checkpointer
+	if !table.SingleMerge && !table.Partitioned {
+		checkpointer = NewCheckpointer(config, table.Destination, bounds, result)
+	}
+
+	type keyedBatch struct {
+		rows [][]interface{}
+		key  *BatchKey
+	}
+
+	columns := table.GetCopyColumns()
+	batches := make(chan keyedBatch, max(config.Prefetch, 0))
+	var inserted atomic.Int64
 
 	go func() {
 		defer close(batches)
-		total, err := Batching(table, conn, config.BatchSize, func(batch [][]interface{}) error {
-			batches <- batch
+		send := func(batch [][]interface{}, key *BatchKey) error {
+			batches <- keyedBatch{batch, key}
 			return nil
-		})
+		}
+
+		var total int
+		var err error
+		if table.Partitioned {
+			total, err = BatchingPartitions(config, table, conn, func(batch [][]interface{}) error {
+				return send(batch, nil)
+			})
+		} else {
+			total, err = BatchingKeys(config, table, conn, send)
+		}
 
 		if err != nil {
 			log.WithError(err).Errorln("Failed to batch")
+			fail(err)
 		}
 
+		result.RowsRead = total
 		log.WithField("total", total).Infoln("Selecting data completed")
 	}()
 
+	workers := config.Workers
+	if workers <= 0 {
+		workers = int(db.MaxConns())
+	}
+
+	// Batches wait for a free worker, so the reader blocks and memory stays bounded
+	slots := make(chan struct{}, workers)
+
 	wg := sync.WaitGroup{}
-	for batch := range batches {
+	index := 0
+	for keyed := range batches {
+		slots <- struct{}{}
 		wg.Add(1)
 
-		go func(batch [][]interface{}) {
+		go func(batch [][]interface{}, key *BatchKey, index int) {
 			defer wg.Done()
-			log.WithField("batch", len(batch)).Info("Inserting batch")
+			defer func() { <-slots }()
+
+			offset := index * config.BatchSize
+			logger := log.WithFields(log.Fields{
+				"batch":  index,
+				"offset": offset,
+			})
+			failBatch := func(message string, err error) {
+				logger.WithError(err).Errorln(message)
+				fail(fmt.Errorf("batch %d at offset %d: %w", index, offset, err))
+			}
+
+			// A panic fails the batch rather than the process, leaving the cursor untouched
+			defer func() {
+				if r := recover(); r != nil {
+					failBatch("Batch panicked", fmt.Errorf("panic: %v", r))
+				}
+			}()
+
+			logger.WithField("rows", len(batch)).Info("Inserting batch")
+
+			if table.ReportDuplicates && table.Mode != ModeAppend {
+				if duplicates := CountDuplicates(table, batch); duplicates > 0 {
+					logger.WithField("duplicates", duplicates).Warn("Batch has duplicate conflict keys, keeping one row per key")
+				}
+			}
 
 			conn, err := db.Acquire(ctx)
 			if err != nil {
-				log.WithError(err).Errorln("Failed to acquire connection")
+				failBatch("Failed to acquire connection", err)
 				return
 			}
 			defer conn.Release()
 
-			tableName, err := MakeTemporaryTable(table, conn)
-			if err != nil {
-				log.WithError(err).Errorln("Failed to make temporary table")
+			if err := PrepareConnection(conn, config.Postgres, table); err != nil {
+				failBatch("Failed to prepare connection", err)
 				return
 			}
 
-			_, err = conn.CopyFrom(
-				ctx,
-				pgx.Identifier{tableName},
-				columns,
-				pgx.CopyFromRows(batch),
-			)
-			if err != nil {
-				log.WithError(err).Errorln("Failed to insert batch")
+			tableName := staging
+			if tableName == "" {
+				tableName, err = MakeTemporaryTable(config, table, conn, index)
+				if err != nil {
+					failBatch("Failed to make temporary table", err)
+					return
+				}
+
+				// Temporary tables live as long as the pooled connection, so they are dropped too.
+				// Dropped on the worker connection, released after, as the pool may have no other free connection.
+				defer DropStagingTable(conn, tableName)
+			}
+
+			// Large batches are copied and merged in chunks to keep transactions short
+			chunkSize := config.CopyChunkSize
+			if chunkSize <= 0 {
+				chunkSize = len(batch)
+			}
+
+			// A chunk is copied, merged and cleared in one transaction, so it is merged whole or not at all
+			writeChunk := func(chunk [][]interface{}, last bool) (int64, error) {
+				// Partitions are created before the rows they hold, the parent routing them on merge
+				if table.PartitionBy != nil {
+					if err := CreatePartitions(table, conn, chunk); err != nil {
+						return 0, fmt.Errorf("partitions: %w", err)
+					}
+				}
+
+				tx, err := conn.Begin(ctx)
+				if err != nil {
+					return 0, fmt.Errorf("begin: %w", err)
+				}
+				defer tx.Rollback(ctx)
+
+				if err := SetTimeouts(tx, config.Postgres); err != nil {
+					return 0, fmt.Errorf("timeouts: %w", err)
+				}
+
+				copied, err := WriteRows(config, tx, tableName, columns, chunk)
+				if err != nil {
+					return 0, fmt.Errorf("insert: %w", err)
+				}
+
+				// Rolled back, so a chunk missing rows is not merged
+				if table.VerifyBatches && copied != int64(len(chunk)) {
+					return 0, fmt.Errorf("copied %d rows out of %d read", copied, len(chunk))
+				}
+
+				if staging == "" {
+					if err := MoveTemporaryTable(table, tx, tableName); err != nil {
+						return 0, fmt.Errorf("move temporary table: %w", err)
+					}
+
+					if !last {
+						if _, err := tx.Exec(ctx, fmt.Sprintf("TRUNCATE %s", QuoteQualified(tableName))); err != nil {
+							return 0, fmt.Errorf("truncate temporary table: %w", err)
+						}
+					}
+				}
+
+				return copied, tx.Commit(ctx)
+			}
+
+			for from := 0; from < len(batch); from += chunkSize {
+				chunk := batch[from:min(from+chunkSize, len(batch))]
+
+				copied, err := writeChunk(chunk, from+chunkSize >= len(batch))
+				if err != nil {
+					failBatch("Failed to insert batch", err)
+					return
+				}
+				inserted.Add(copied)
 			}
 
-			if err := MoveTemporaryTable(table, conn, tableName); err != nil {
-				log.WithError(err).Errorln("Failed to move temporary table")
+			if staging != "" {
+				return
 			}
-		}(batch)
+
+			checkpointer.Commit(index, key)
+		}(keyed.rows, keyed.key, index)
+		index++
 	}
 
 	wg.Wait()
 
-	log.Infoln("Data inserted")
+	if staging != "" && failure == nil {
+		conn, err := db.Acquire(ctx)
+		if err != nil {
+			return result, fail(err)
+		}
+		defer conn.Release()
+
+		if err := PrepareConnection(conn, config.Postgres, table); err != nil {
+			return result, fail(err)
+		}
+
+		// The merge runs in a transaction bounding it with the timeouts
+		merge := func() error {
+			tx, err := conn.Begin(ctx)
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback(ctx)
+
+			if err := SetTimeouts(tx, config.Postgres); err != nil {
+				return err
+			}
+
+			if err := MoveTemporaryTable(table, tx, staging); err != nil {
+				return err
+			}
+			return tx.Commit(ctx)
+		}
+
+		if err := merge(); err != nil {
+			log.WithError(err).Errorln("Failed to move staging table")
+			fail(fmt.Errorf("merge: %w", err))
+		}
+	}
+
+	result.RowsInserted = int(inserted.Load())
+	result.Duration = time.Since(start)
+
+	if failure != nil {
+		return result, failure
+	}
+
+	if rebuildPrimaryKey {
+		log.Info("Adding primary key after load")
+		if err := AddPrimaryKey(table, db); err != nil {
+			return result, fail(fmt.Errorf("add primary key: %w", err))
+		}
+	}
+
+	// Indexes built once the rows are loaded are much faster to create than to maintain while copying
+	if table.CreateIndexes == CreateIndexesAfterLoad {
+		for _, index := range table.Indexes {
+			if table.DefersIndex(index) {
+				log.WithField("index", index.Name).Info("Creating index after load")
+				CreateIndex(table, index, db)
+			}
+		}
+	}
+
+	if result.RowsRead == 0 {
+		// Keep the cursor as is, unless a window edge was reached
+		if table.Cursor.Until.IsZero() {
+			result.NewCursor = table.Cursor.LastSync
+		}
+		result.NewValue = table.Cursor.LastValue
+
+		log.WithField("table", table.GetName()).Info("No rows to synchronize")
+		config.Hooks.tableDone(table, 0)
+
+		return result, nil
+	}
+
+	if result.RowsInserted != result.RowsRead {
+		log.WithFields(log.Fields{
+			"read":     result.RowsRead,
+			"inserted": result.RowsInserted,
+		}).Warn("Inserted row count does not match rows read")
+	}
+
+	log.WithField("inserted", result.RowsInserted).Infoln("Data inserted")
+	config.Hooks.tableDone(table, result.RowsRead)
+
+	return result, nil
+}
+
+// maxParameters is the Postgres limit of bind parameters per statement
+const maxParameters = 65535
+
+// WriteRows writes rows into a staged table with COPY, or multi-row INSERT statements
+// where COPY is not permitted
+func WriteRows(config Config, conn Executor, tableName string, columns []string, rows [][]interface{}) (int64, error) {
+	identifier := pgx.Identifier(strings.Split(tableName, "."))
+
+	if config.InsertMethod != InsertMethodInsert {
+		// pgx always copies in the binary format, encoding each value with the
+		// codec of the destination column type, so there is no text round-trip
+		return conn.CopyFrom(ctx, identifier, columns, pgx.CopyFromRows(rows))
+	}
+
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = pgx.Identifier{column}.Sanitize()
+	}
+
+	// Statements are chunked to stay under the parameter limit
+	perStatement := max(maxParameters/max(len(columns), 1), 1)
+
+	inserted := int64(0)
+	for from := 0; from < len(rows); from += perStatement {
+		chunk := rows[from:min(from+perStatement, len(rows))]
+
+		values := make([]string, len(chunk))
+		args := make([]interface{}, 0, len(chunk)*len(columns))
+		for i, row := range chunk {
+			placeholders := make([]string, len(row))
+			for j, value := range row {
+				args = append(args, value)
+				placeholders[j] = fmt.Sprintf("$%d", len(args))
+			}
+			values[i] = fmt.Sprintf("(%s)", strings.Join(placeholders, ", "))
+		}
+
+		tag, err := conn.Exec(ctx, fmt.Sprintf(
+			"INSERT INTO %s (%s) VALUES %s",
+			identifier.Sanitize(),
+			strings.Join(quoted, ", "),
+			strings.Join(values, ", "),
+		), args...)
+		if err != nil {
+			return inserted, err
+		}
+		inserted += tag.RowsAffected()
+	}
+
+	return inserted, nil
+}
+
+// CreateSchema infers the missing column types, creates or migrates the destination table
+// and copies the column comments if enabled
+func CreateSchema(table *Table, conn Reader, db Pool) error {
+	if err := InferColumnTypes(table, conn); err != nil {
+		return err
+	}
+
+	// A table whose columns can never be loaded is not created
+	if err := CheckSourceTypes(*table, conn); err != nil {
+		return fmt.Errorf("incompatible types: %w", err)
+	}
+
+	if err := CreatePostgresTable(*table, db); err != nil {
+		return err
+	}
+
+	if table.AutoMigrate {
+		if err := MigrateTable(*table, db); err != nil {
+			return fmt.Errorf("migrate: %w", err)
+		}
+	}
+
+	if table.CopyComments {
+		if err := CopyComments(*table, conn, db); err != nil {
+			return fmt.Errorf("copy comments: %w", err)
+		}
+	}
 
 	return nil
 }
 
 // MoveTemporaryTable moves the temporary table to the main table
-func MoveTemporaryTable(table Table, conn *pgxpool.Conn, tableName string) error {
-	updateQuery := []string{}
-	for _, column := range table.GetDestinationColumns() {
-		updateQuery = append(updateQuery, fmt.Sprintf("%s = EXCLUDED.%s", column, column))
+func MoveTemporaryTable(table Table, conn Executor, tableName string) error {
+	log.WithField("source", tableName).Info("Moving temporary table")
+
+	// Rows are merged in key order so concurrent merges lock rows in the same order and cannot deadlock
+	conflictColumns := strings.Join(QuoteIdentifiers(table.GetConflictColumns()), ", ")
+	distinct := fmt.Sprintf("DISTINCT ON (%s) ", conflictColumns)
+	if table.DedupInMerge != nil && !*table.DedupInMerge {
+		distinct = ""
 	}
 
-	log.WithField("source", tableName).Info("Moving temporary table")
-	_, err := conn.Exec(ctx, fmt.Sprintf(`
-		INSERT INTO %s
-		SELECT DISTINCT ON (%s) * FROM %s
-		ON CONFLICT (%s) DO UPDATE SET
-		%s;
-	`, table.Destination,
-		strings.Join(table.GetPrimaryKey(), ", "),
-		tableName,
-		strings.Join(table.GetPrimaryKey(), ", "),
-		strings.Join(updateQuery, ", "),
-	))
+	query := fmt.Sprintf(`
+		INSERT INTO %s AS target
+		SELECT %s* FROM %s
+		ORDER BY %s
+		ON CONFLICT (%s) %s;
+	`, QuoteQualified(table.Destination),
+		distinct,
+		QuoteQualified(tableName),
+		conflictColumns,
+		conflictColumns,
+		GetConflictAction(table),
+	)
 
-	if err != nil {
-		log.WithError(err).Errorln("Failed to move temporary table")
+	if table.Mode == ModeAppend {
+		query = fmt.Sprintf("INSERT INTO %s SELECT * FROM %s", QuoteQualified(table.Destination), QuoteQualified(tableName))
+	}
+
+	if _, err := conn.Exec(ctx, query); err != nil {
+		return err
 	}
 
 	log.WithField("table", tableName).Infoln("Moved temporary table")
@@ -203,62 +988,256 @@ func MoveTemporaryTable(table Table, conn *pgxpool.Conn, tableName string) error
 	return nil
 }
 
+// GetConflictAction builds the ON CONFLICT action of the upsert
+func GetConflictAction(table Table) string {
+	if table.ConflictAction == ConflictActionNothing {
+		return "DO NOTHING"
+	}
+
+	columns := QuoteIdentifiers(table.GetUpdateColumns())
+	if len(columns) == 0 {
+		return "DO NOTHING"
+	}
+
+	updateQuery := []string{}
+	for _, column := range columns {
+		updateQuery = append(updateQuery, fmt.Sprintf("%s = EXCLUDED.%s", column, column))
+	}
+
+	action := fmt.Sprintf("DO UPDATE SET %s", strings.Join(updateQuery, ", "))
+	if !table.SkipUnchanged {
+		return action
+	}
+
+	current := []string{}
+	excluded := []string{}
+	for _, column := range table.Columns {
+		// Destination-only columns are filled anew on every merge, so they would always differ
+		if column.Source == "" || slices.Contains(table.ExcludeFromUpdate, column.Destination) {
+			continue
+		}
+
+		// json has no equality operator, so its values are compared as jsonb
+		cast := ""
+		if base, _, _ := ParseColumnType(column.Type); base == "json" || base == "json[]" {
+			cast = "::jsonb" + strings.TrimPrefix(base, "json")
+		}
+
+		name := QuoteIdentifier(column.Destination)
+		current = append(current, "target."+name+cast)
+		excluded = append(excluded, "EXCLUDED."+name+cast)
+	}
+
+	if len(current) == 0 {
+		return action
+	}
+
+	return fmt.Sprintf(
+		"%s WHERE (%s) IS DISTINCT FROM (%s)",
+		action,
+		strings.Join(current, ", "),
+		strings.Join(excluded, ", "),
+	)
+}
+
 // CreatePostgresTable creates a table in Postgres
-func CreatePostgresTable(table Table, db *pgxpool.Pool) error {
+func CreatePostgresTable(table Table, db Executor) error {
 	columns := []string{}
 
 	for _, column := range table.Columns {
-		columns = append(columns, fmt.Sprintf("%s %s", column.Destination, column.Type))
+		columns = append(columns, column.GetDefinition())
+	}
+
+	partitionBy := ""
+	if table.PartitionBy != nil {
+		partitionBy = fmt.Sprintf(" PARTITION BY RANGE (%s)", QuoteIdentifier(table.PartitionBy.Column))
 	}
 
 	_, err := db.Exec(ctx, fmt.Sprintf(
-		`CREATE TABLE IF NOT EXISTS %s (%s)`,
-		table.Destination,
+		`CREATE TABLE IF NOT EXISTS %s (%s)%s`,
+		QuoteQualified(table.Destination),
 		strings.Join(columns, ", "),
+		partitionBy,
 	))
 	if err != nil {
 		return err
 	}
 
-	if len(table.GetPrimaryKey()) > 0 {
-		_, err = db.Exec(ctx, fmt.Sprintf(
-			`ALTER TABLE %s ADD PRIMARY KEY (%s)`,
-			table.Destination,
-			strings.Join(table.GetPrimaryKey(), ", "),
-		))
+	if len(table.GetPrimaryKey()) > 0 && table.PrimaryKeyMode != PrimaryKeyModeNone {
+		// Tables created by a previous run already have their constraint, which cannot be added twice
+		existing := ""
+		if table.PrimaryKeyMode != PrimaryKeyModeUniqueIndex {
+			if existing, err = PrimaryKeyConstraint(table, db); err != nil {
+				log.WithError(err).Warn("Failed to look up primary key")
+			}
+		}
 
-		if err != nil {
-			log.WithError(err).Warn("Failed to add primary key")
+		if existing == "" && err == nil {
+			if err := AddPrimaryKey(table, db); err != nil {
+				log.WithError(err).Warn("Failed to add primary key")
+			}
 		}
 	}
 
 	for _, index := range table.Indexes {
-		_, err = db.Exec(ctx, fmt.Sprintf(
-			`CREATE INDEX IF NOT EXISTS %s_%s ON %s (%s)`,
-			table.Destination,
-			index.Name,
-			table.Destination,
-			strings.Join(index.Columns, ", "),
+		if !table.DefersIndex(index) {
+			CreateIndex(table, index, db)
+		}
+	}
+
+	return nil
+}
+
+// AddPrimaryKey adds the primary key of the destination table, as a unique index with the unique_index mode
+func AddPrimaryKey(table Table, db Executor) error {
+	if table.PrimaryKeyMode == PrimaryKeyModeUniqueIndex {
+		index := table.GetPrimaryKeyIndex()
+		_, err := db.Exec(ctx, fmt.Sprintf(
+			`CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s (%s)`,
+			QuoteIdentifier(table.GetIndexName(index)),
+			QuoteQualified(table.Destination),
+			strings.Join(QuoteIdentifiers(index.Columns), ", "),
 		))
+		return err
+	}
 
-		if err != nil {
-			log.WithError(err).Warn("Failed to create index")
-		}
+	_, err := db.Exec(ctx, fmt.Sprintf(
+		`ALTER TABLE %s ADD PRIMARY KEY (%s)`,
+		QuoteQualified(table.Destination),
+		strings.Join(QuoteIdentifiers(table.GetPrimaryKey()), ", "),
+	))
+	return err
+}
+
+// PrimaryKeyConstraint returns the name of the primary key constraint of the destination table,
+// empty if it has none
+func PrimaryKeyConstraint(table Table, db Executor) (string, error) {
+	var name string
+	err := db.QueryRow(ctx, `
+		SELECT conname FROM pg_constraint WHERE conrelid = $1::regclass AND contype = 'p'
+	`, QuoteQualified(table.Destination)).Scan(&name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	return name, err
+}
+
+// DropPrimaryKey drops the primary key constraint of the destination table, or its unique index, if any
+func DropPrimaryKey(table Table, db Executor) error {
+	if table.PrimaryKeyMode == PrimaryKeyModeUniqueIndex {
+		index := table.GetPrimaryKeyIndex()
+		log.WithField("index", table.GetIndexName(index)).Info("Dropping primary key index before load")
+		_, err := db.Exec(ctx, fmt.Sprintf("DROP INDEX IF EXISTS %s", QuoteQualified(table.GetQualifiedIndexName(index))))
+		return err
+	}
+
+	name, err := PrimaryKeyConstraint(table, db)
+	if err != nil || name == "" {
+		return err
 	}
 
+	log.WithField("constraint", name).Info("Dropping primary key before load")
+	_, err = db.Exec(ctx, fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s", QuoteQualified(table.Destination), pgx.Identifier{name}.Sanitize()))
+	return err
+}
+
+// DropDeferredIndexes drops the indexes created after the load, so they are rebuilt instead of maintained
+func DropDeferredIndexes(table Table, db Executor) error {
+	for _, index := range table.Indexes {
+		if !table.DefersIndex(index) {
+			continue
+		}
+
+		log.WithField("index", index.Name).Info("Dropping index before load")
+		if _, err := db.Exec(ctx, fmt.Sprintf("DROP INDEX IF EXISTS %s", QuoteQualified(table.GetQualifiedIndexName(index)))); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// MakeTemporaryTable creates a temporary table
-func MakeTemporaryTable(table Table, conn *pgxpool.Conn) (string, error) {
-	rnd := uuid.New().String()[:8]
-	tableName := fmt.Sprintf("%s_%s_tmp", table.Destination, rnd)
+// CreateIndex creates an index of the destination table if missing, a failure only being logged
+func CreateIndex(table Table, index Index, db Executor) {
+	unique := ""
+	if index.Unique {
+		unique = "UNIQUE "
+	}
+
+	_, err := db.Exec(ctx, fmt.Sprintf(
+		`CREATE %sINDEX IF NOT EXISTS %s ON %s (%s)`,
+		unique,
+		QuoteIdentifier(table.GetIndexName(index)),
+		QuoteQualified(table.Destination),
+		strings.Join(QuoteIdentifiers(index.Columns), ", "),
+	))
+
+	if err != nil {
+		log.WithError(err).Warn("Failed to create index")
+	}
+}
+
+// MakeTemporaryTable creates a temporary table, or a regular table in the staging schema if any
+func MakeTemporaryTable(config Config, table Table, conn Executor, batch int) (string, error) {
+	suffix := "tmp"
+	if config.StagingRunNames {
+		suffix = fmt.Sprintf("b%d_tmp", batch)
+	}
+	tableName := StagingTableName(config, table, suffix)
+	log.WithField("table", tableName).Info("Creating temporary table")
+
+	kind := "UNLOGGED"
+	if config.StagingSchema == "" {
+		// Temporary tables live in the session temporary schema and cannot be created in the destination one
+		kind = "TEMPORARY"
+		_, tableName = splitQualified(tableName)
+	}
 
 	_, err := conn.Exec(ctx, fmt.Sprintf(
-		`CREATE TEMPORARY TABLE %s (LIKE %s INCLUDING DEFAULTS)`,
-		tableName,
-		table.Destination,
+		`CREATE %s TABLE %s (LIKE %s INCLUDING DEFAULTS)`,
+		kind,
+		QuoteQualified(tableName),
+		QuoteQualified(table.Destination),
 	))
 
 	return tableName, err
 }
+
+// MakeStagingTable creates an unlogged table shared by every worker of a table sync,
+// temporary tables being bound to a single connection
+func MakeStagingTable(config Config, table Table, db Executor) (string, error) {
+	tableName := StagingTableName(config, table, "staging")
+	log.WithField("table", tableName).Info("Creating staging table")
+
+	_, err := db.Exec(ctx, fmt.Sprintf(
+		`CREATE UNLOGGED TABLE %s (LIKE %s INCLUDING DEFAULTS)`,
+		QuoteQualified(tableName),
+		QuoteQualified(table.Destination),
+	))
+
+	return tableName, err
+}
+
+// StagingTableName builds a unique staging table name, placed in the staging schema if any.
+// With staging run names, the random part is replaced by the run ID to correlate tables with a run.
+func StagingTableName(config Config, table Table, suffix string) string {
+	name := table.Destination
+	if config.StagingSchema != "" {
+		name = config.StagingSchema + "." + name[strings.LastIndex(name, ".")+1:]
+	}
+
+	id := uuid.New().String()[:8]
+	if config.NewID != nil {
+		id = config.NewID()
+	}
+	if config.StagingRunNames {
+		id = "run" + config.RunID
+	}
+	return TruncateQualified(fmt.Sprintf("%s_%s_%s", name, id, suffix))
+}
+
+// DropStagingTable drops a staging table once it has been merged
+func DropStagingTable(db Executor, tableName string) {
+	if _, err := db.Exec(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", QuoteQualified(tableName))); err != nil {
+		log.WithError(err).WithField("table", tableName).Warn("Failed to drop staging table")
+	}
+}
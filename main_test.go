@@ -0,0 +1,1577 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/netip"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+var eventColumns = []fakeColumn{
+	{name: "id", chType: "UInt32", scan: reflect.TypeOf(uint32(0))},
+	{name: "name", chType: "String", scan: reflect.TypeOf("")},
+}
+
+// eventsTable is an upserted table of the events fake source
+func eventsTable() Table {
+	return Table{
+		Source:      "events",
+		Destination: "events",
+		Columns: []Column{
+			{Source: "id", Destination: "id", Type: "bigint", Primary: true},
+			{Source: "name", Destination: "name", Type: "text"},
+		},
+	}
+}
+
+// eventRows returns n rows of the events fake source
+func eventRows(n int) [][]any {
+	rows := [][]any{}
+	for i := 1; i <= n; i++ {
+		rows = append(rows, []any{uint32(i), "event"})
+	}
+	return rows
+}
+
+func TestSynchronizeTable(t *testing.T) {
+	source := newFakeSource(eventColumns, eventRows(5))
+	pool := newFakePool()
+
+	result, err := SynchronizeTable(Config{BatchSize: 2}, eventsTable(), source, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.RowsRead != 5 || result.RowsInserted != 5 {
+		t.Errorf("read %d and inserted %d rows, want 5", result.RowsRead, result.RowsInserted)
+	}
+
+	if copied := pool.Copied("events_"); len(copied) != 5 {
+		t.Errorf("copied %d rows into the temporary tables, want 5", len(copied))
+	}
+
+	if merges := pool.Statements("INSERT INTO events AS target"); len(merges) != 3 {
+		t.Errorf("merged %d batches, want 3", len(merges))
+	}
+
+	if len(pool.Statements("CREATE TABLE IF NOT EXISTS events")) != 1 {
+		t.Error("destination table not created")
+	}
+
+	if acquired := pool.Acquired(); acquired != 0 {
+		t.Errorf("%d connections not released", acquired)
+	}
+}
+
+func TestSynchronizeTableRollsBackFailedMerge(t *testing.T) {
+	source := newFakeSource(eventColumns, eventRows(2))
+	pool := newFakePool()
+	pool.failures["INSERT INTO events AS target"] = errors.New("merge failed")
+
+	if _, err := SynchronizeTable(Config{BatchSize: 10}, eventsTable(), source, pool); err == nil {
+		t.Fatal("SynchronizeTable succeeded with a failed merge")
+	}
+
+	// The rows were copied, but the copy is rolled back with the merge
+	if len(pool.Copied("events_")) != 2 {
+		t.Error("rows not copied before the merge")
+	}
+	if len(pool.Statements("COMMIT")) != 0 {
+		t.Error("batch committed after a failed merge")
+	}
+	if len(pool.Statements("ROLLBACK")) != 1 {
+		t.Error("batch not rolled back after a failed merge")
+	}
+}
+
+func TestMakeTemporaryTable(t *testing.T) {
+	config := Config{NewID: func() string { return "id" }}
+
+	db := newFakeDB()
+	tableName, err := MakeTemporaryTable(config, eventsTable(), db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "CREATE TEMPORARY TABLE events_id_tmp (LIKE events INCLUDING DEFAULTS)"; tableName != "events_id_tmp" || db.statements[0] != want {
+		t.Errorf("created %s with %q, want %q", tableName, db.statements[0], want)
+	}
+
+	// Temporary tables of a destination in another schema are not qualified
+	table := eventsTable()
+	table.Destination = "analytics.events"
+	db = newFakeDB()
+	tableName, err = MakeTemporaryTable(config, table, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "CREATE TEMPORARY TABLE events_id_tmp (LIKE analytics.events INCLUDING DEFAULTS)"; tableName != "events_id_tmp" || db.statements[0] != want {
+		t.Errorf("created %s with %q, want %q", tableName, db.statements[0], want)
+	}
+
+	config.StagingSchema = "staging"
+	db = newFakeDB()
+	tableName, err = MakeTemporaryTable(config, eventsTable(), db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "CREATE UNLOGGED TABLE staging.events_id_tmp (LIKE events INCLUDING DEFAULTS)"; tableName != "staging.events_id_tmp" || db.statements[0] != want {
+		t.Errorf("created %s with %q, want %q", tableName, db.statements[0], want)
+	}
+}
+
+func TestSynchronizeTableInjectedID(t *testing.T) {
+	run := func() []string {
+		ids := 0
+		config := Config{BatchSize: 2, Workers: 1, NewID: func() string {
+			ids++
+			return fmt.Sprintf("%08d", ids)
+		}}
+
+		pool := newFakePool()
+		if _, err := SynchronizeTable(config, eventsTable(), newFakeSource(eventColumns, eventRows(3)), pool); err != nil {
+			t.Fatal(err)
+		}
+		return pool.Statements("")
+	}
+
+	// The generated SQL is the same on every run, as a golden file would expect
+	first, second := run(), run()
+	if !slices.Equal(first, second) {
+		t.Errorf("runs differ:\n%q\n%q", first, second)
+	}
+	for _, want := range []string{"events_00000001_tmp", "events_00000002_tmp"} {
+		if !slices.ContainsFunc(first, func(statement string) bool { return strings.Contains(statement, want) }) {
+			t.Errorf("no statement on %s in %q", want, first)
+		}
+	}
+}
+
+func TestStagingTableNameLength(t *testing.T) {
+	table := Table{Destination: strings.Repeat("x", 60)}
+
+	// Names only differing past the limit must stay apart once truncated
+	names := map[string]bool{}
+	for _, config := range []Config{{}, {StagingSchema: "staging"}} {
+		for i := 0; i < 100; i++ {
+			name := StagingTableName(config, table, "tmp")
+			_, unqualified := splitQualified(name)
+			if len(unqualified) > maxIdentifierLength {
+				t.Errorf("staging table %s has %d characters, over the limit of %d", name, len(unqualified), maxIdentifierLength)
+			}
+			if names[name] {
+				t.Errorf("staging table %s named twice", name)
+			}
+			names[name] = true
+		}
+	}
+
+	// The tables of every batch of a run are apart too
+	config := Config{StagingRunNames: true, RunID: "1a2b3c4d"}
+	for batch := 0; batch < 20; batch++ {
+		name := StagingTableName(config, table, fmt.Sprintf("b%d_tmp", batch))
+		if len(name) > maxIdentifierLength || names[name] {
+			t.Errorf("batch %d staging table %s is too long or not unique", batch, name)
+		}
+		names[name] = true
+	}
+}
+
+func TestSynchronizeTableDropsStagingTables(t *testing.T) {
+	source := newFakeSource(eventColumns, eventRows(5))
+	pool := newFakePool()
+	pool.maxConns = 1
+
+	config := Config{BatchSize: 2, StagingSchema: "staging"}
+	if _, err := SynchronizeTable(config, eventsTable(), source, pool); err != nil {
+		t.Fatal(err)
+	}
+
+	if dropped := pool.Statements("DROP TABLE IF EXISTS staging.events_"); len(dropped) != 3 {
+		t.Errorf("dropped %d staging tables, want 3", len(dropped))
+	}
+	if acquired := pool.Acquired(); acquired != 0 {
+		t.Errorf("%d connections not released", acquired)
+	}
+}
+
+func TestSynchronizeTableDropsTemporaryTables(t *testing.T) {
+	source := newFakeSource(eventColumns, eventRows(5))
+	pool := newFakePool()
+
+	config := Config{BatchSize: 2, StagingRunNames: true, RunID: "1"}
+	if _, err := SynchronizeTable(config, eventsTable(), source, pool); err != nil {
+		t.Fatal(err)
+	}
+
+	for batch := 0; batch < 3; batch++ {
+		if dropped := pool.Statements(fmt.Sprintf("DROP TABLE IF EXISTS events_run1_b%d_tmp", batch)); len(dropped) != 1 {
+			t.Errorf("temporary table of batch %d dropped %d times, want once", batch, len(dropped))
+		}
+	}
+}
+
+func TestReplicateRunID(t *testing.T) {
+	config := &Config{}
+	options := RunOptions{Issues: &Issues{}}
+
+	Replicate(config, options, nil, nil)
+	first := config.RunID
+
+	Replicate(config, options, nil, nil)
+	if first == "" || config.RunID == first {
+		t.Errorf("run IDs %q then %q, want a new ID per run", first, config.RunID)
+	}
+}
+
+func TestMoveTemporaryTableDedup(t *testing.T) {
+	db := newFakeDB()
+	if err := MoveTemporaryTable(eventsTable(), db, "events_tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(db.statements[0], "SELECT DISTINCT ON (id) * FROM events_tmp\n\t\tORDER BY id\n\t\tON CONFLICT (id) DO UPDATE SET") {
+		t.Errorf("merge without deduplication: %s", db.statements[0])
+	}
+
+	dedup := false
+	table := eventsTable()
+	table.DedupInMerge = &dedup
+
+	db = newFakeDB()
+	if err := MoveTemporaryTable(table, db, "events_tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(db.statements[0], "SELECT * FROM events_tmp\n\t\tORDER BY id\n\t\tON CONFLICT (id) DO UPDATE SET") {
+		t.Errorf("merge still deduplicating or no longer upserting: %s", db.statements[0])
+	}
+}
+
+func TestReplicate(t *testing.T) {
+	pool := newFakePool()
+	config := &Config{BatchSize: 10, Tables: []Table{eventsTable()}}
+	sources := fakeSources{"": newFakeSource(eventColumns, eventRows(3))}
+
+	if failed := Replicate(config, RunOptions{Issues: &Issues{}}, sources, fakeDestinations{"": pool}); failed != 0 {
+		t.Fatalf("%d tables failed", failed)
+	}
+
+	if copied := pool.Copied("events_"); len(copied) != 3 {
+		t.Errorf("copied %d rows, want 3", len(copied))
+	}
+}
+
+func TestReplicateNamedSources(t *testing.T) {
+	lastSync := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	events := eventsTable()
+	events.SourceConn = "shop"
+	metrics := metricsTable()
+	metrics.SourceConn = "analytics"
+	metrics.Cursor.LastSync = lastSync
+
+	shop := newFakeSource(eventColumns, eventRows(3))
+	analytics := filteredSource([][]any{{uint32(1), lastSync.Add(time.Hour)}, {uint32(2), lastSync.Add(2 * time.Hour)}})
+	sources := fakeSources{"shop": shop, "analytics": analytics}
+
+	pool := newFakePool()
+	config := &Config{BatchSize: 10, Tables: []Table{events, metrics}}
+	if failed := Replicate(config, RunOptions{Issues: &Issues{}}, sources, fakeDestinations{"": pool}); failed != 0 {
+		t.Fatalf("%d tables failed", failed)
+	}
+
+	// Every table only reads from its own cluster
+	if queries := shop.Queries("metrics"); len(queries) != 0 {
+		t.Errorf("shop source queried for metrics: %v", queries)
+	}
+	if queries := analytics.Queries("events"); len(queries) != 0 {
+		t.Errorf("analytics source queried for events: %v", queries)
+	}
+
+	if copied := pool.Copied("events_"); len(copied) != 3 {
+		t.Errorf("copied %d events, want the 3 rows of the shop source", len(copied))
+	}
+	if copied := pool.Copied("metrics_"); len(copied) != 2 {
+		t.Errorf("copied %d metrics, want the 2 rows of the analytics source", len(copied))
+	}
+}
+
+func TestClickHouseConnsReuse(t *testing.T) {
+	sources := NewClickHouseConns(ClickHouseConfig{Host: "localhost:9000"}, map[string]string{
+		"analytics": "clickhouse://analytics:9000/default",
+	})
+	defer sources.Close()
+
+	first, err := sources.Get("analytics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := sources.Get("analytics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("named source connection opened twice")
+	}
+
+	primary, err := sources.Get("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if primary == first {
+		t.Error("primary source sharing the named connection")
+	}
+
+	if _, err := sources.Get("archive"); err == nil {
+		t.Error("unknown source connection opened")
+	}
+}
+
+func TestReplicateNamedDestinations(t *testing.T) {
+	events := eventsTable()
+	archived := eventsTable()
+	archived.Destination = "archived_events"
+	archived.DestinationConn = "archive"
+
+	primary, archive := newFakePool(), newFakePool()
+	sources := fakeSources{"": newFakeSource(eventColumns, eventRows(3))}
+	destinations := fakeDestinations{"": primary, "archive": archive}
+
+	config := &Config{BatchSize: 10, Tables: []Table{events, archived}}
+	if failed := Replicate(config, RunOptions{Issues: &Issues{}}, sources, destinations); failed != 0 {
+		t.Fatalf("%d tables failed", failed)
+	}
+
+	// Every table lands in its own database only
+	if copied := primary.Copied("events_"); len(copied) != 3 {
+		t.Errorf("copied %d events to the primary destination, want 3", len(copied))
+	}
+	if statements := primary.Statements("archived_events"); len(statements) != 0 {
+		t.Errorf("archived events written to the primary destination: %v", statements)
+	}
+	if copied := archive.Copied("archived_events_"); len(copied) != 3 {
+		t.Errorf("copied %d events to the archive destination, want 3", len(copied))
+	}
+	if statements := archive.Statements("INSERT INTO events "); len(statements) != 0 {
+		t.Errorf("events written to the archive destination: %v", statements)
+	}
+}
+
+// usersTable is upserted on its unique email rather than its primary key
+func usersTable() Table {
+	return Table{
+		Source:          "users",
+		Destination:     "users",
+		ConflictColumns: []string{"email"},
+		Indexes:         []Index{{Name: "email", Columns: []string{"email"}, Unique: true}},
+		Columns: []Column{
+			{Source: "id", Destination: "id", Type: "bigint", Primary: true},
+			{Source: "email", Destination: "email", Type: "text"},
+			{Source: "name", Destination: "name", Type: "text"},
+		},
+	}
+}
+
+func TestUniqueKeyConflictTarget(t *testing.T) {
+	table := usersTable()
+	if err := table.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	db := newFakeDB()
+	if err := MoveTemporaryTable(table, db, "users_tmp"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"SELECT DISTINCT ON (email) *", "ORDER BY email", "ON CONFLICT (email) DO UPDATE SET id = EXCLUDED.id"} {
+		if !strings.Contains(db.statements[0], want) {
+			t.Errorf("merge %q does not contain %q", db.statements[0], want)
+		}
+	}
+
+	table.ConflictColumns = []string{"login"}
+	if err := table.Validate(); err == nil {
+		t.Error("Validate accepted an unknown conflict column")
+	}
+}
+
+func TestGetConflictAction(t *testing.T) {
+	table := eventsTable()
+	if action := GetConflictAction(table); action != "DO UPDATE SET id = EXCLUDED.id, name = EXCLUDED.name" {
+		t.Errorf("update action %q", action)
+	}
+
+	// Unchanged rows are filtered out, so they are not rewritten
+	table.SkipUnchanged = true
+	if action, want := GetConflictAction(table), "DO UPDATE SET id = EXCLUDED.id, name = EXCLUDED.name WHERE (target.id, target.name) IS DISTINCT FROM (EXCLUDED.id, EXCLUDED.name)"; action != want {
+		t.Errorf("skip unchanged action %q, want %q", action, want)
+	}
+
+	// Destination-only columns are updated but not compared, their default changing on every merge
+	table.Columns = append(table.Columns, Column{Destination: "synced_at", Type: "timestamptz", Default: "now()"})
+	if action, want := GetConflictAction(table), "DO UPDATE SET id = EXCLUDED.id, name = EXCLUDED.name, synced_at = EXCLUDED.synced_at WHERE (target.id, target.name) IS DISTINCT FROM (EXCLUDED.id, EXCLUDED.name)"; action != want {
+		t.Errorf("destination-only action %q, want %q", action, want)
+	}
+
+	// json values have no equality operator and are compared as jsonb
+	table.Columns = []Column{
+		{Source: "id", Destination: "id", Type: "bigint", Primary: true},
+		{Source: "payload", Destination: "payload", Type: "json"},
+		{Source: "tags", Destination: "tags", Type: "JSON[]"},
+	}
+	if action, want := GetConflictAction(table), "DO UPDATE SET id = EXCLUDED.id, payload = EXCLUDED.payload, tags = EXCLUDED.tags WHERE (target.id, target.payload::jsonb, target.tags::jsonb[]) IS DISTINCT FROM (EXCLUDED.id, EXCLUDED.payload::jsonb, EXCLUDED.tags::jsonb[])"; action != want {
+		t.Errorf("json action %q, want %q", action, want)
+	}
+
+	table.ConflictAction = ConflictActionNothing
+	if action := GetConflictAction(table); action != "DO NOTHING" {
+		t.Errorf("nothing action %q", action)
+	}
+}
+
+func TestSingleMergeStatements(t *testing.T) {
+	for _, singleMerge := range []bool{false, true} {
+		table := eventsTable()
+		table.SingleMerge = singleMerge
+
+		pool := newFakePool()
+		if _, err := SynchronizeTable(Config{BatchSize: 2}, table, newFakeSource(eventColumns, eventRows(6)), pool); err != nil {
+			t.Fatal(err)
+		}
+
+		want := 3
+		if singleMerge {
+			want = 1
+		}
+		if merges := pool.Statements("INSERT INTO events AS target"); len(merges) != want {
+			t.Errorf("single_merge %v: %d merge statements, want %d", singleMerge, len(merges), want)
+		}
+		if copied := pool.Copied("events_"); len(copied) != 6 {
+			t.Errorf("single_merge %v: copied %d rows, want 6", singleMerge, len(copied))
+		}
+	}
+}
+
+func TestStagingRunNames(t *testing.T) {
+	config := Config{StagingRunNames: true, RunID: "1a2b3c4d"}
+
+	db := newFakeDB()
+	tableName, err := MakeTemporaryTable(config, eventsTable(), db, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "events_run1a2b3c4d_b3_tmp"; tableName != want {
+		t.Errorf("MakeTemporaryTable() = %s, want %s", tableName, want)
+	}
+	if name := StagingTableName(config, eventsTable(), "staging"); name != "events_run1a2b3c4d_staging" {
+		t.Errorf("StagingTableName() = %s, want events_run1a2b3c4d_staging", name)
+	}
+
+	config.RunID = "5e6f7a8b"
+	if name := StagingTableName(config, eventsTable(), "b3_tmp"); name == tableName {
+		t.Errorf("StagingTableName() = %s for another run", name)
+	}
+}
+
+func TestSyncResultCounts(t *testing.T) {
+	for _, count := range []int{1, 4, 7} {
+		before := time.Now()
+		result, err := SynchronizeTable(Config{BatchSize: 3}, eventsTable(), newFakeSource(eventColumns, eventRows(count)), newFakePool())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result.RowsRead != count || result.RowsInserted != count {
+			t.Errorf("%d rows: read %d and inserted %d", count, result.RowsRead, result.RowsInserted)
+		}
+		if result.Duration <= 0 || result.Duration > time.Since(before) {
+			t.Errorf("%d rows: duration = %v", count, result.Duration)
+		}
+		if result.NewCursor.Before(before) || result.NewCursor.After(before.Add(result.Duration)) {
+			t.Errorf("%d rows: new cursor %v is not the sync start", count, result.NewCursor)
+		}
+	}
+}
+
+func TestSynchronizeTableInsertedMismatch(t *testing.T) {
+	hook := test.NewLocal(log.StandardLogger())
+	defer hook.Reset()
+
+	pool := newFakePool()
+	pool.dropped = 1
+
+	result, err := SynchronizeTable(Config{BatchSize: 2}, eventsTable(), newFakeSource(eventColumns, eventRows(5)), pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RowsRead != 5 || result.RowsInserted != 2 {
+		t.Errorf("read %d and inserted %d rows, want 5 and 2", result.RowsRead, result.RowsInserted)
+	}
+
+	var warning *log.Entry
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Inserted row count does not match rows read" {
+			warning = entry
+		}
+	}
+	if warning == nil {
+		t.Fatal("mismatch not surfaced")
+	}
+	if warning.Data["read"] != 5 || warning.Data["inserted"] != 2 {
+		t.Errorf("warned with %v, want read 5 and inserted 2", warning.Data)
+	}
+}
+
+func TestSynchronizeTableVerifyBatches(t *testing.T) {
+	table := eventsTable()
+	table.VerifyBatches = true
+
+	// A copy silently missing rows fails its batch before the merge
+	pool := newFakePool()
+	pool.dropped = 1
+	_, err := SynchronizeTable(Config{BatchSize: 3}, table, newFakeSource(eventColumns, eventRows(3)), pool)
+	if err == nil || !strings.Contains(err.Error(), "copied 2 rows out of 3 read") {
+		t.Errorf("SynchronizeTable = %v, want the missing row reported", err)
+	}
+	if merges := pool.Statements("INSERT INTO events"); len(merges) != 0 {
+		t.Errorf("merged a batch missing rows: %q", merges)
+	}
+	if len(pool.Statements("ROLLBACK")) != 1 || len(pool.Statements("COMMIT")) != 0 {
+		t.Error("batch missing rows not rolled back")
+	}
+
+	// Complete copies are merged
+	pool = newFakePool()
+	if _, err := SynchronizeTable(Config{BatchSize: 3}, table, newFakeSource(eventColumns, eventRows(3)), pool); err != nil {
+		t.Fatal(err)
+	}
+	if len(pool.Statements("COMMIT")) != 1 {
+		t.Error("verified batch not committed")
+	}
+}
+
+func TestSynchronizeTableUUIDKey(t *testing.T) {
+	columns := []fakeColumn{
+		{name: "id", chType: "UUID", scan: reflect.TypeOf(uuid.UUID{})},
+		{name: "name", chType: "String", scan: reflect.TypeOf("")},
+	}
+	ids := []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}
+	rows := [][]any{}
+	for _, id := range ids {
+		rows = append(rows, []any{id, "product"})
+	}
+
+	table := Table{
+		Source:      "products",
+		Destination: "products",
+		Columns: []Column{
+			{Source: "id", Destination: "id", Primary: true},
+			{Source: "name", Destination: "name", Type: "text"},
+		},
+	}
+
+	pool := newFakePool()
+	if _, err := SynchronizeTable(Config{BatchSize: 2}, table, newFakeSource(columns, rows), pool); err != nil {
+		t.Fatal(err)
+	}
+
+	if create := pool.Statements("CREATE TABLE IF NOT EXISTS products"); len(create) != 1 || !strings.Contains(create[0], "id uuid") {
+		t.Errorf("created the table with %q, want an id uuid column", create)
+	}
+	for _, merge := range pool.Statements("INSERT INTO products AS target") {
+		if !strings.Contains(merge, "ON CONFLICT (id) DO UPDATE") {
+			t.Errorf("merged with %q, want a conflict on id", merge)
+		}
+	}
+
+	copied := pool.Copied("products_")
+	if len(copied) != len(ids) {
+		t.Fatalf("copied %d rows, want %d", len(copied), len(ids))
+	}
+	want := map[uuid.UUID]bool{}
+	for _, id := range ids {
+		want[id] = true
+	}
+	for _, row := range copied {
+		if id, ok := row[0].(**uuid.UUID); !ok || !want[**id] {
+			t.Errorf("copied id %#v, want one of the source uuid.UUID", row[0])
+		}
+	}
+}
+
+func TestReplicateSince(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	rows := [][]any{}
+	for i := 0; i < 6; i++ {
+		rows = append(rows, []any{uint32(i), start.Add(time.Duration(i) * time.Hour)})
+	}
+
+	table := metricsTable()
+	table.Cursor.LastSync = start.Add(4 * time.Hour)
+	config := &Config{BatchSize: 10, Tables: []Table{table}}
+	since := start.Add(-time.Hour)
+
+	// A failing run leaves the saved cursor alone rather than moving it back to -since
+	pool := newFakePool()
+	pool.failures["metrics"] = errors.New("connection lost")
+	sources := fakeSources{"": filteredSource(rows)}
+	if failed := Replicate(config, RunOptions{Since: since, Issues: &Issues{}}, sources, fakeDestinations{"": pool}); failed != 1 {
+		t.Fatalf("%d tables failed, want the metrics table", failed)
+	}
+	if lastSync := config.Tables[0].Cursor.LastSync; !lastSync.Equal(table.Cursor.LastSync) {
+		t.Errorf("failed run saved the cursor at %v, want %v kept", lastSync, table.Cursor.LastSync)
+	}
+
+	pool = newFakePool()
+	source := filteredSource(rows)
+	if failed := Replicate(config, RunOptions{Since: since, Issues: &Issues{}}, fakeSources{"": source}, fakeDestinations{"": pool}); failed != 0 {
+		t.Fatalf("%d tables failed", failed)
+	}
+
+	bound := false
+	for _, args := range source.args {
+		for _, arg := range args {
+			if named, ok := arg.(driver.NamedDateValue); ok && named.Name == "lastSync" {
+				bound = true
+				if !named.Value.Equal(since) {
+					t.Errorf("lastSync bound to %v, want -since %v", named.Value, since)
+				}
+			}
+		}
+	}
+	if !bound {
+		t.Error("no query bound lastSync")
+	}
+
+	if copied := len(pool.Copied("metrics_")); copied != len(rows) {
+		t.Errorf("copied %d rows, want the %d rows after -since", copied, len(rows))
+	}
+	if lastSync := config.Tables[0].Cursor.LastSync; !lastSync.After(table.Cursor.LastSync) {
+		t.Errorf("cursor saved at %v, want it past the previous %v", lastSync, table.Cursor.LastSync)
+	}
+}
+
+func TestReplicateUntil(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	rows := [][]any{}
+	for i := 0; i < 6; i++ {
+		rows = append(rows, []any{uint32(i), start.Add(time.Duration(i) * time.Hour)})
+	}
+
+	table := metricsTable()
+	table.Cursor.LastSync = start.Add(-time.Hour)
+	config := &Config{BatchSize: 10, Tables: []Table{table}}
+	until := start.Add(2 * time.Hour)
+
+	pool := newFakePool()
+	if failed := Replicate(config, RunOptions{Until: until, Issues: &Issues{}}, fakeSources{"": filteredSource(rows)}, fakeDestinations{"": pool}); failed != 0 {
+		t.Fatalf("%d tables failed", failed)
+	}
+	if copied := len(pool.Copied("metrics_")); copied != 3 {
+		t.Errorf("copied %d rows, want the 3 rows up to -until", copied)
+	}
+	if lastSync := config.Tables[0].Cursor.LastSync; !lastSync.Equal(until) {
+		t.Errorf("cursor saved at %v, want -until %v", lastSync, until)
+	}
+
+	// The cursor now sits on the bound, so the same run again has nothing left to read
+	hook := test.NewLocal(log.StandardLogger())
+	defer hook.Reset()
+
+	pool = newFakePool()
+	source := filteredSource(rows)
+	if failed := Replicate(config, RunOptions{Until: until, Issues: &Issues{}}, fakeSources{"": source}, fakeDestinations{"": pool}); failed != 0 {
+		t.Fatalf("%d tables failed", failed)
+	}
+	if len(source.queries) != 0 || len(pool.Statements("")) != 0 {
+		t.Errorf("skipped table ran %d queries and %d statements, want none", len(source.queries), len(pool.Statements("")))
+	}
+	if lastSync := config.Tables[0].Cursor.LastSync; !lastSync.Equal(until) {
+		t.Errorf("skipped table saved the cursor at %v, want %v kept", lastSync, until)
+	}
+
+	warned := false
+	for _, entry := range hook.AllEntries() {
+		warned = warned || entry.Message == "Cursor already past -until, skipping table"
+	}
+	if !warned {
+		t.Error("no warning logged for the skipped table")
+	}
+}
+
+func TestReplicateVerifiesUpToNewCursor(t *testing.T) {
+	synced := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	table := metricsTable()
+	table.Verify = true
+	table.Cursor.LastSync = synced.Add(-time.Hour)
+	config := &Config{BatchSize: 10, Tables: []Table{table}}
+
+	// A row inserted once the sync started is left to the next run on both sides
+	source := filteredSource([][]any{{uint32(1), synced}, {uint32(2), time.Now().Add(time.Hour)}})
+	answer := source.answer
+	source.answer = func(query string, args []any) (*fakeRows, error) {
+		if strings.HasPrefix(query, "SELECT max(created_at)") {
+			return &fakeRows{rows: [][]any{{synced}}}, nil
+		}
+		return answer(query, args)
+	}
+
+	pool := newFakePool()
+	pool.rows["SELECT COUNT(*)"] = [][]any{{int64(1)}}
+	pool.rows["SELECT COALESCE(max(created_at)"] = [][]any{{synced}}
+	if failed := Replicate(config, RunOptions{Issues: &Issues{}}, fakeSources{"": source}, fakeDestinations{"": pool}); failed != 0 {
+		t.Fatalf("%d tables failed, want the verification bounded by the new cursor", failed)
+	}
+
+	counts := pool.Args("SELECT COUNT(*)")
+	if len(counts) != 1 || len(counts[0]) != 1 || !counts[0][0].(time.Time).Equal(config.Tables[0].Cursor.LastSync) {
+		t.Errorf("destination counted up to %v, want the saved cursor %v", counts, config.Tables[0].Cursor.LastSync)
+	}
+}
+
+func TestReplicateMaxWindow(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	rows := [][]any{}
+	for i := 0; i < 6; i++ {
+		rows = append(rows, []any{uint32(i), start.Add(time.Duration(i) * time.Hour)})
+	}
+
+	table := metricsTable()
+	table.Cursor.MaxWindow = 3 * time.Hour
+	config := &Config{BatchSize: 10, Tables: []Table{table}}
+
+	// Two runs together cover the whole range, each stopping at its window edge
+	copied := 0
+	for run, want := range []time.Time{start.Add(3 * time.Hour), start.Add(6 * time.Hour)} {
+		pool := newFakePool()
+		sources := fakeSources{"": filteredSource(rows)}
+		if failed := Replicate(config, RunOptions{Issues: &Issues{}}, sources, fakeDestinations{"": pool}); failed != 0 {
+			t.Fatalf("run %d: %d tables failed", run, failed)
+		}
+
+		if lastSync := config.Tables[0].Cursor.LastSync; !lastSync.Equal(want) {
+			t.Errorf("run %d: cursor saved at %v, want the window edge %v", run, lastSync, want)
+		}
+		copied += len(pool.Copied("metrics_"))
+	}
+
+	if copied != len(rows) {
+		t.Errorf("copied %d rows over two runs, want %d", copied, len(rows))
+	}
+}
+
+func TestReplicateEmptySource(t *testing.T) {
+	hook := test.NewLocal(log.StandardLogger())
+	defer hook.Reset()
+
+	lastSync := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	table := metricsTable()
+	table.Cursor.LastSync = lastSync
+	config := &Config{BatchSize: 10, Tables: []Table{table}}
+
+	pool := newFakePool()
+	sources := fakeSources{"": newFakeSource(metricColumns, nil)}
+	if failed := Replicate(config, RunOptions{Issues: &Issues{}}, sources, fakeDestinations{"": pool}); failed != 0 {
+		t.Fatalf("%d tables failed", failed)
+	}
+
+	if cursor := config.Tables[0].Cursor.LastSync; !cursor.Equal(lastSync) {
+		t.Errorf("cursor moved to %v, want it left at %v", cursor, lastSync)
+	}
+	if copies := pool.Statements("COPY"); len(copies) != 0 {
+		t.Errorf("copied into %v from an empty source", copies)
+	}
+
+	logged := false
+	for _, entry := range hook.AllEntries() {
+		logged = logged || entry.Message == "No rows to synchronize"
+		if entry.Message == "Data inserted" {
+			t.Error("logged data inserted from an empty source")
+		}
+	}
+	if !logged {
+		t.Error("empty source not logged")
+	}
+}
+
+func TestSynchronizeTableAppend(t *testing.T) {
+	table := eventsTable()
+	table.Mode = ModeAppend
+	table.Columns[0].Primary = false
+
+	// Rows sharing an id are appended rather than merged
+	rows := [][]any{{uint32(1), "created"}, {uint32(1), "updated"}, {uint32(2), "created"}}
+
+	pool := newFakePool()
+	result, err := SynchronizeTable(Config{BatchSize: 10}, table, newFakeSource(eventColumns, rows), pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RowsInserted != 3 {
+		t.Errorf("inserted %d rows, want 3", result.RowsInserted)
+	}
+
+	inserts := pool.Statements("INSERT INTO events")
+	if len(inserts) != 1 {
+		t.Fatalf("inserted with %q, want one statement", inserts)
+	}
+	for _, clause := range []string{"ON CONFLICT", "DISTINCT ON", "AS target"} {
+		if strings.Contains(inserts[0], clause) {
+			t.Errorf("appended with %q, containing %s", inserts[0], clause)
+		}
+	}
+	if keys := pool.Statements("PRIMARY KEY"); len(keys) != 0 {
+		t.Errorf("created the table with %q, want no primary key", keys)
+	}
+}
+
+func TestSynchronizeTableAppendBoundsCursor(t *testing.T) {
+	table := metricsTable()
+	table.Mode = ModeAppend
+	table.Columns[0].Primary = false
+	table.Cursor.LastSync = time.Now().Add(-time.Hour)
+
+	// The row stamped after the run start is left to the next run, which reads from the saved cursor
+	rows := [][]any{{uint32(1), time.Now().Add(-time.Minute)}, {uint32(2), time.Now().Add(time.Hour)}}
+	source := filteredSource(rows)
+	pool := newFakePool()
+	result, err := SynchronizeTable(Config{BatchSize: 10}, table, source, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if copied := pool.Copied("metrics_"); len(copied) != 1 {
+		t.Errorf("appended %d rows, want the row before the run start only", len(copied))
+	}
+	for _, args := range source.args {
+		for _, arg := range args {
+			if bound, ok := arg.(driver.NamedDateValue); ok && bound.Name == "until" && !bound.Value.Equal(result.NewCursor) {
+				t.Errorf("read until %v, want the saved cursor %v", bound.Value, result.NewCursor)
+			}
+		}
+	}
+	if len(source.Queries("created_at <= @until")) == 0 {
+		t.Errorf("read %q, want the rows bounded by the saved cursor", source.Queries("SELECT"))
+	}
+
+	table.Cursor.Lookback = time.Hour
+	if err := table.Validate(); err == nil {
+		t.Error("Validate accepted a lookback on an append-only table")
+	}
+}
+
+func TestExcludeFromUpdate(t *testing.T) {
+	table := eventsTable()
+	table.Columns = append(table.Columns, Column{Source: "edited_at", Destination: "edited_at", Type: "timestamptz"})
+	table.ExcludeFromUpdate = []string{"edited_at"}
+
+	db := newFakeDB()
+	if err := MoveTemporaryTable(table, db, "events_tmp"); err != nil {
+		t.Fatal(err)
+	}
+
+	// New rows are inserted with every column, while conflicting ones keep their edited_at
+	want := "ON CONFLICT (id) DO UPDATE SET id = EXCLUDED.id, name = EXCLUDED.name;"
+	if !strings.Contains(db.statements[0], want) || strings.Contains(db.statements[0], "EXCLUDED.edited_at") {
+		t.Errorf("merged with %q, want %q", db.statements[0], want)
+	}
+
+	table.ExcludeFromUpdate = []string{"id", "name", "edited_at"}
+	if action := GetConflictAction(table); action != "DO NOTHING" {
+		t.Errorf("action %q with every column excluded, want DO NOTHING", action)
+	}
+}
+
+func TestSynchronizeTableErrorContext(t *testing.T) {
+	refused := errors.New("permission denied")
+	pool := newFakePool()
+	pool.failures["COPY events_run1_b1_tmp"] = refused
+
+	config := Config{BatchSize: 2, Workers: 1, StagingRunNames: true, RunID: "1"}
+	_, err := SynchronizeTable(config, eventsTable(), newFakeSource(eventColumns, eventRows(6)), pool)
+	if !errors.Is(err, refused) {
+		t.Fatalf("SynchronizeTable() = %v, want the copy error", err)
+	}
+	if want := "table events: batch 1 at offset 2: "; !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("SynchronizeTable() = %q, want it prefixed by %q", err, want)
+	}
+
+	// Read failures carry the offset of the page
+	source := newFakeSource(eventColumns, eventRows(6))
+	answer := source.answer
+	source.answer = func(query string, args []any) (*fakeRows, error) {
+		if strings.HasSuffix(query, "OFFSET 4") {
+			return nil, refused
+		}
+		return answer(query, args)
+	}
+
+	_, err = SynchronizeTable(config, eventsTable(), source, newFakePool())
+	if !errors.Is(err, refused) || !strings.Contains(err.Error(), "table events") || !strings.Contains(err.Error(), "select at offset 4") {
+		t.Errorf("SynchronizeTable() = %v, want the table and the read offset", err)
+	}
+}
+
+func TestReplicateFailFast(t *testing.T) {
+	archived := eventsTable()
+	archived.Destination = "archived_events"
+	archived.SourceConn = "archive"
+
+	for _, failFast := range []bool{false, true} {
+		pool := newFakePool()
+		config := &Config{BatchSize: 10, Tables: []Table{archived, eventsTable()}}
+		sources := fakeSources{"": newFakeSource(eventColumns, eventRows(3))}
+
+		failed := Replicate(config, RunOptions{Issues: &Issues{}, FailFast: failFast}, sources, fakeDestinations{"": pool})
+		if failed != 1 {
+			t.Errorf("fail fast %v: %d tables failed, want 1", failFast, failed)
+		}
+
+		// Continuing synchronizes the table after the failed one
+		want := 3
+		if failFast {
+			want = 0
+		}
+		if copied := pool.Copied("events_"); len(copied) != want {
+			t.Errorf("fail fast %v: copied %d rows, want %d", failFast, len(copied), want)
+		}
+	}
+}
+
+func TestReplicateFailureCount(t *testing.T) {
+	lastSync := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	table := func(destination string) Table {
+		table := metricsTable()
+		table.Destination = destination
+		table.Cursor.LastSync = lastSync
+		return table
+	}
+
+	missing := table("archived_metrics")
+	missing.SourceConn = "archive"
+	config := &Config{BatchSize: 10, Tables: []Table{table("broken_metrics"), missing, table("metrics")}}
+
+	pool := newFakePool()
+	pool.failures["INSERT INTO broken_metrics"] = errors.New("deadlock detected")
+	sources := fakeSources{"": filteredSource([][]any{{uint32(1), lastSync.Add(time.Hour)}})}
+
+	// Every table is attempted, the count of failures setting the exit status
+	if failed := Replicate(config, RunOptions{Issues: &Issues{}}, sources, fakeDestinations{"": pool}); failed != 2 {
+		t.Errorf("%d tables failed, want 2", failed)
+	}
+
+	for _, table := range config.Tables {
+		moved := !table.Cursor.LastSync.Equal(lastSync)
+		if moved != (table.Destination == "metrics") {
+			t.Errorf("table %s cursor at %v", table.Destination, table.Cursor.LastSync)
+		}
+	}
+
+	if failed := Replicate(&Config{BatchSize: 10, Tables: []Table{table("metrics")}}, RunOptions{Issues: &Issues{}}, sources, fakeDestinations{"": newFakePool()}); failed != 0 {
+		t.Errorf("%d tables failed, want 0", failed)
+	}
+}
+
+// unconfiguredDestinations connect to their pools but have no settings for them
+type unconfiguredDestinations struct {
+	fakeDestinations
+}
+
+func (d unconfiguredDestinations) Config(name string) (PostgresConfig, error) {
+	return PostgresConfig{}, fmt.Errorf("unknown destination connection %s", name)
+}
+
+func TestReplicateUnknownDestinationConfig(t *testing.T) {
+	lastSync := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	table := metricsTable()
+	table.Cursor.LastSync = lastSync
+	config := &Config{BatchSize: 10, Tables: []Table{table}}
+
+	// The table fails rather than running with zero settings
+	pool := newFakePool()
+	sources := fakeSources{"": filteredSource([][]any{{uint32(1), lastSync.Add(time.Hour)}})}
+	if failed := Replicate(config, RunOptions{Issues: &Issues{}}, sources, unconfiguredDestinations{fakeDestinations{"": pool}}); failed != 1 {
+		t.Errorf("%d tables failed, want 1", failed)
+	}
+
+	if statements := pool.Statements(""); len(statements) != 0 {
+		t.Errorf("ran %q, want nothing", statements)
+	}
+	if !config.Tables[0].Cursor.LastSync.Equal(lastSync) {
+		t.Errorf("cursor moved to %v", config.Tables[0].Cursor.LastSync)
+	}
+}
+
+func TestSynchronizeTableCopyChunks(t *testing.T) {
+	pool := newFakePool()
+	result, err := SynchronizeTable(Config{BatchSize: 5, CopyChunkSize: 2}, eventsTable(), newFakeSource(eventColumns, eventRows(5)), pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The single batch is written in chunks of 2, 2 and 1 rows, each in its own transaction
+	if copies := pool.Statements("COPY events_"); len(copies) != 3 {
+		t.Errorf("copied %d chunks, want 3", len(copies))
+	}
+	if commits := pool.Statements("COMMIT"); len(commits) != 3 {
+		t.Errorf("committed %d transactions, want 3", len(commits))
+	}
+	if merges := pool.Statements("INSERT INTO events AS target"); len(merges) != 3 {
+		t.Errorf("merged %d chunks, want 3", len(merges))
+	}
+	if truncates := pool.Statements("TRUNCATE events_"); len(truncates) != 2 {
+		t.Errorf("cleared %d chunks, want the 2 before the last", len(truncates))
+	}
+
+	if copied := pool.Copied("events_"); len(copied) != 5 || result.RowsInserted != 5 {
+		t.Errorf("copied %d and inserted %d rows, want 5", len(copied), result.RowsInserted)
+	}
+}
+
+// BenchmarkCopyFormat compares encoding a numeric-heavy batch in the text and binary COPY formats,
+// the binary one being the format pgx copies in
+func BenchmarkCopyFormat(b *testing.B) {
+	types := pgtype.NewMap()
+	oids := []uint32{pgtype.Int8OID, pgtype.Float8OID, pgtype.Float8OID, pgtype.TimestamptzOID, pgtype.NumericOID, pgtype.TextOID}
+
+	rows := make([][]any, 1000)
+	created := time.Date(2024, 3, 1, 12, 30, 15, 123_000_000, time.UTC)
+	for i := range rows {
+		price := pgtype.Numeric{Int: big.NewInt(int64(i) * 12345), Exp: -2, Valid: true}
+		rows[i] = []any{int64(i), float64(i) / 3, float64(i) * 1.5, created.Add(time.Duration(i) * time.Second), price, "sneaker"}
+	}
+
+	for name, format := range map[string]int16{"text": pgtype.TextFormatCode, "binary": pgtype.BinaryFormatCode} {
+		b.Run(name, func(b *testing.B) {
+			buf := []byte{}
+			for i := 0; i < b.N; i++ {
+				buf = buf[:0]
+				for _, row := range rows {
+					for j, value := range row {
+						var err error
+						if buf, err = types.Encode(oids[j], format, value, buf); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+			}
+			b.SetBytes(int64(len(buf)))
+			b.ReportMetric(float64(b.N*len(rows))/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
+
+func TestMoveTemporaryTableKeyOrder(t *testing.T) {
+	table := usersTable()
+	table.ConflictColumns = []string{"tenant", "email"}
+
+	db := newFakeDB()
+	if err := MoveTemporaryTable(table, db, "users_tmp"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent merges lock the rows in the same key order, so overlapping batches wait instead of deadlocking
+	want := "SELECT DISTINCT ON (tenant, email) * FROM users_tmp\n\t\tORDER BY tenant, email\n\t\tON CONFLICT (tenant, email)"
+	if !strings.Contains(db.statements[0], want) {
+		t.Errorf("merged with %q, want %q", db.statements[0], want)
+	}
+}
+
+func TestSynchronizeTableSourceQuery(t *testing.T) {
+	table := eventsTable()
+	table.Source = ""
+	table.SourceQuery = "SELECT e.id AS id, u.name AS name FROM events AS e FINAL JOIN users AS u ON u.id = e.user_id"
+	if err := table.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	source := newFakeSource(eventColumns, eventRows(3))
+	pool := newFakePool()
+	if _, err := SynchronizeTable(Config{BatchSize: 2}, table, source, pool); err != nil {
+		t.Fatal(err)
+	}
+
+	// The query is read as a subquery ordered by the primary key, without FINAL on its result
+	pages := source.Queries("LIMIT 2 OFFSET")
+	want := "SELECT id, name FROM (" + table.SourceQuery + ") AS src ORDER BY id LIMIT 2 OFFSET 0"
+	if len(pages) != 2 || pages[0] != want {
+		t.Errorf("read pages %q, want %q", pages, want)
+	}
+	if copied := pool.Copied("events_"); len(copied) != 3 {
+		t.Errorf("copied %d rows, want 3", len(copied))
+	}
+
+	table.Columns[0].Primary = false
+	if err := table.Validate(); err == nil || !strings.Contains(err.Error(), "source_query requires a primary column or order_by") {
+		t.Errorf("Validate() = %v without a key to order by", err)
+	}
+}
+
+func TestSynchronizeTableWide(t *testing.T) {
+	hook := test.NewLocal(log.StandardLogger())
+	defer hook.Reset()
+
+	columns := []fakeColumn{}
+	table := Table{Source: "wide", Destination: "wide"}
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("c%d", i)
+		columns = append(columns, fakeColumn{name: name, chType: "UInt32", scan: reflect.TypeOf(uint32(0))})
+		table.Columns = append(table.Columns, Column{Source: name, Destination: name, Type: "bigint", Primary: i == 0})
+	}
+
+	rows := [][]any{}
+	for i := 0; i < 250; i++ {
+		row := make([]any, len(columns))
+		for j := range row {
+			row[j] = uint32(i*len(columns) + j)
+		}
+		rows = append(rows, row)
+	}
+
+	pool := newFakePool()
+	if _, err := SynchronizeTable(Config{BatchSize: 250}, table, newFakeSource(columns, rows), pool); err != nil {
+		t.Fatal(err)
+	}
+	if copied := pool.Copied("wide_"); len(copied) != 250 || len(copied[0]) != 300 {
+		t.Errorf("copied %d rows, want 250 rows of 300 columns", len(copied))
+	}
+
+	// Inserts are split to stay under the parameter limit of Postgres
+	pool = newFakePool()
+	if _, err := SynchronizeTable(Config{BatchSize: 250, InsertMethod: InsertMethodInsert}, table, newFakeSource(columns, rows), pool); err != nil {
+		t.Fatal(err)
+	}
+	inserts := pool.Args(`INSERT INTO "wide_`)
+	if len(inserts) != 2 {
+		t.Errorf("inserted with %d statements, want 2", len(inserts))
+	}
+	for _, args := range inserts {
+		if len(args) > maxParameters {
+			t.Errorf("inserted with %d parameters", len(args))
+		}
+	}
+
+	warned := false
+	for _, entry := range hook.AllEntries() {
+		warned = warned || strings.HasPrefix(entry.Message, "Wide table")
+	}
+	if !warned {
+		t.Error("wide table not warned about")
+	}
+}
+
+func TestSynchronizeTablePanickingBatch(t *testing.T) {
+	pool := newFakePool()
+	pool.panics["COPY events_run1_b1_tmp"] = "reflect: call of reflect.Value.Elem on zero Value"
+
+	config := Config{BatchSize: 2, StagingRunNames: true, RunID: "1"}
+	_, err := SynchronizeTable(config, eventsTable(), newFakeSource(eventColumns, eventRows(6)), pool)
+	if err == nil || !strings.Contains(err.Error(), "batch 1 at offset 2: panic: reflect") {
+		t.Fatalf("SynchronizeTable() = %v, want the panic as a batch error", err)
+	}
+
+	// The other batches were written, and the panicking one released its connection
+	if merges := pool.Statements("INSERT INTO events AS target"); len(merges) != 2 {
+		t.Errorf("merged %d batches, want the 2 others", len(merges))
+	}
+	if acquired := pool.Acquired(); acquired != 0 {
+		t.Errorf("%d connections not released", acquired)
+	}
+}
+
+func TestSynchronizeTableBackpressure(t *testing.T) {
+	pool := newFakePool()
+	pool.maxConns = 8
+	pool.delay = 5 * time.Millisecond
+
+	source := newFakeSource(eventColumns, eventRows(20))
+	if _, err := SynchronizeTable(Config{BatchSize: 2, Workers: 3}, eventsTable(), source, pool); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each batch in flight holds a connection, so the peak is the batches written at once
+	if peak := pool.Peak(); peak > 3 {
+		t.Errorf("%d batches in flight, want at most the 3 workers", peak)
+	}
+	if peak := pool.Peak(); peak < 2 {
+		t.Errorf("%d batches in flight, want batches written concurrently", peak)
+	}
+	if copied := pool.Copied("events_"); len(copied) != 20 {
+		t.Errorf("copied %d rows, want 20", len(copied))
+	}
+}
+
+// BenchmarkPrefetch reads a bursty source, every fourth page being slow, into a single worker,
+// buffered batches keeping the worker busy while the slow pages are read
+func BenchmarkPrefetch(b *testing.B) {
+	rows := eventRows(64)
+
+	for _, prefetch := range []int{0, 2, 8} {
+		b.Run(fmt.Sprintf("prefetch=%d", prefetch), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				source := newFakeSource(eventColumns, rows)
+				answer := source.answer
+				pages := 0
+				source.answer = func(query string, args []any) (*fakeRows, error) {
+					if strings.Contains(query, " LIMIT ") {
+						pages++
+						delay := time.Millisecond
+						if pages%4 == 0 {
+							delay = 6 * time.Millisecond
+						}
+						time.Sleep(delay)
+					}
+					return answer(query, args)
+				}
+
+				pool := newFakePool()
+				pool.delay = 2 * time.Millisecond
+
+				config := Config{BatchSize: 2, Workers: 1, Prefetch: prefetch}
+				if _, err := SynchronizeTable(config, eventsTable(), source, pool); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.N*len(rows))/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
+
+func TestReplicateSchemaOnly(t *testing.T) {
+	table := usersTable()
+	config := &Config{BatchSize: 10, Tables: []Table{table}}
+	source := newFakeSource([]fakeColumn{
+		{name: "id", chType: "UInt32", scan: reflect.TypeOf(uint32(0))},
+		{name: "email", chType: "String", scan: reflect.TypeOf("")},
+		{name: "name", chType: "String", scan: reflect.TypeOf("")},
+	}, [][]any{{uint32(1), "a@example.com", "A"}})
+
+	pool := newFakePool()
+	if failed := Replicate(config, RunOptions{Issues: &Issues{}, SchemaOnly: true}, fakeSources{"": source}, fakeDestinations{"": pool}); failed != 0 {
+		t.Fatalf("%d tables failed", failed)
+	}
+
+	if create := pool.Statements("CREATE TABLE IF NOT EXISTS users"); len(create) != 1 {
+		t.Errorf("created %q, want the users table", create)
+	}
+	if keys := pool.Statements("ALTER TABLE users ADD PRIMARY KEY (id)"); len(keys) != 1 {
+		t.Error("primary key not added")
+	}
+	if indexes := pool.Statements("CREATE UNIQUE INDEX IF NOT EXISTS users_email"); len(indexes) != 1 {
+		t.Errorf("created indexes %q, want users_email", pool.Statements("INDEX"))
+	}
+
+	if pages := source.Queries("LIMIT"); len(pages) != 0 {
+		t.Errorf("read %q in schema-only mode", pages)
+	}
+	if copies := pool.Statements("COPY"); len(copies) != 0 {
+		t.Errorf("copied %q in schema-only mode", copies)
+	}
+}
+
+func TestReplicateExistingPrimaryKey(t *testing.T) {
+	hooks := log.StandardLogger().ReplaceHooks(log.LevelHooks{})
+	defer log.StandardLogger().ReplaceHooks(hooks)
+
+	issues := &Issues{}
+	log.AddHook(issues)
+
+	source := newFakeSource([]fakeColumn{
+		{name: "id", chType: "UInt32", scan: reflect.TypeOf(uint32(0))},
+		{name: "email", chType: "String", scan: reflect.TypeOf("")},
+		{name: "name", chType: "String", scan: reflect.TypeOf("")},
+	}, nil)
+
+	// The table of a previous run keeps its key, without a warning on every run
+	pool := newFakePool()
+	pool.rows["pg_constraint"] = [][]any{{"users_pkey"}}
+	config := &Config{BatchSize: 10, Tables: []Table{usersTable()}}
+	if failed := Replicate(config, RunOptions{Issues: issues, SchemaOnly: true}, fakeSources{"": source}, fakeDestinations{"": pool}); failed != 0 {
+		t.Fatalf("%d tables failed", failed)
+	}
+
+	if keys := pool.Statements("ADD PRIMARY KEY"); len(keys) != 0 {
+		t.Errorf("added the existing primary key again with %q", keys)
+	}
+	if summary := issues.Summary(); summary != "no errors or warnings" {
+		t.Errorf("summary %q, want no issues", summary)
+	}
+}
+
+// closedAddress returns a local address nothing listens on
+func closedAddress(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	return listener.Addr().String()
+}
+
+func TestPreflight(t *testing.T) {
+	address := closedAddress(t)
+	addr := net.TCPAddrFromAddrPort(netip.MustParseAddrPort(address))
+	sources := NewClickHouseConns(ClickHouseConfig{Host: address}, nil)
+	defer sources.Close()
+	pools := NewPostgresPools(PostgresConfig{Host: addr.IP.String(), Port: addr.Port, Database: "replication", SSLMode: "disable"}, nil)
+	defer pools.Close()
+
+	// Startup aborts before any table is created when a database is down
+	tables := []Table{eventsTable()}
+	err := Preflight(tables, "", sources, pools)
+	if err == nil || !strings.Contains(err.Error(), "ClickHouse is unreachable") {
+		t.Errorf("preflight returned %v, want ClickHouse unreachable", err)
+	}
+
+	// Tables not selected are not connected to
+	if err := Preflight(tables, "users", NewClickHouseConns(ClickHouseConfig{Host: address}, nil), NewPostgresPools(PostgresConfig{}, nil)); err != nil {
+		t.Errorf("preflight of no table returned %v", err)
+	}
+}
+
+func TestWriteRowsInsert(t *testing.T) {
+	rows := [][]any{{1, "a"}, {2, "b"}, {3, "c"}}
+
+	db := newFakeDB()
+	if _, err := WriteRows(Config{InsertMethod: InsertMethodInsert}, db, "staging.events_tmp", []string{"id", "name"}, rows); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rows are written with a multi-row INSERT rather than COPY
+	want := `INSERT INTO "staging"."events_tmp" ("id", "name") VALUES ($1, $2), ($3, $4), ($5, $6)`
+	if inserts := db.Statements("INSERT INTO"); !slices.Equal(inserts, []string{want}) {
+		t.Errorf("inserted with %q, want %q", inserts, want)
+	}
+	if args := db.Args("INSERT INTO"); !reflect.DeepEqual(args, [][]any{{1, "a", 2, "b", 3, "c"}}) {
+		t.Errorf("inserted %v, want the rows in order", args)
+	}
+	if copied := db.Copied(""); len(copied) != 0 {
+		t.Errorf("copied %d rows with the insert method", len(copied))
+	}
+
+	db = newFakeDB()
+	if _, err := WriteRows(Config{}, db, "events_tmp", []string{"id", "name"}, rows); err != nil {
+		t.Fatal(err)
+	}
+	if copied := db.Copied("events_tmp"); len(copied) != 3 || len(db.Statements("INSERT INTO")) != 0 {
+		t.Errorf("copied %d rows with the default method, want 3", len(copied))
+	}
+}
+
+func TestSynchronizeTableCreateIndexes(t *testing.T) {
+	tests := []struct {
+		createIndexes string
+		// when is the index created relative to the batch transactions
+		when string
+	}{
+		{"", "before"},
+		{CreateIndexesBeforeLoad, "before"},
+		{CreateIndexesAfterLoad, "after"},
+		{CreateIndexesNever, "never"},
+	}
+
+	for _, test := range tests {
+		table := eventsTable()
+		table.CreateIndexes = test.createIndexes
+		table.Indexes = []Index{{Name: "name", Columns: []string{"name"}}}
+		if err := table.Validate(); err != nil {
+			t.Fatal(err)
+		}
+
+		pool := newFakePool()
+		if _, err := SynchronizeTable(Config{BatchSize: 2}, table, newFakeSource(eventColumns, eventRows(3)), pool); err != nil {
+			t.Fatal(err)
+		}
+
+		index, begin, commit := -1, -1, -1
+		for i, statement := range pool.Statements("") {
+			switch {
+			case statement == "BEGIN" && begin < 0:
+				begin = i
+			case statement == "COMMIT":
+				commit = i
+			case statement == "CREATE INDEX IF NOT EXISTS events_name ON events (name)":
+				index = i
+			}
+		}
+
+		when := "during"
+		switch {
+		case index < 0:
+			when = "never"
+		case index < begin:
+			when = "before"
+		case index > commit:
+			when = "after"
+		}
+		if when != test.when {
+			t.Errorf("create_indexes %q: index created %s the load, want %s", test.createIndexes, when, test.when)
+		}
+	}
+}
+
+// loadPhases returns the phase of the load each statement containing a substring ran in:
+// before the first batch transaction, during the batches or after the last one
+func loadPhases(pool *fakePool, substring string) []string {
+	statements := pool.Statements("")
+	begin, commit := slices.Index(statements, "BEGIN"), -1
+	for i, statement := range statements {
+		if statement == "COMMIT" {
+			commit = i
+		}
+	}
+
+	phases := []string{}
+	for i, statement := range statements {
+		if !strings.Contains(statement, substring) {
+			continue
+		}
+		switch {
+		case i < begin:
+			phases = append(phases, "before")
+		case i > commit:
+			phases = append(phases, "after")
+		default:
+			phases = append(phases, "during")
+		}
+	}
+	return phases
+}
+
+func TestSynchronizeTableRebuildIndexes(t *testing.T) {
+	table := eventsTable()
+	table.Cursor = Cursor{Column: "updated_at"}
+	table.RebuildIndexes = true
+	table.Indexes = []Index{{Name: "name", Columns: []string{"name"}}}
+	if err := table.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A full load drops the index created with the table and builds it once every batch is merged
+	pool := newFakePool()
+	if _, err := SynchronizeTable(Config{BatchSize: 2}, table, newFakeSource(eventColumns, eventRows(3)), pool); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"CREATE INDEX IF NOT EXISTS events_name ON events (name)",
+		"DROP INDEX IF EXISTS events_name",
+		"CREATE INDEX IF NOT EXISTS events_name ON events (name)",
+	}
+	if statements := pool.Statements("events_name"); !slices.Equal(statements, want) {
+		t.Errorf("full load ran %q, want %q", statements, want)
+	}
+	if phases := loadPhases(pool, "events_name"); !slices.Equal(phases, []string{"before", "before", "after"}) {
+		t.Errorf("full load changed the index %v, want it absent during the load", phases)
+	}
+
+	// Incremental syncs keep the index
+	table.Cursor.LastSync = time.Now().Add(-time.Hour)
+	pool = newFakePool()
+	if _, err := SynchronizeTable(Config{BatchSize: 2}, table, newFakeSource(eventColumns, eventRows(3)), pool); err != nil {
+		t.Fatal(err)
+	}
+	if dropped := pool.Statements("DROP INDEX"); len(dropped) != 0 {
+		t.Errorf("incremental sync dropped %q", dropped)
+	}
+}
+
+func TestSynchronizeTableRebuildPrimaryKey(t *testing.T) {
+	table := eventsTable()
+	table.Mode = ModeAppend
+	table.RebuildPrimaryKey = true
+	if err := table.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	pool := newFakePool()
+	pool.rows["pg_constraint"] = [][]any{{"events_pkey"}}
+	if _, err := SynchronizeTable(Config{BatchSize: 2}, table, newFakeSource(eventColumns, eventRows(3)), pool); err != nil {
+		t.Fatal(err)
+	}
+
+	if phases := loadPhases(pool, `ALTER TABLE events DROP CONSTRAINT "events_pkey"`); !slices.Equal(phases, []string{"before"}) {
+		t.Errorf("dropped the primary key %v, want before the load", phases)
+	}
+	if phases := loadPhases(pool, "ADD PRIMARY KEY (id)"); len(phases) == 0 || phases[len(phases)-1] != "after" {
+		t.Errorf("added the primary key %v, want after the load", phases)
+	}
+
+	// Upserts rely on the primary key
+	table.Mode = ""
+	if err := table.Validate(); err == nil {
+		t.Error("rebuild_primary_key validated for an upserted table")
+	}
+}
+
+func TestSynchronizeTablePrimaryKeyMode(t *testing.T) {
+	tests := []struct {
+		mode     string
+		conflict []string
+		// key is the statement enforcing the primary columns, empty if none
+		key    string
+		target string
+	}{
+		{PrimaryKeyModeConstraint, nil, "ALTER TABLE events ADD PRIMARY KEY (id)", "ON CONFLICT (id)"},
+		{PrimaryKeyModeUniqueIndex, nil, "CREATE UNIQUE INDEX IF NOT EXISTS events_pkey ON events (id)", "ON CONFLICT (id)"},
+		{PrimaryKeyModeNone, []string{"name"}, "", "ON CONFLICT (name)"},
+	}
+
+	for _, test := range tests {
+		table := eventsTable()
+		table.PrimaryKeyMode = test.mode
+		table.ConflictColumns = test.conflict
+		if test.conflict != nil {
+			table.Indexes = []Index{{Name: "name", Columns: test.conflict, Unique: true}}
+		}
+		if err := table.Validate(); err != nil {
+			t.Fatalf("primary_key_mode %s: %v", test.mode, err)
+		}
+
+		pool := newFakePool()
+		if _, err := SynchronizeTable(Config{BatchSize: 10}, table, newFakeSource(eventColumns, eventRows(3)), pool); err != nil {
+			t.Fatalf("primary_key_mode %s: %v", test.mode, err)
+		}
+
+		keys := append(pool.Statements("PRIMARY KEY"), pool.Statements("events_pkey")...)
+		if test.key == "" && len(keys) != 0 {
+			t.Errorf("primary_key_mode %s: enforced the key with %q", test.mode, keys)
+		}
+		if test.key != "" && !slices.Equal(keys, []string{test.key}) {
+			t.Errorf("primary_key_mode %s: enforced the key with %q, want %q", test.mode, keys, test.key)
+		}
+
+		// The upsert targets the enforced key
+		if merge := pool.Statements(test.target); len(merge) != 1 {
+			t.Errorf("primary_key_mode %s: merged with %q, want %s", test.mode, pool.Statements("INSERT INTO events"), test.target)
+		}
+	}
+
+	// Without a key, upserts need another unique target
+	table := eventsTable()
+	table.PrimaryKeyMode = PrimaryKeyModeNone
+	if err := table.Validate(); err == nil {
+		t.Error("primary_key_mode none validated without conflict_columns")
+	}
+	table.Mode = ModeAppend
+	if err := table.Validate(); err != nil {
+		t.Errorf("primary_key_mode none of an append table: %v", err)
+	}
+}
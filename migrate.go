@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sourceComment prefixes the column comments recording the ClickHouse source of a column
+const sourceComment = "source="
+
+// MigrateTable aligns an existing Postgres table with the configured columns.
+// Columns are renamed when their source moved to another destination, added when missing
+// and, if enabled, dropped when no longer configured. Sources are tracked in column comments,
+// so renames are only detected for columns migrated at least once.
+func MigrateTable(table Table, db Pool) error {
+	rows, err := db.Query(ctx, `
+		SELECT attname, COALESCE(col_description(attrelid, attnum), '')
+		FROM pg_attribute
+		WHERE attrelid = $1::regclass AND attnum > 0 AND NOT attisdropped
+	`, QuoteQualified(table.Destination))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	live := map[string]bool{}
+	sources := map[string]string{}
+	for rows.Next() {
+		var name, comment string
+		if err := rows.Scan(&name, &comment); err != nil {
+			return err
+		}
+
+		live[name] = true
+		if source, ok := strings.CutPrefix(comment, sourceComment); ok {
+			// Copied ClickHouse comments follow the source on the next lines
+			source, _, _ = strings.Cut(source, "\n")
+			sources[source] = name
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	configured := map[string]bool{}
+	for _, column := range table.Columns {
+		configured[column.Destination] = true
+	}
+
+	statements := []string{}
+	for _, column := range table.Columns {
+		if live[column.Destination] {
+			continue
+		}
+
+		if previous, ok := sources[column.Source]; ok && column.Source != "" && !configured[previous] {
+			log.WithFields(log.Fields{
+				"from": previous,
+				"to":   column.Destination,
+			}).Info("Renaming column")
+
+			statements = append(statements, fmt.Sprintf("ALTER TABLE %s RENAME COLUMN %s TO %s", QuoteQualified(table.Destination), QuoteIdentifier(previous), QuoteIdentifier(column.Destination)))
+			delete(live, previous)
+			continue
+		}
+
+		log.WithField("column", column.Destination).Info("Adding column")
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", QuoteQualified(table.Destination), column.GetDefinition()))
+	}
+
+	for name := range live {
+		if configured[name] {
+			continue
+		}
+
+		if !table.MigrateDrops {
+			log.WithField("column", name).Warn("Column is no longer configured, enable migrate_drops to drop it")
+			continue
+		}
+
+		log.WithField("column", name).Info("Dropping column")
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", QuoteQualified(table.Destination), QuoteIdentifier(name)))
+	}
+
+	for _, column := range table.Columns {
+		if column.Source == "" {
+			continue
+		}
+
+		statements = append(statements, fmt.Sprintf(
+			"COMMENT ON COLUMN %s.%s IS '%s%s'",
+			QuoteQualified(table.Destination),
+			QuoteIdentifier(column.Destination),
+			sourceComment,
+			strings.ReplaceAll(column.Source, "'", "''"),
+		))
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, statement := range statements {
+		if _, err := tx.Exec(ctx, statement); err != nil {
+			return fmt.Errorf("%s: %w", statement, err)
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// CopyComments applies the ClickHouse column comments to the Postgres columns, after the source comment
+// tracking renames when the table is migrated
+func CopyComments(table Table, conn Reader, db Executor) error {
+	rows, err := conn.Query(TableContext(table), fmt.Sprintf("DESCRIBE %s", table.GetDescribeTarget()))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	comments := map[string]string{}
+	for rows.Next() {
+		values := make([]interface{}, len(rows.Columns()))
+		for i := range values {
+			values[i] = new(string)
+		}
+
+		if err := rows.Scan(values...); err != nil {
+			return err
+		}
+
+		// DESCRIBE returns the name, type, default type, default expression and comment
+		comments[*values[0].(*string)] = *values[4].(*string)
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, column := range table.Columns {
+		comment := comments[column.Source]
+		if column.Source == "" || comment == "" {
+			continue
+		}
+
+		if table.AutoMigrate {
+			comment = fmt.Sprintf("%s%s\n%s", sourceComment, column.Source, comment)
+		}
+
+		statement := fmt.Sprintf(
+			"COMMENT ON COLUMN %s.%s IS '%s'",
+			QuoteQualified(table.Destination),
+			QuoteIdentifier(column.Destination),
+			strings.ReplaceAll(comment, "'", "''"),
+		)
+		if _, err := db.Exec(ctx, statement); err != nil {
+			return fmt.Errorf("%s: %w", statement, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// liveColumns answers the pg_attribute query of MigrateTable with the existing columns and their comment
+func liveColumns(db *fakeDB, columns ...[]any) {
+	db.rows["FROM pg_attribute"] = columns
+}
+
+func TestMigrateTable(t *testing.T) {
+	table := Table{
+		Source:      "products",
+		Destination: "products",
+		AutoMigrate: true,
+		Columns: []Column{
+			{Source: "id", Destination: "id", Type: "bigint", Primary: true},
+			{Source: "name", Destination: "label", Type: "text"},
+			{Source: "price", Destination: "price", Type: "numeric"},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		drops bool
+		want  []string
+	}{
+		{"rename and add", false, []string{
+			"ALTER TABLE products RENAME COLUMN title TO label",
+			"ALTER TABLE products ADD COLUMN price numeric",
+		}},
+		{"drop", true, []string{
+			"ALTER TABLE products RENAME COLUMN title TO label",
+			"ALTER TABLE products ADD COLUMN price numeric",
+			"ALTER TABLE products DROP COLUMN legacy",
+		}},
+	}
+
+	for _, test := range tests {
+		pool := newFakePool()
+		liveColumns(pool.fakeDB,
+			[]any{"id", "source=id"},
+			[]any{"title", "source=name"},
+			[]any{"legacy", "source=old"},
+		)
+
+		table.MigrateDrops = test.drops
+		if err := MigrateTable(table, pool); err != nil {
+			t.Fatal(err)
+		}
+
+		if altered := pool.Statements("ALTER TABLE"); !slices.Equal(altered, test.want) {
+			t.Errorf("%s: altered with %q, want %q", test.name, altered, test.want)
+		}
+
+		// Sources are recorded so the next renames are detected
+		if comment := pool.Statements("COMMENT ON COLUMN products.label IS 'source=name'"); len(comment) != 1 {
+			t.Errorf("%s: renamed column source not recorded", test.name)
+		}
+		if len(pool.Statements("COMMIT")) != 1 {
+			t.Errorf("%s: migration not committed", test.name)
+		}
+	}
+}
+
+func TestCopyComments(t *testing.T) {
+	// DESCRIBE returns the name, type, default type, default expression and comment
+	source := &fakeReader{answer: func(query string, args []any) (*fakeRows, error) {
+		return &fakeRows{
+			columns: []fakeColumn{{name: "name"}, {name: "type"}, {name: "default_type"}, {name: "default_expression"}, {name: "comment"}},
+			rows: [][]any{
+				{"id", "UInt64", "", "", "Product identifier"},
+				{"name", "String", "", "", "Customer's label"},
+				{"price", "Decimal(10, 2)", "", "", ""},
+			},
+		}, nil
+	}}
+
+	table := Table{
+		Source:      "products",
+		Destination: "products",
+		Columns: []Column{
+			{Source: "id", Destination: "id", Primary: true},
+			{Source: "name", Destination: "label"},
+			{Source: "price", Destination: "price"},
+		},
+	}
+
+	db := newFakeDB()
+	if err := CopyComments(table, source, db); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"COMMENT ON COLUMN products.id IS 'Product identifier'",
+		"COMMENT ON COLUMN products.label IS 'Customer''s label'",
+	}
+	if comments := db.Statements("COMMENT ON COLUMN"); !slices.Equal(comments, want) {
+		t.Errorf("commented with %q, want %q", comments, want)
+	}
+
+	// Migrated tables keep the source comment first, tracking renames
+	table.AutoMigrate = true
+	db = newFakeDB()
+	if err := CopyComments(table, source, db); err != nil {
+		t.Fatal(err)
+	}
+	if comments := db.Statements("COMMENT ON COLUMN products.label IS 'source=name\nCustomer''s label'"); len(comments) != 1 {
+		t.Errorf("commented with %q, want the source before the comment", db.Statements("COMMENT ON COLUMN"))
+	}
+}
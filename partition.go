@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// ListPartitions returns the active partition IDs of the source table, from the partitions_from one if set
+func ListPartitions(table Table, conn Reader) ([]string, error) {
+	database, name := "", table.GetSourceTable()
+	if i := strings.Index(name, "."); i >= 0 {
+		database, name = name[:i], name[i+1:]
+	}
+
+	rows, err := conn.Query(TableContext(table), `
+		SELECT DISTINCT partition_id
+		FROM system.parts
+		WHERE database = if(@database = '', currentDatabase(), @database)
+			AND table = @table
+			AND active
+			AND partition_id >= @from
+		ORDER BY partition_id
+	`,
+		clickhouse.Named("database", database),
+		clickhouse.Named("table", name),
+		clickhouse.Named("from", table.PartitionsFrom),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	partitions := []string{}
+	for rows.Next() {
+		var partition string
+		if err := rows.Scan(&partition); err != nil {
+			return nil, err
+		}
+		partitions = append(partitions, partition)
+	}
+
+	return partitions, rows.Err()
+}
+
+// BatchingPartitions reads the source partition by partition when the table is partitioned,
+// so FINAL only merges one partition at a time
+func BatchingPartitions(config Config, table Table, conn Reader, onBatch func([][]interface{}) error) (int, error) {
+	if !table.Partitioned {
+		return Batching(config, table, conn, onBatch)
+	}
+
+	partitions, err := ListPartitions(table, conn)
+	if err != nil {
+		return 0, fmt.Errorf("list partitions: %w", err)
+	}
+
+	total := 0
+	for _, partition := range partitions {
+		log.WithField("partition", partition).Info("Replicating partition")
+
+		table.Partition = partition
+		read, err := Batching(config, table, conn, onBatch)
+		total += read
+
+		if err != nil {
+			return total, fmt.Errorf("partition %s: %w", partition, err)
+		}
+	}
+
+	return total, nil
+}
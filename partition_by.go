@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	log "github.com/sirupsen/logrus"
+)
+
+// PartitionBy range partitions the Postgres destination on a date or timestamp column
+type PartitionBy struct {
+	Column string `yaml:"column"`
+	// Interval is the range of each partition: day, month or year
+	Interval string `yaml:"interval"`
+}
+
+// partitionSuffixes formats the partition name suffix of each interval
+var partitionSuffixes = map[string]string{
+	"day":   "YYYY_MM_DD",
+	"month": "YYYY_MM",
+	"year":  "YYYY",
+}
+
+// Validate checks the partition interval and that the partition column is part of the conflict target,
+// as Postgres requires for unique constraints of partitioned tables
+func (p *PartitionBy) Validate(table *Table) error {
+	if _, ok := partitionSuffixes[p.Interval]; !ok {
+		return fmt.Errorf("unknown partition interval %s", p.Interval)
+	}
+
+	found := false
+	for _, column := range table.Columns {
+		found = found || column.Destination == p.Column
+	}
+	if !found {
+		return fmt.Errorf("partition column %s is not a destination column", p.Column)
+	}
+
+	// Partitions are created from the values read, before the rows are merged
+	if !slices.Contains(table.GetCopyColumns(), p.Column) {
+		return fmt.Errorf("partition column %s must have a source", p.Column)
+	}
+
+	if table.Mode != ModeAppend {
+		for _, name := range table.GetConflictColumns() {
+			if name == p.Column {
+				return nil
+			}
+		}
+		return fmt.Errorf("partition column %s must be a conflict column", p.Column)
+	}
+
+	return nil
+}
+
+// CreatePartitions creates the destination partitions missing for rows about to be merged. It runs
+// before the merge transaction, as creating a partition locks the parent table until commit and
+// a partition created concurrently by another batch would abort the transaction.
+func CreatePartitions(table Table, conn Executor, batch [][]interface{}) error {
+	p := table.PartitionBy
+	index := slices.Index(table.GetCopyColumns(), p.Column)
+
+	values := []interface{}{}
+	for _, row := range batch {
+		if !IsNull(row[index]) {
+			values = append(values, row[index])
+		}
+	}
+
+	if len(values) == 0 {
+		return nil
+	}
+
+	// Values are bucketed by Postgres as the column type, as the rows are routed once merged
+	var columnType string
+	for _, column := range table.Columns {
+		if column.Destination == p.Column {
+			columnType = column.Type
+		}
+	}
+
+	rows, err := conn.Query(ctx, fmt.Sprintf(`
+		SELECT DISTINCT
+			to_char(date_trunc('%s', v), '%s'),
+			date_trunc('%s', v)::text,
+			(date_trunc('%s', v) + interval '1 %s')::text
+		FROM unnest($1::%s[]) AS t(v)
+	`,
+		p.Interval, partitionSuffixes[p.Interval],
+		p.Interval,
+		p.Interval, p.Interval,
+		columnType,
+	), values)
+	if err != nil {
+		return err
+	}
+
+	type partition struct{ suffix, from, to string }
+	partitions := []partition{}
+	for rows.Next() {
+		var p partition
+		if err := rows.Scan(&p.suffix, &p.from, &p.to); err != nil {
+			rows.Close()
+			return err
+		}
+		partitions = append(partitions, p)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, partition := range partitions {
+		_, err := conn.Exec(ctx, fmt.Sprintf(
+			`CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')`,
+			QuoteQualified(TruncateQualified(fmt.Sprintf("%s_p%s", table.Destination, partition.suffix))),
+			QuoteQualified(table.Destination),
+			partition.from,
+			partition.to,
+		))
+
+		// Concurrent batches may create the same partition
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && (pgErr.Code == "42P07" || pgErr.Code == "23505") {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("create partition %s: %w", partition.suffix, err)
+		}
+
+		log.WithField("partition", partition.suffix).Debug("Ensured partition")
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// partitionedTable is the events table range partitioned by month on its creation time
+func partitionedTable() Table {
+	table := eventsTable()
+	table.Columns = append(table.Columns, Column{Source: "created_at", Destination: "created_at", Type: "timestamptz", Primary: true})
+	table.PartitionBy = &PartitionBy{Column: "created_at", Interval: "month"}
+	return table
+}
+
+func TestPartitionByValidate(t *testing.T) {
+	table := partitionedTable()
+	if err := table.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	table.Columns[2].Source = ""
+	table.Columns[2].Primary = false
+	table.ConflictColumns = []string{"id", "created_at"}
+	if err := table.Validate(); err == nil || !strings.Contains(err.Error(), "must have a source") {
+		t.Errorf("Validate = %v, want the partition column to require a source", err)
+	}
+}
+
+func TestCreatePartitionsOutsideMergeTransaction(t *testing.T) {
+	columns := append(slices.Clone(eventColumns), fakeColumn{name: "created_at", chType: "DateTime", scan: reflect.TypeOf(time.Time{})})
+	source := newFakeSource(columns, [][]any{
+		{uint32(1), "event", time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{uint32(2), "event", time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)},
+	})
+
+	pool := newFakePool()
+	pool.rows["unnest"] = [][]any{
+		{"2024_07", "2024-07-01 00:00:00+00", "2024-08-01 00:00:00+00"},
+		{"2024_08", "2024-08-01 00:00:00+00", "2024-09-01 00:00:00+00"},
+	}
+	// Another batch created the July partition first
+	pool.failures["events_p2024_07"] = &pgconn.PgError{Code: "42P07"}
+
+	if _, err := SynchronizeTable(Config{BatchSize: 10}, partitionedTable(), source, pool); err != nil {
+		t.Fatal(err)
+	}
+
+	created := pool.Statements("PARTITION OF events")
+	if len(created) != 2 {
+		t.Fatalf("created %d partitions, want 2", len(created))
+	}
+
+	statements := pool.Statements("")
+	if slices.Index(statements, created[1]) > slices.Index(statements, "BEGIN") {
+		t.Error("partitions created inside the merge transaction")
+	}
+
+	if len(pool.Statements("COMMIT")) != 1 {
+		t.Error("batch not committed after a concurrently created partition")
+	}
+}
+
+func TestSynchronizeTablePartitioned(t *testing.T) {
+	columns := append(slices.Clone(eventColumns), fakeColumn{name: "created_at", chType: "DateTime", scan: reflect.TypeOf(time.Time{})})
+	july := time.Date(2024, 7, 14, 0, 0, 0, 0, time.UTC)
+	source := newFakeSource(columns, [][]any{{uint32(1), "event", july}})
+
+	table := partitionedTable()
+	if err := table.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	pool := newFakePool()
+	pool.rows["unnest"] = [][]any{{"2024_07", "2024-07-01 00:00:00+00", "2024-08-01 00:00:00+00"}}
+	if _, err := SynchronizeTable(Config{BatchSize: 10}, table, source, pool); err != nil {
+		t.Fatal(err)
+	}
+
+	if create := pool.Statements("CREATE TABLE IF NOT EXISTS events ("); len(create) != 1 || !strings.Contains(create[0], "PARTITION BY RANGE (created_at)") {
+		t.Errorf("created %q, want a table range partitioned on created_at", create)
+	}
+
+	// The partition is bucketed from the values read and covers the row
+	if args := pool.Args("unnest"); len(args) != 1 || len(args[0][0].([]interface{})) != 1 {
+		t.Errorf("bucketed %v, want the creation time of the row", args)
+	}
+	want := "CREATE TABLE IF NOT EXISTS events_p2024_07 PARTITION OF events FOR VALUES FROM ('2024-07-01 00:00:00+00') TO ('2024-08-01 00:00:00+00')"
+	if created := pool.Statements("PARTITION OF events"); !slices.Equal(created, []string{want}) {
+		t.Errorf("created partitions %q, want %q", created, want)
+	}
+
+	// Rows are merged into the parent, conflicting on a key including the partition column
+	if merge := pool.Statements("INSERT INTO events "); len(merge) != 1 || !strings.Contains(merge[0], "ON CONFLICT (id, created_at)") {
+		t.Errorf("merged with %q, want an upsert of the parent on id and created_at", merge)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// partitionedSource fakes a source whose rows are spread over partitions, answering system.parts
+// from the partitions_from parameter and reading the partition parameter of the queries
+func partitionedSource(partitions map[string][][]any) *fakeReader {
+	return &fakeReader{answer: func(query string, args []any) (*fakeRows, error) {
+		named := map[string]any{}
+		for _, arg := range args {
+			if arg, ok := arg.(driver.NamedValue); ok {
+				named[arg.Name] = arg.Value
+			}
+		}
+
+		if strings.Contains(query, "FROM system.parts") {
+			ids := []string{}
+			for id := range partitions {
+				if id >= named["from"].(string) {
+					ids = append(ids, id)
+				}
+			}
+			slices.Sort(ids)
+
+			parts := &fakeRows{}
+			for _, id := range ids {
+				parts.rows = append(parts.rows, []any{id})
+			}
+			return parts, nil
+		}
+
+		partition, _ := named["partition"].(string)
+		return newFakeSource(eventColumns, partitions[partition]).answer(query, args)
+	}}
+}
+
+func TestBatchingPartitions(t *testing.T) {
+	source := partitionedSource(map[string][][]any{
+		"202401": eventRows(3),
+		"202402": eventRows(2),
+		"202403": eventRows(4),
+	})
+
+	table := eventsTable()
+	table.Partitioned = true
+	table.PartitionsFrom = "202402"
+
+	read := []string{}
+	total, err := BatchingPartitions(Config{BatchSize: 10}, table, source, func(batch [][]interface{}) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 6 {
+		t.Errorf("read %d rows, want the 6 rows of the targeted partitions", total)
+	}
+
+	for i, query := range source.queries {
+		if strings.Contains(query, "FROM system.parts") {
+			continue
+		}
+		if !strings.Contains(query, "_partition_id = @partition") {
+			t.Errorf("query %q reads every partition", query)
+		}
+		for _, arg := range source.args[i] {
+			if arg, ok := arg.(driver.NamedValue); ok && arg.Name == "partition" && !slices.Contains(read, arg.Value.(string)) {
+				read = append(read, arg.Value.(string))
+			}
+		}
+	}
+	if !slices.Equal(read, []string{"202402", "202403"}) {
+		t.Errorf("read partitions %v, want 202402 and 202403", read)
+	}
+}
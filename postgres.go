@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// maxIdentifierLength is the Postgres limit of identifiers, longer ones being silently truncated
+const maxIdentifierLength = 63
+
+// TruncateIdentifier shortens identifiers over the Postgres limit, replacing their end with a hash
+// of the whole name so truncated names stay unique
+func TruncateIdentifier(name string) string {
+	if len(name) <= maxIdentifierLength {
+		return name
+	}
+
+	hash := sha1.Sum([]byte(name))
+	suffix := hex.EncodeToString(hash[:4])
+	return fmt.Sprintf("%s_%s", name[:maxIdentifierLength-len(suffix)-1], suffix)
+}
+
+// TruncateQualified truncates the unqualified part of a possibly schema qualified name
+func TruncateQualified(name string) string {
+	schema, name := splitQualified(name)
+	if schema == "" {
+		return TruncateIdentifier(name)
+	}
+	return fmt.Sprintf("%s.%s", schema, TruncateIdentifier(name))
+}
+
+// plainIdentifier matches the identifiers Postgres keeps as is unquoted
+var plainIdentifier = regexp.MustCompile(`^[a-z_][a-z0-9_$]*$`)
+
+// QuoteIdentifier quotes identifiers with upper case or special characters, which Postgres would otherwise
+// fold to lower case or reject, leaving plain ones readable in statements and logs
+func QuoteIdentifier(name string) string {
+	if plainIdentifier.MatchString(name) {
+		return name
+	}
+	return pgx.Identifier{name}.Sanitize()
+}
+
+// QuoteIdentifiers quotes every identifier of a list
+func QuoteIdentifiers(names []string) []string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = QuoteIdentifier(name)
+	}
+	return quoted
+}
+
+// QuoteQualified quotes both parts of a possibly schema qualified name
+func QuoteQualified(name string) string {
+	schema, name := splitQualified(name)
+	if schema == "" {
+		return QuoteIdentifier(name)
+	}
+	return fmt.Sprintf("%s.%s", QuoteIdentifier(schema), QuoteIdentifier(name))
+}
+
+// DefaultApplicationName labels the connections in pg_stat_activity
+const DefaultApplicationName = "replication"
+
+// PostgresConfig describes the Postgres connection, DATABASE_URL being used when no host is set
+type PostgresConfig struct {
+	Host            string `yaml:"host,omitempty"`
+	Port            int    `yaml:"port,omitempty"`
+	Database        string `yaml:"database,omitempty"`
+	User            string `yaml:"user,omitempty"`
+	Password        string `yaml:"password,omitempty"`
+	SSLMode         string `yaml:"sslmode,omitempty"`
+	ApplicationName string `yaml:"application_name,omitempty"`
+	// StatementTimeout and LockTimeout bound the copy and merge statements, zero disabling them
+	StatementTimeout time.Duration `yaml:"statement_timeout,omitempty"`
+	LockTimeout      time.Duration `yaml:"lock_timeout,omitempty"`
+}
+
+// DSN builds a connection URL from the structured configuration
+func (p PostgresConfig) DSN() string {
+	host := p.Host
+	if p.Port != 0 {
+		host = fmt.Sprintf("%s:%d", p.Host, p.Port)
+	}
+
+	dsn := url.URL{
+		Scheme: "postgres",
+		Host:   host,
+		Path:   "/" + p.Database,
+	}
+
+	if p.Password != "" {
+		dsn.User = url.UserPassword(p.User, p.Password)
+	} else if p.User != "" {
+		dsn.User = url.User(p.User)
+	}
+
+	query := url.Values{}
+	if p.SSLMode != "" {
+		query.Set("sslmode", p.SSLMode)
+	}
+	dsn.RawQuery = query.Encode()
+
+	return dsn.String()
+}
+
+// ParsePostgresConfig builds the pool configuration from the postgres block or DATABASE_URL
+func ParsePostgresConfig(p PostgresConfig) (*pgxpool.Config, error) {
+	dsn := os.Getenv("DATABASE_URL")
+	if p.Host != "" {
+		dsn = p.DSN()
+	}
+
+	poolConfig, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	name := p.ApplicationName
+	if name == "" {
+		name = DefaultApplicationName
+	}
+
+	// An application name set in the DSN takes precedence over the default
+	if _, ok := poolConfig.ConnConfig.RuntimeParams["application_name"]; !ok || p.ApplicationName != "" {
+		poolConfig.ConnConfig.RuntimeParams["application_name"] = name
+	}
+
+	return poolConfig, nil
+}
+
+// ApplicationName labels the connections synchronizing a table
+func ApplicationName(p PostgresConfig, table Table) string {
+	name := p.ApplicationName
+	if name == "" {
+		name = DefaultApplicationName
+	}
+	return fmt.Sprintf("%s:%s", name, table.Destination)
+}
+
+// PrepareConnection labels an acquired connection with the table, replacing the label a previous table
+// left on the pooled connection
+func PrepareConnection(conn Executor, p PostgresConfig, table Table) error {
+	_, err := conn.Exec(ctx, "SELECT set_config('application_name', $1, false)", ApplicationName(p, table))
+	return err
+}
+
+// SetTimeouts applies the configured timeouts to the current transaction only,
+// so they bound its copy and merge without outliving it on the pooled connection.
+// Timeouts not configured are left to the role and database settings.
+func SetTimeouts(tx Executor, p PostgresConfig) error {
+	settings := []string{}
+	args := []any{}
+	for _, timeout := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"statement_timeout", p.StatementTimeout},
+		{"lock_timeout", p.LockTimeout},
+	} {
+		if timeout.value <= 0 {
+			continue
+		}
+
+		args = append(args, fmt.Sprintf("%dms", timeout.value.Milliseconds()))
+		settings = append(settings, fmt.Sprintf("set_config('%s', $%d, true)", timeout.name, len(args)))
+	}
+
+	if len(settings) == 0 {
+		return nil
+	}
+
+	_, err := tx.Exec(ctx, fmt.Sprintf("SELECT %s", strings.Join(settings, ", ")), args...)
+	return err
+}
+
+// Executor is the part of a Postgres pool, connection or transaction writing the destinations,
+// so fakes can stand in for it
+type Executor interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	CopyFrom(ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource) (int64, error)
+}
+
+// Pool is the part of a Postgres pool synchronizing tables, so fakes can stand in for it
+type Pool interface {
+	Executor
+	Begin(ctx context.Context) (pgx.Tx, error)
+	Acquire(ctx context.Context) (PoolConn, error)
+	// MaxConns is the pool size, bounding the batches inserted concurrently
+	MaxConns() int32
+}
+
+// PoolConn is a connection acquired from a Pool, to be released once done
+type PoolConn interface {
+	Executor
+	Begin(ctx context.Context) (pgx.Tx, error)
+	Release()
+}
+
+// Destinations opens the Postgres destinations of the tables by name, so fakes can stand in for them
+type Destinations interface {
+	Get(name string) (Pool, error)
+	Config(name string) (PostgresConfig, error)
+}
+
+// pgxPool adapts a pgx pool to the Pool interface
+type pgxPool struct {
+	*pgxpool.Pool
+}
+
+func (p pgxPool) Acquire(ctx context.Context) (PoolConn, error) {
+	conn, err := p.Pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (p pgxPool) MaxConns() int32 {
+	return p.Config().MaxConns
+}
+
+// PostgresPools creates the Postgres pools of the tables by destination name on first use
+// and reuses them, tables without a destination connection writing to the postgres block or DATABASE_URL
+type PostgresPools struct {
+	mu      sync.Mutex
+	primary PostgresConfig
+	named   map[string]PostgresConfig
+	pools   map[string]*pgxpool.Pool
+	// Tracer is set on the connections of every pool
+	Tracer pgx.QueryTracer
+}
+
+// NewPostgresPools creates the pools registry of the primary and named destinations
+func NewPostgresPools(primary PostgresConfig, named map[string]PostgresConfig) *PostgresPools {
+	return &PostgresPools{
+		primary: primary,
+		named:   named,
+		pools:   map[string]*pgxpool.Pool{},
+	}
+}
+
+// Config returns the configuration of a named destination, the primary one when the name is empty
+func (p *PostgresPools) Config(name string) (PostgresConfig, error) {
+	if name == "" {
+		return p.primary, nil
+	}
+
+	config, ok := p.named[name]
+	if !ok {
+		return PostgresConfig{}, fmt.Errorf("unknown destination connection %s", name)
+	}
+	return config, nil
+}
+
+// Get returns the pool of a named destination, creating it if needed
+func (p *PostgresPools) Get(name string) (Pool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if pool, ok := p.pools[name]; ok {
+		return pgxPool{pool}, nil
+	}
+
+	config, err := p.Config(name)
+	if err != nil {
+		return nil, err
+	}
+
+	poolConfig, err := ParsePostgresConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("destination connection %q: %w", name, err)
+	}
+	poolConfig.ConnConfig.Tracer = p.Tracer
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, fmt.Errorf("destination connection %q: %w", name, err)
+	}
+
+	p.pools[name] = pool
+	return pgxPool{pool}, nil
+}
+
+// Ping checks every created pool
+func (p *PostgresPools) Ping() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for name, pool := range p.pools {
+		if err := pool.Ping(ctx); err != nil {
+			return fmt.Errorf("destination connection %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Close closes every created pool
+func (p *PostgresPools) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, pool := range p.pools {
+		pool.Close()
+	}
+	p.pools = map[string]*pgxpool.Pool{}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultProgressInterval is used when the configuration does not set one
+const DefaultProgressInterval = 10 * time.Second
+
+// Progress tracks rows processed against a known total and logs periodically
+type Progress struct {
+	mu       sync.Mutex
+	table    string
+	total    int
+	done     int
+	start    time.Time
+	last     time.Time
+	interval time.Duration
+}
+
+// NewProgress creates a progress tracker logging at most once per interval
+func NewProgress(table string, total int, interval time.Duration) *Progress {
+	if interval <= 0 {
+		interval = DefaultProgressInterval
+	}
+
+	now := time.Now()
+	return &Progress{
+		table:    table,
+		total:    total,
+		start:    now,
+		last:     now,
+		interval: interval,
+	}
+}
+
+// Add records processed rows and logs progress if the interval has elapsed
+func (p *Progress) Add(rows int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done += rows
+
+	now := time.Now()
+	if now.Sub(p.last) < p.interval && p.done < p.total {
+		return
+	}
+	p.last = now
+
+	elapsed := now.Sub(p.start)
+	throughput := float64(p.done) / elapsed.Seconds()
+
+	var eta time.Duration
+	if throughput > 0 && p.total > p.done {
+		eta = time.Duration(float64(p.total-p.done) / throughput * float64(time.Second))
+	}
+
+	log.WithFields(log.Fields{
+		"table":      p.table,
+		"done":       p.done,
+		"total":      p.total,
+		"throughput": int(throughput),
+		"eta":        eta.Round(time.Second),
+	}).Info("Progress")
+}
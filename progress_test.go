@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// slowSource delays every page of a fake source
+func slowSource(rows [][]any, delay time.Duration) *fakeReader {
+	source := newFakeSource(eventColumns, rows)
+	answer := source.answer
+	source.answer = func(query string, args []any) (*fakeRows, error) {
+		if strings.Contains(query, " LIMIT ") {
+			time.Sleep(delay)
+		}
+		return answer(query, args)
+	}
+	return source
+}
+
+func TestProgressWithSlowSource(t *testing.T) {
+	hook := test.NewLocal(log.StandardLogger())
+	defer hook.Reset()
+
+	config := Config{BatchSize: 2, ProgressInterval: 5 * time.Millisecond}
+	if _, err := Batching(config, eventsTable(), slowSource(eventRows(6), 10*time.Millisecond), func([][]interface{}) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	done := []int{}
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Progress" {
+			done = append(done, entry.Data["done"].(int))
+			if entry.Data["total"] != 6 {
+				t.Errorf("progress total %v, want 6", entry.Data["total"])
+			}
+		}
+	}
+
+	if len(done) != 3 || done[0] != 2 || done[2] != 6 {
+		t.Errorf("progress logged at %v rows, want after every slow batch up to 6", done)
+	}
+}
+
+func TestProgressInterval(t *testing.T) {
+	hook := test.NewLocal(log.StandardLogger())
+	defer hook.Reset()
+
+	progress := NewProgress("events", 10, time.Hour)
+	progress.Add(4)
+	progress.Add(4)
+	if len(hook.AllEntries()) != 0 {
+		t.Error("progress logged within the interval")
+	}
+
+	// The last rows are always logged
+	progress.Add(2)
+	if entry := hook.LastEntry(); entry == nil || entry.Data["done"] != 10 {
+		t.Errorf("progress not logged once done: %v", entry)
+	}
+}
+
+// estimatedSource is a fake source whose parts hold an estimated number of rows
+func estimatedSource(rows [][]any, estimate uint64) *fakeReader {
+	source := newFakeSource(eventColumns, rows)
+	answer := source.answer
+	source.answer = func(query string, args []any) (*fakeRows, error) {
+		if strings.Contains(query, "FROM system.parts") {
+			return &fakeRows{rows: [][]any{{estimate}}}, nil
+		}
+		return answer(query, args)
+	}
+	return source
+}
+
+func TestBatchingEstimateCount(t *testing.T) {
+	table := eventsTable()
+	table.EstimateCount = true
+
+	// Parts hold more rows than read once merged, or fewer once rows were inserted since
+	for _, estimate := range []uint64{100, 2} {
+		totals := []int{}
+		config := Config{BatchSize: 2, Hooks: Hooks{OnProgress: func(_ context.Context, _ Table, done, total int) {
+			totals = append(totals, total)
+		}}}
+
+		source := estimatedSource(eventRows(5), estimate)
+		total, err := Batching(config, table, source, func([][]interface{}) error { return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The estimate drives the progress while the end of the data ends the read
+		if total != 5 {
+			t.Errorf("estimate %d: read %d rows, want 5", estimate, total)
+		}
+		if len(totals) != 3 || totals[0] != int(estimate) {
+			t.Errorf("estimate %d: progress totals %v, want the estimate for 3 pages", estimate, totals)
+		}
+		if counts := source.Queries("COUNT(*)"); len(counts) != 0 {
+			t.Errorf("estimate %d: counted with %q", estimate, counts)
+		}
+		if pages := source.Queries("LIMIT"); len(pages) != 3 {
+			t.Errorf("estimate %d: read %d pages, want 3", estimate, len(pages))
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ApplyRetention deletes the destination rows whose cursor is older than the table retention,
+// which a TTL already deleted from the source or soon will
+func ApplyRetention(table Table, db Executor) error {
+	cursor := table.GetCursorDestination()
+	if cursor == "" {
+		return fmt.Errorf("cursor column %s is not replicated", table.Cursor.Column)
+	}
+
+	cutoff := time.Now().Add(-table.Retention)
+
+	tag, err := db.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE %s < $1", QuoteQualified(table.Destination), QuoteIdentifier(cursor)), cutoff)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"cutoff":  cutoff,
+		"deleted": tag.RowsAffected(),
+	}).Info("Applied retention")
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestApplyRetention(t *testing.T) {
+	table := eventsTable()
+	table.Columns = append(table.Columns, Column{Source: "CreatedAt", Destination: "created_at", Type: "timestamptz"})
+	table.Cursor.Column = "CreatedAt"
+	table.Retention = 30 * 24 * time.Hour
+
+	db := newFakeDB()
+	start := time.Now()
+	if err := ApplyRetention(table, db); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "DELETE FROM events WHERE created_at < $1"; len(db.statements) != 1 || db.statements[0] != want {
+		t.Fatalf("statements %v, want %q", db.statements, want)
+	}
+
+	// Rows older than the window are deleted, the more recent ones kept
+	cutoff := db.args[0][0].(time.Time)
+	if cutoff.Before(start.Add(-table.Retention)) || cutoff.After(time.Now().Add(-table.Retention)) {
+		t.Errorf("cutoff %s, want %s before now", cutoff, table.Retention)
+	}
+}
+
+func TestApplyRetentionUnreplicatedCursor(t *testing.T) {
+	table := eventsTable()
+	table.Cursor.Column = "CreatedAt"
+	table.Retention = time.Hour
+
+	if err := ApplyRetention(table, newFakeDB()); err == nil {
+		t.Error("ApplyRetention succeeded without a replicated cursor column")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import "time"
+
+// Schedule tracks when a daemon synchronizes each table next, every table being due on the first run
+// and then after its own interval
+type Schedule struct {
+	interval     time.Duration
+	fullInterval time.Duration
+	// next is the time each table is due, zero for the tables only synchronized on the first run
+	next map[string]time.Time
+}
+
+// NewSchedule creates the schedule of a daemon
+func NewSchedule(interval, fullInterval time.Duration) *Schedule {
+	return &Schedule{
+		interval:     interval,
+		fullInterval: fullInterval,
+		next:         map[string]time.Time{},
+	}
+}
+
+// Due returns the destinations of the tables due at a time, and schedules their next run
+func (s *Schedule) Due(tables []Table, now time.Time) map[string]bool {
+	due := map[string]bool{}
+	for _, table := range tables {
+		next, ok := s.next[table.Destination]
+		if ok && (next.IsZero() || next.After(now)) {
+			continue
+		}
+
+		due[table.Destination] = true
+		s.next[table.Destination] = time.Time{}
+		if every := TableInterval(table, s.interval, s.fullInterval); every > 0 {
+			s.next[table.Destination] = now.Add(every)
+		}
+	}
+	return due
+}
+
+// Wake returns when the next table is due, or zero if no table is due again
+func (s *Schedule) Wake() time.Time {
+	wake := time.Time{}
+	for _, next := range s.next {
+		if !next.IsZero() && (wake.IsZero() || next.Before(wake)) {
+			wake = next
+		}
+	}
+	return wake
+}
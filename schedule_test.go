@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleIterations(t *testing.T) {
+	tables := []Table{
+		{Destination: "events", Cursor: Cursor{Column: "updated_at"}},
+		{Destination: "countries"},
+	}
+
+	interval := 50 * time.Millisecond
+	schedule := NewSchedule(interval, 0)
+
+	start := time.Now()
+	if due := schedule.Due(tables, start); !due["events"] || !due["countries"] {
+		t.Fatalf("first run due %v, want every table", due)
+	}
+
+	if due := schedule.Due(tables, start.Add(interval/2)); len(due) != 0 {
+		t.Errorf("due %v within the interval, want none", due)
+	}
+
+	if wake := schedule.Wake(); !wake.Equal(start.Add(interval)) {
+		t.Errorf("wake at %s, want %s", wake, start.Add(interval))
+	}
+
+	// Tables without a cursor and without a full interval only run once
+	if due := schedule.Due(tables, start.Add(interval)); !due["events"] || due["countries"] {
+		t.Errorf("second run due %v, want only events", due)
+	}
+}
+
+func TestScheduleFullInterval(t *testing.T) {
+	tables := []Table{
+		{Destination: "events", Cursor: Cursor{Column: "updated_at"}},
+		{Destination: "countries"},
+		{Destination: "users", Interval: time.Minute},
+	}
+
+	schedule := NewSchedule(time.Minute, time.Hour)
+	start := time.Now()
+	schedule.Due(tables, start)
+
+	if due := schedule.Due(tables, start.Add(time.Minute)); !due["events"] || !due["users"] || due["countries"] {
+		t.Errorf("due %v after a minute, want events and users", due)
+	}
+
+	if due := schedule.Due(tables, start.Add(time.Hour)); !due["countries"] {
+		t.Errorf("due %v after an hour, want countries", due)
+	}
+}
+
+func TestSchedulePerTableInterval(t *testing.T) {
+	tables := []Table{
+		{Destination: "orders", Interval: time.Minute, Cursor: Cursor{Column: "updated_at"}},
+		{Destination: "countries", Interval: time.Hour},
+	}
+
+	// The daemon wakes up whenever a table is due, for two hours
+	schedule := NewSchedule(10*time.Minute, 0)
+	start := time.Now()
+	runs := map[string]int{}
+	for now := start; now.Before(start.Add(2 * time.Hour)); now = schedule.Wake() {
+		for destination := range schedule.Due(tables, now) {
+			runs[destination]++
+		}
+	}
+
+	if runs["orders"] != 120 || runs["countries"] != 2 {
+		t.Errorf("ran %v in two hours, want orders every minute and countries every hour", runs)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+// SQLLog appends every statement run against Postgres to a file for audit,
+// labelled with the application name of the connection and so with the table
+type SQLLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+type sqlLogCopyKey struct{}
+
+// NewSQLLog opens the file statements are appended to
+func NewSQLLog(path string) (*SQLLog, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLLog{file: file}, nil
+}
+
+// Close closes the underlying file
+func (l *SQLLog) Close() error {
+	return l.file.Close()
+}
+
+// write appends a statement on a single line, labelled with the application name of its connection
+func (l *SQLLog) write(conn *pgx.Conn, statement string) {
+	l.append(conn.PgConn().ParameterStatus("application_name"), statement)
+}
+
+func (l *SQLLog) append(label string, statement string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, err := fmt.Fprintf(l.file, "%s [%s] %s;\n",
+		time.Now().Format(time.RFC3339Nano),
+		label,
+		strings.Join(strings.Fields(statement), " "),
+	)
+	if err != nil {
+		log.WithError(err).Warn("Failed to write SQL log")
+	}
+}
+
+// TraceQueryStart logs a statement before it runs
+func (l *SQLLog) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	l.write(conn, data.SQL)
+	return ctx
+}
+
+func (l *SQLLog) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {}
+
+// TraceCopyFromStart keeps the copied table so the copy is summarized once done
+func (l *SQLLog) TraceCopyFromStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceCopyFromStartData) context.Context {
+	return context.WithValue(ctx, sqlLogCopyKey{}, data)
+}
+
+// TraceCopyFromEnd logs a copy with the number of rows copied
+func (l *SQLLog) TraceCopyFromEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceCopyFromEndData) {
+	start, ok := ctx.Value(sqlLogCopyKey{}).(pgx.TraceCopyFromStartData)
+	if !ok {
+		return
+	}
+
+	l.write(conn, fmt.Sprintf("COPY %s (%s) FROM STDIN -- %d rows",
+		start.TableName.Sanitize(),
+		strings.Join(start.ColumnNames, ", "),
+		data.CommandTag.RowsAffected(),
+	))
+}
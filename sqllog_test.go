@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSQLLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "statements.sql")
+
+	// Runs append to the same file
+	for _, table := range []string{"events", "users"} {
+		sqlLog, err := NewSQLLog(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sqlLog.append("replication:"+table, "\n\t\tINSERT INTO "+table+" AS target\n\t\tSELECT * FROM "+table+"_tmp\n\t")
+		if err := sqlLog.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %d lines, want one per statement:\n%s", len(lines), b)
+	}
+
+	for i, table := range []string{"events", "users"} {
+		timestamp, statement, _ := strings.Cut(lines[i], " ")
+		if _, err := time.Parse(time.RFC3339Nano, timestamp); err != nil {
+			t.Errorf("line %q not timestamped: %v", lines[i], err)
+		}
+		if want := "[replication:" + table + "] INSERT INTO " + table + " AS target SELECT * FROM " + table + "_tmp;"; statement != want {
+			t.Errorf("logged %q, want %q", statement, want)
+		}
+	}
+}
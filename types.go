@@ -0,0 +1,487 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/netip"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/shopspring/decimal"
+	log "github.com/sirupsen/logrus"
+)
+
+var decimalType = regexp.MustCompile(`^Decimal(32|64|128|256)?\((\d+)(?:,\s*(\d+))?\)$`)
+
+var dateTime64Type = regexp.MustCompile(`^DateTime64\((\d+)(?:,\s*'.*')?\)$`)
+
+// dateTimeType matches DateTime with a timezone, which only changes how ClickHouse displays the instant
+var dateTimeType = regexp.MustCompile(`^DateTime\('.*'\)$`)
+
+// decimalPrecisions are the precisions of the fixed size ClickHouse decimals
+var decimalPrecisions = map[string]int{"32": 9, "64": 18, "128": 38, "256": 76}
+
+// postgresTypes maps ClickHouse types to Postgres types when no parameter is involved
+var postgresTypes = map[string]string{
+	"String": "text",
+	"Bool":   "boolean",
+	"Int8":   "smallint",
+	"Int16":  "smallint",
+	"Int32":  "integer",
+	"Int64":  "bigint",
+	"UInt8":  "smallint",
+	"UInt16": "integer",
+	"UInt32": "bigint",
+	// Integers wider than bigint are numeric, UInt64 keeping a precision covering its range
+	"UInt64":   "numeric(20,0)",
+	"Int128":   "numeric",
+	"UInt128":  "numeric",
+	"Int256":   "numeric",
+	"UInt256":  "numeric",
+	"Float32":  "real",
+	"Float64":  "double precision",
+	"Date":     "date",
+	"Date32":   "date",
+	"DateTime": "timestamptz",
+	// UUIDs are scanned into uuid.UUID which pgx encodes natively
+	"UUID": "uuid",
+	"IPv4": "inet",
+	"IPv6": "inet",
+	// Nothing is the type of NULL literals, which only ever hold NULL
+	"Nothing": "text",
+}
+
+// UnwrapType strips the Nullable and LowCardinality wrappers of a ClickHouse type,
+// which are scanned as their underlying type
+func UnwrapType(chType string) string {
+	for _, wrapper := range []string{"Nullable", "LowCardinality"} {
+		if strings.HasPrefix(chType, wrapper+"(") && strings.HasSuffix(chType, ")") {
+			return UnwrapType(chType[len(wrapper)+1 : len(chType)-1])
+		}
+	}
+	return chType
+}
+
+// fixedStringType matches FixedString(N), capturing its length
+var fixedStringType = regexp.MustCompile(`^FixedString\((\d+)\)$`)
+
+// PostgresType maps a ClickHouse type to a Postgres type, or returns an empty string if unknown
+func PostgresType(chType string) string {
+	chType = UnwrapType(chType)
+
+	// Enums are scanned as their label
+	if strings.HasPrefix(chType, "FixedString(") || strings.HasPrefix(chType, "Enum") {
+		return "text"
+	}
+
+	if IsJSONType(chType) {
+		return "jsonb"
+	}
+
+	if pgType, ok := postgresTypes[chType]; ok {
+		return pgType
+	}
+
+	if dateTimeType.MatchString(chType) {
+		return "timestamptz"
+	}
+
+	if match := dateTime64Type.FindStringSubmatch(chType); match != nil {
+		// Postgres timestamps are limited to microseconds
+		precision, _ := strconv.Atoi(match[1])
+		return fmt.Sprintf("timestamptz(%d)", min(precision, 6))
+	}
+
+	if match := decimalType.FindStringSubmatch(chType); match != nil {
+		if match[1] != "" {
+			// Decimal32(S) and friends only carry the scale
+			return fmt.Sprintf("numeric(%d, %s)", decimalPrecisions[match[1]], match[2])
+		}
+
+		scale := match[3]
+		if scale == "" {
+			scale = "0"
+		}
+		return fmt.Sprintf("numeric(%s, %s)", match[2], scale)
+	}
+
+	return ""
+}
+
+// DescribeSource returns the source column names, in order, and their ClickHouse types
+func DescribeSource(table Table, conn Reader) ([]string, map[string]string, error) {
+	rows, err := conn.Query(TableContext(table), fmt.Sprintf("DESCRIBE %s", table.GetDescribeTarget()))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	names := []string{}
+	types := map[string]string{}
+	for rows.Next() {
+		values := make([]interface{}, len(rows.Columns()))
+		for i := range values {
+			values[i] = new(string)
+		}
+
+		if err := rows.Scan(values...); err != nil {
+			return nil, nil, err
+		}
+
+		names = append(names, *values[0].(*string))
+		types[*values[0].(*string)] = *values[1].(*string)
+	}
+
+	return names, types, rows.Err()
+}
+
+// InferColumnTypes fills the columns without a type from the ClickHouse table description,
+// after adding the discovered source columns
+func InferColumnTypes(table *Table, conn Reader) error {
+	missing := table.DiscoversColumns()
+	for _, column := range table.Columns {
+		if column.Type == "" {
+			missing = true
+			break
+		}
+	}
+
+	if !missing {
+		return nil
+	}
+
+	names, types, err := DescribeSource(*table, conn)
+	if err != nil {
+		return err
+	}
+
+	// Copy the columns so inferred types are not saved back to the configuration
+	table.Columns = append([]Column(nil), table.Columns...)
+	for _, name := range names {
+		if !table.Discovers(name) {
+			continue
+		}
+
+		// Unquoted Postgres identifiers are lower case
+		log.WithField("column", name).Info("Discovered column")
+		table.Columns = append(table.Columns, Column{Source: name, Destination: strings.ToLower(name)})
+	}
+
+	for i, column := range table.Columns {
+		if column.Type != "" {
+			continue
+		}
+
+		pgType := PostgresType(types[column.Source])
+		if column.EnumAs == EnumAsNumber && strings.HasPrefix(UnwrapType(types[column.Source]), "Enum") {
+			pgType = "smallint"
+		}
+		if match := fixedStringType.FindStringSubmatch(UnwrapType(types[column.Source])); match != nil {
+			switch column.FixedStringAs {
+			case FixedStringAsChar:
+				pgType = fmt.Sprintf("char(%s)", match[1])
+			case FixedStringAsBytea:
+				pgType = "bytea"
+			}
+		}
+		if pgType == "" {
+			return fmt.Errorf("cannot infer Postgres type of %s (%s)", column.Source, types[column.Source])
+		}
+
+		log.WithFields(log.Fields{
+			"column": column.Source,
+			"source": types[column.Source],
+			"type":   pgType,
+		}).Info("Inferred column type")
+
+		table.Columns[i].Type = pgType
+	}
+
+	return nil
+}
+
+// wideIntegers are the ClickHouse integers wider than bigint
+var wideIntegers = map[string]bool{"UInt64": true, "Int128": true, "UInt128": true, "Int256": true, "UInt256": true}
+
+// postgresFamilies groups the Postgres types a scanned Go value is checked against
+var postgresFamilies = map[string]string{
+	"smallint": "integer", "integer": "integer", "bigint": "integer", "int": "integer",
+	"int2": "integer", "int4": "integer", "int8": "integer",
+	"real": "float", "double precision": "float", "float": "float", "float4": "float", "float8": "float",
+	"numeric": "numeric", "decimal": "numeric",
+	"boolean": "boolean", "bool": "boolean",
+	"text": "text", "varchar": "text", "character varying": "text", "char": "text", "character": "text",
+	"date": "time", "timestamp": "time", "timestamptz": "time",
+	"timestamp with time zone": "time", "timestamp without time zone": "time",
+}
+
+// compatibleFamilies lists the Postgres families a Go family can be copied into besides its own
+var compatibleFamilies = map[string][]string{
+	"integer": {"float", "numeric"},
+	"float":   {"numeric"},
+	"numeric": {"float"},
+}
+
+// goFamily returns the family of a scanned Go type, or an empty string if it is not checked
+func goFamily(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return "time"
+	case reflect.TypeOf(decimal.Decimal{}):
+		return "numeric"
+	}
+
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "float"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.String:
+		return "text"
+	}
+
+	return ""
+}
+
+// collateClause matches the collation of a column type, such as text COLLATE "C"
+var collateClause = regexp.MustCompile(`(?i)\s+collate(\s+|$)`)
+
+// collationName matches a quoted or plain collation name
+var collationName = regexp.MustCompile(`^("[^"]+"|[A-Za-z_][A-Za-z0-9_.]*)$`)
+
+// ParseColumnType splits a declared Postgres type into its lower case base name, without type modifiers
+// such as varchar(50), and its collation, checking the modifiers are well formed
+func ParseColumnType(pgType string) (string, string, error) {
+	declared, collation := strings.TrimSpace(pgType), ""
+	if parts := collateClause.Split(declared, -1); len(parts) > 1 {
+		if len(parts) > 2 || !collationName.MatchString(strings.TrimSpace(parts[1])) {
+			return "", "", fmt.Errorf("invalid collation in type %s", pgType)
+		}
+		declared, collation = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	}
+
+	if strings.Contains(declared, ";") || strings.Count(declared, "(") != strings.Count(declared, ")") {
+		return "", "", fmt.Errorf("invalid type %s", pgType)
+	}
+
+	base := strings.ToLower(declared)
+	if open := strings.Index(base, "("); open >= 0 {
+		closing := strings.Index(base, ")")
+		if closing < open || strings.TrimSpace(base[open+1:closing]) == "" {
+			return "", "", fmt.Errorf("invalid type modifier in %s", pgType)
+		}
+		base = strings.TrimSpace(base[:open])
+	}
+
+	return base, collation, nil
+}
+
+// CheckColumnTypes warns about columns whose scanned Go type cannot be copied into their declared Postgres type,
+// which would otherwise only fail with a copy error
+func CheckColumnTypes(table Table, columnTypes []driver.ColumnType) {
+	columns := []Column{}
+	for _, column := range table.Columns {
+		if column.Source != "" {
+			columns = append(columns, column)
+		}
+	}
+
+	for i, columnType := range columnTypes {
+		if i >= len(columns) || columnType.ScanType() == nil {
+			continue
+		}
+
+		// Modifiers such as a length or a collation do not change how values are copied
+		declared, _, _ := ParseColumnType(columns[i].Type)
+
+		pgFamily := postgresFamilies[declared]
+		scanned := goFamily(columnType.ScanType())
+		if pgFamily == "" || scanned == "" || pgFamily == scanned || slices.Contains(compatibleFamilies[scanned], pgFamily) {
+			continue
+		}
+
+		log.WithField("table", table.GetName()).Warnf("Column %s: scanned %s but declared %s", columns[i].Destination, columnType.ScanType(), columns[i].Type)
+	}
+}
+
+// CheckSourceTypes checks the ClickHouse type of every source column can be copied into its declared
+// Postgres type, before any table is created. Types outside the checked families are left to the copy.
+func CheckSourceTypes(table Table, conn Reader) error {
+	_, types, err := DescribeSource(table, conn)
+	if err != nil {
+		return err
+	}
+
+	errs := []error{}
+	for _, column := range table.Columns {
+		chType, ok := types[column.Source]
+		if !ok || column.Type == "" {
+			continue
+		}
+
+		declared, _, err := ParseColumnType(column.Type)
+		if err != nil {
+			return err
+		}
+
+		source := UnwrapType(chType)
+		inferred, _, _ := ParseColumnType(PostgresType(source))
+		switch {
+		case column.EnumAs == EnumAsNumber && strings.HasPrefix(source, "Enum"):
+			inferred = "smallint"
+		case source == "UInt8" && postgresFamilies[declared] == "boolean":
+			// UInt8 flags are cast to Bool when selected
+			inferred = "boolean"
+		case wideIntegers[source]:
+			// Wide integers may be declared with a narrower integer type, values out of its range failing the copy
+			inferred = "bigint"
+		}
+
+		pgFamily, sourceFamily := postgresFamilies[declared], postgresFamilies[inferred]
+		if pgFamily == "" || sourceFamily == "" || pgFamily == sourceFamily || slices.Contains(compatibleFamilies[sourceFamily], pgFamily) {
+			continue
+		}
+
+		errs = append(errs, fmt.Errorf("column %s: ClickHouse %s cannot be copied into %s", column.Source, chType, column.Type))
+	}
+
+	return errors.Join(errs...)
+}
+
+// IsJSONType reports whether a ClickHouse type is replicated as jsonb
+func IsJSONType(chType string) bool {
+	return strings.HasPrefix(chType, "Tuple(") || strings.HasPrefix(chType, "Nested(")
+}
+
+// ConvertValue converts a scanned ClickHouse value to a value Postgres can copy without loss
+func ConvertValue(chType string, value interface{}) (interface{}, error) {
+	if IsJSONType(chType) {
+		return EncodeJSON(value)
+	}
+
+	switch v := value.(type) {
+	case *time.Time:
+		// Dates are midnight in the server timezone, kept as the same day at UTC midnight
+		// so they have no time component whether copied into date or timestamptz
+		if chType == "Date" || chType == "Date32" {
+			return time.Date(v.Year(), v.Month(), v.Day(), 0, 0, 0, 0, time.UTC), nil
+		}
+	case **time.Time:
+		if *v == nil {
+			return nil, nil
+		}
+		return ConvertValue(chType, *v)
+	case *big.Int:
+		// Wide integers are scanned as big integers, which pgx only copies as numerics
+		return pgtype.Numeric{Int: v, Valid: true}, nil
+	case **big.Int:
+		if *v == nil {
+			return nil, nil
+		}
+		return ConvertValue(chType, *v)
+	case *decimal.Decimal:
+		return pgtype.Numeric{Int: v.Coefficient(), Exp: v.Exponent(), Valid: true}, nil
+	case **decimal.Decimal:
+		if *v == nil {
+			return nil, nil
+		}
+		return ConvertValue(chType, *v)
+	case *net.IP:
+		// IPv4 addresses are unmapped so they are not stored as IPv6
+		addr, ok := netip.AddrFromSlice(*v)
+		if !ok {
+			return nil, nil
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	case **net.IP:
+		if *v == nil {
+			return nil, nil
+		}
+		return ConvertValue(chType, *v)
+	}
+
+	return value, nil
+}
+
+// ConvertFixedString trims the NUL bytes padding a scanned FixedString, which Postgres text rejects,
+// or keeps them as bytes for bytea columns
+func ConvertFixedString(value interface{}, as string) interface{} {
+	switch v := value.(type) {
+	case string:
+		if as == FixedStringAsBytea {
+			return []byte(v)
+		}
+		return strings.TrimRight(v, "\x00")
+	case *string:
+		return ConvertFixedString(*v, as)
+	case **string:
+		if *v == nil {
+			return nil
+		}
+		return ConvertFixedString(*v, as)
+	}
+	return value
+}
+
+// InLocation converts a scanned time to a location, keeping the instant but changing the wall clock
+func InLocation(value interface{}, location *time.Location) interface{} {
+	switch v := value.(type) {
+	case time.Time:
+		return v.In(location)
+	case *time.Time:
+		return v.In(location)
+	case **time.Time:
+		if *v == nil {
+			return nil
+		}
+		return (*v).In(location)
+	}
+	return value
+}
+
+// IsNull reports whether a scanned or converted value is NULL
+func IsNull(value interface{}) bool {
+	v := reflect.ValueOf(value)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return true
+		}
+		v = v.Elem()
+	}
+	return !v.IsValid()
+}
+
+// EncodeJSON encodes a scanned tuple or nested value, named tuples being objects and others arrays
+func EncodeJSON(value interface{}) (interface{}, error) {
+	v := reflect.ValueOf(value)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+
+	b, err := json.Marshal(v.Interface())
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
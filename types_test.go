@@ -0,0 +1,634 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"net"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/shopspring/decimal"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestPostgresType(t *testing.T) {
+	tests := map[string]string{
+		"String":                           "text",
+		"Nullable(Int64)":                  "bigint",
+		"LowCardinality(String)":           "text",
+		"UInt32":                           "bigint",
+		"UInt64":                           "numeric(20,0)",
+		"Int128":                           "numeric",
+		"UInt128":                          "numeric",
+		"Int256":                           "numeric",
+		"Nullable(UInt256)":                "numeric",
+		"Date":                             "date",
+		"Nullable(Date32)":                 "date",
+		"DateTime":                         "timestamptz",
+		"DateTime('Europe/Paris')":         "timestamptz",
+		"Nullable(DateTime('Asia/Tokyo'))": "timestamptz",
+		"DateTime64(3)":                    "timestamptz(3)",
+		"DateTime64(6, 'Europe/Paris')":    "timestamptz(6)",
+		"DateTime64(9)":                    "timestamptz(6)",
+		"Decimal(10, 2)":                   "numeric(10, 2)",
+		"Decimal64(4)":                     "numeric(18, 4)",
+		"FixedString(3)":                   "text",
+		"Enum8('a' = 1)":                   "text",
+		"Tuple(a String)":                  "jsonb",
+		"Map(String, String)":              "",
+	}
+
+	for chType, want := range tests {
+		if got := PostgresType(chType); got != want {
+			t.Errorf("PostgresType(%q) = %q, want %q", chType, got, want)
+		}
+	}
+}
+
+func TestConvertValueBigInt(t *testing.T) {
+	value, _ := new(big.Int).SetString("170141183460469231731687303715884105727", 10)
+
+	converted, err := ConvertValue("Int128", &value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	numeric, ok := converted.(pgtype.Numeric)
+	if !ok || !numeric.Valid || numeric.Int.Cmp(value) != 0 || numeric.Exp != 0 {
+		t.Errorf("ConvertValue = %#v, want the numeric %s", converted, value)
+	}
+
+	var null *big.Int
+	if converted, _ := ConvertValue("Nullable(Int128)", &null); converted != nil {
+		t.Errorf("ConvertValue of NULL = %#v, want nil", converted)
+	}
+}
+
+func TestCheckSourceTypesWideIntegers(t *testing.T) {
+	source := newFakeSource([]fakeColumn{
+		{name: "id", chType: "UInt64", scan: reflect.TypeOf(uint64(0))},
+		{name: "total", chType: "Int128"},
+	}, nil)
+
+	table := Table{Source: "events", Columns: []Column{
+		{Source: "id", Destination: "id", Type: "bigint"},
+		{Source: "total", Destination: "total", Type: "numeric"},
+	}}
+	if err := CheckSourceTypes(table, source); err != nil {
+		t.Errorf("CheckSourceTypes = %v, want wide integers accepted as integers", err)
+	}
+
+	table.Columns[0].Type = "text"
+	if err := CheckSourceTypes(table, source); err == nil {
+		t.Error("CheckSourceTypes accepted a wide integer copied into text")
+	}
+}
+
+func TestCheckSourceTypes(t *testing.T) {
+	source := newFakeSource([]fakeColumn{
+		{name: "id", chType: "UInt64", scan: reflect.TypeOf(uint64(0))},
+		{name: "name", chType: "Nullable(String)", scan: reflect.TypeOf("")},
+		{name: "active", chType: "UInt8", scan: reflect.TypeOf(uint8(0))},
+		{name: "status", chType: "Enum8('active' = 1, 'archived' = 2)", scan: reflect.TypeOf("")},
+	}, nil)
+
+	table := Table{Source: "users", Destination: "users", Columns: []Column{
+		{Source: "id", Destination: "id", Type: "bigint", Primary: true},
+		{Source: "name", Destination: "name", Type: "text"},
+		{Source: "active", Destination: "active", Type: "boolean"},
+		{Source: "status", Destination: "status", Type: "smallint", EnumAs: EnumAsNumber},
+	}}
+	if err := CheckSourceTypes(table, source); err != nil {
+		t.Fatalf("CheckSourceTypes = %v, want compatible types accepted", err)
+	}
+
+	table.Columns[1].Type = "bigint"
+	err := CheckSourceTypes(table, source)
+	if err == nil || !strings.Contains(err.Error(), "column name") {
+		t.Fatalf("CheckSourceTypes = %v, want a string copied into bigint rejected", err)
+	}
+
+	// The table is not created once a column can never be loaded
+	pool := newFakePool()
+	if err := CreateSchema(&table, source, pool); err == nil {
+		t.Error("CreateSchema created a table with incompatible types")
+	}
+	if created := pool.Statements("CREATE TABLE"); len(created) != 0 {
+		t.Errorf("CreateSchema ran %q, want nothing created", created)
+	}
+}
+
+func TestInLocationKeepsInstant(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	// A DateTime('Europe/Paris') value as scanned by the driver
+	scanned := time.Date(2024, 7, 1, 14, 30, 0, 0, paris)
+	pointer := &scanned
+
+	converted, ok := InLocation(&pointer, time.UTC).(time.Time)
+	if !ok {
+		t.Fatalf("InLocation = %#v, want a time", converted)
+	}
+
+	if !converted.Equal(scanned) {
+		t.Errorf("InLocation shifted %s to %s", scanned, converted)
+	}
+	if converted.Hour() != 12 {
+		t.Errorf("InLocation wall clock = %d:00, want 12:00 UTC", converted.Hour())
+	}
+}
+
+func TestBatchingDates(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	// The driver scans dates as midnight in the server timezone, ahead of UTC here
+	day := time.Date(2024, 7, 1, 0, 0, 0, 0, tokyo)
+	instant := time.Date(2024, 7, 1, 8, 30, 0, 0, tokyo)
+	columns := []fakeColumn{
+		{name: "id", chType: "UInt32", scan: reflect.TypeOf(uint32(0))},
+		{name: "day", chType: "Date", scan: reflect.TypeOf(time.Time{})},
+		{name: "old_day", chType: "Nullable(Date32)", scan: reflect.TypeOf((*time.Time)(nil))},
+		{name: "created_at", chType: "DateTime", scan: reflect.TypeOf(time.Time{})},
+	}
+
+	table := eventsTable()
+	table.Columns = []Column{
+		{Source: "id", Destination: "id", Type: "bigint", Primary: true},
+		{Source: "day", Destination: "day", Type: "date"},
+		{Source: "old_day", Destination: "old_day", Type: "date"},
+		{Source: "created_at", Destination: "created_at", Type: "timestamptz"},
+	}
+
+	read := readAll(t, Config{BatchSize: 10}, table, newFakeSource(columns, [][]any{{uint32(1), day, &day, instant}}))
+	if len(read) != 1 {
+		t.Fatalf("read %d rows, want 1", len(read))
+	}
+
+	// Dates keep their day without a time component, rather than the previous day at 15:00 UTC
+	want := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)
+	for i, name := range []string{"day", "old_day"} {
+		if value, ok := read[0][i+1].(time.Time); !ok || !value.Equal(want) {
+			t.Errorf("read %s %#v, want %s", name, read[0][i+1], want)
+		}
+	}
+
+	// Timestamps keep their instant
+	if value, ok := read[0][3].(*time.Time); !ok || !value.Equal(instant) {
+		t.Errorf("read created_at %#v, want %s", read[0][3], instant)
+	}
+}
+
+func TestBatchingCursorKeepsTimezone(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	source := newFakeSource(eventColumns, nil)
+	table := eventsTable()
+	table.Cursor = Cursor{Column: "updated_at", LastSync: time.Date(2024, 7, 1, 14, 30, 0, 0, paris)}
+
+	if _, err := Batching(Config{BatchSize: 10}, table, source, func([][]interface{}) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cursor is bound as a time, not formatted, so the instant is kept whatever the column timezone
+	for _, arg := range source.args[0] {
+		if named, ok := arg.(driver.NamedDateValue); ok && named.Name == "lastSync" {
+			if !named.Value.Equal(table.Cursor.LastSync) {
+				t.Errorf("lastSync bound to %s, want %s", named.Value, table.Cursor.LastSync)
+			}
+			return
+		}
+	}
+	t.Error("lastSync not bound")
+}
+
+func TestConvertValueDecimal(t *testing.T) {
+	for _, text := range []string{
+		"12345678901234567890.123456789012345678",
+		"-0.000000000000000001",
+		"99999999999999999999999999999999999999",
+		"0.10",
+	} {
+		value := decimal.RequireFromString(text)
+
+		converted, err := ConvertValue("Decimal(38, 18)", &value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		numeric, ok := converted.(pgtype.Numeric)
+		if !ok {
+			t.Fatalf("ConvertValue(%s) = %#v, want a numeric", text, converted)
+		}
+
+		copied, err := numeric.Value()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !decimal.RequireFromString(copied.(string)).Equal(value) {
+			t.Errorf("ConvertValue(%s) copied as %s", text, copied)
+		}
+	}
+
+	var null *decimal.Decimal
+	if converted, _ := ConvertValue("Nullable(Decimal(38, 18))", &null); converted != nil {
+		t.Errorf("ConvertValue of NULL = %#v, want nil", converted)
+	}
+}
+
+func TestInferColumnTypesDiscovers(t *testing.T) {
+	source := newFakeSource([]fakeColumn{
+		{name: "id", chType: "UInt32"},
+		{name: "Name", chType: "String"},
+		{name: "email", chType: "Nullable(String)"},
+		{name: "secret", chType: "String"},
+	}, nil)
+
+	tests := []struct {
+		include, exclude []string
+		want             []string
+	}{
+		{include: []string{"Name", "email"}, want: []string{"id bigint", "name text", "email text"}},
+		{exclude: []string{"secret"}, want: []string{"id bigint", "name text", "email text"}},
+		{include: []string{"Name", "secret"}, exclude: []string{"secret"}, want: []string{"id bigint", "name text"}},
+	}
+
+	for _, test := range tests {
+		table := Table{
+			Source:         "users",
+			Destination:    "users",
+			IncludeColumns: test.include,
+			ExcludeColumns: test.exclude,
+			Columns:        []Column{{Source: "id", Destination: "id", Type: "bigint", Primary: true}},
+		}
+		if err := InferColumnTypes(&table, source); err != nil {
+			t.Fatal(err)
+		}
+
+		columns := []string{}
+		for _, column := range table.Columns {
+			columns = append(columns, column.Destination+" "+column.Type)
+		}
+		if !slices.Equal(columns, test.want) {
+			t.Errorf("include %v and exclude %v discovered %v, want %v", test.include, test.exclude, columns, test.want)
+		}
+	}
+
+	// The key and the cursor cannot be excluded
+	for _, excluded := range []string{"id", "updated_at"} {
+		table := Table{
+			Source:         "users",
+			Destination:    "users",
+			ExcludeColumns: []string{excluded},
+			Cursor:         Cursor{Column: "updated_at"},
+			Columns: []Column{
+				{Source: "id", Destination: "id", Primary: true},
+				{Source: "updated_at", Destination: "updated_at"},
+			},
+		}
+		if err := table.Validate(); err == nil {
+			t.Errorf("excluding %s validated", excluded)
+		}
+	}
+}
+
+func TestSynchronizeTableEnum(t *testing.T) {
+	described := []fakeColumn{
+		{name: "id", chType: "UInt32", scan: reflect.TypeOf(uint32(0))},
+		{name: "status", chType: "Enum8('active' = 1, 'archived' = 2)", scan: reflect.TypeOf("")},
+	}
+
+	tests := []struct {
+		enumAs string
+		// selected is the status column as read, numbers being cast by the query
+		selected fakeColumn
+		value    any
+		pgType   string
+		expr     string
+	}{
+		{EnumAsText, described[1], "archived", "status text", "SELECT id, status FROM"},
+		{EnumAsNumber, fakeColumn{name: "status_cast", chType: "Int16", scan: reflect.TypeOf(int16(0))}, int16(2), "status smallint", "CAST(status AS Int16) AS `status_cast`"},
+	}
+
+	for _, test := range tests {
+		pages := newFakeSource([]fakeColumn{described[0], test.selected}, [][]any{{uint32(1), test.value}})
+		description := newFakeSource(described, nil)
+		source := &fakeReader{answer: func(query string, args []any) (*fakeRows, error) {
+			if strings.HasPrefix(query, "DESCRIBE") {
+				return description.answer(query, args)
+			}
+			return pages.answer(query, args)
+		}}
+
+		table := Table{
+			Source:      "accounts",
+			Destination: "accounts",
+			Columns: []Column{
+				{Source: "id", Destination: "id", Type: "bigint", Primary: true},
+				{Source: "status", Destination: "status", EnumAs: test.enumAs},
+			},
+		}
+
+		pool := newFakePool()
+		if _, err := SynchronizeTable(Config{BatchSize: 10}, table, source, pool); err != nil {
+			t.Fatalf("enum_as %s: %v", test.enumAs, err)
+		}
+
+		if create := pool.Statements("CREATE TABLE IF NOT EXISTS accounts"); len(create) != 1 || !strings.Contains(create[0], test.pgType) {
+			t.Errorf("enum_as %s: created %q, want %s", test.enumAs, create, test.pgType)
+		}
+		if selects := source.Queries(test.expr); len(selects) == 0 {
+			t.Errorf("enum_as %s: never selected %s", test.enumAs, test.expr)
+		}
+
+		copied := pool.Copied("accounts_")
+		if len(copied) != 1 {
+			t.Fatalf("enum_as %s: copied %d rows, want 1", test.enumAs, len(copied))
+		}
+		if value := reflect.ValueOf(copied[0][1]).Elem().Elem().Interface(); value != test.value {
+			t.Errorf("enum_as %s: copied %v, want %v", test.enumAs, value, test.value)
+		}
+	}
+}
+
+func TestConvertValueTuple(t *testing.T) {
+	named := map[string]any{"name": "Air Max", "sizes": []uint16{40, 41}}
+	unnamed := []any{"Air Max", uint8(40)}
+	nested := []map[string]any{{"store": "Paris", "stock": 2}, {"store": "Tokyo", "stock": 0}}
+	var null *map[string]any
+
+	tests := []struct {
+		chType string
+		value  any
+		want   string
+	}{
+		{"Tuple(name String, sizes Array(UInt16))", &named, `{"name":"Air Max","sizes":[40,41]}`},
+		{"Tuple(String, UInt8)", &unnamed, `["Air Max",40]`},
+		{"Nested(store String, stock UInt32)", &nested, `[{"stock":2,"store":"Paris"},{"stock":0,"store":"Tokyo"}]`},
+	}
+
+	for _, test := range tests {
+		converted, err := ConvertValue(test.chType, test.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		encoded, ok := converted.(string)
+		if !ok || !json.Valid([]byte(encoded)) || encoded != test.want {
+			t.Errorf("ConvertValue(%s) = %#v, want %s", test.chType, converted, test.want)
+		}
+	}
+
+	if converted, _ := ConvertValue("Tuple(name String)", &null); converted != nil {
+		t.Errorf("ConvertValue of NULL = %#v, want nil", converted)
+	}
+}
+
+func TestSynchronizeTableIPv6(t *testing.T) {
+	columns := []fakeColumn{
+		{name: "id", chType: "UInt32", scan: reflect.TypeOf(uint32(0))},
+		{name: "address", chType: "IPv6", scan: reflect.TypeOf(net.IP{})},
+	}
+	rows := [][]any{
+		{uint32(1), net.ParseIP("2001:db8::1")},
+		// IPv4 addresses read from an IPv6 column are mapped
+		{uint32(2), net.ParseIP("192.0.2.1")},
+	}
+
+	table := Table{
+		Source:      "visits",
+		Destination: "visits",
+		Columns: []Column{
+			{Source: "id", Destination: "id", Type: "bigint", Primary: true},
+			{Source: "address", Destination: "address"},
+		},
+	}
+
+	pool := newFakePool()
+	if _, err := SynchronizeTable(Config{BatchSize: 10}, table, newFakeSource(columns, rows), pool); err != nil {
+		t.Fatal(err)
+	}
+
+	if create := pool.Statements("CREATE TABLE IF NOT EXISTS visits"); len(create) != 1 || !strings.Contains(create[0], "address inet") {
+		t.Errorf("created %q, want an inet address column", create)
+	}
+
+	copied := pool.Copied("visits_")
+	if len(copied) != len(rows) {
+		t.Fatalf("copied %d rows, want %d", len(copied), len(rows))
+	}
+
+	want := map[string]bool{"2001:db8::1/128": true, "192.0.2.1/32": true}
+	for _, row := range copied {
+		if prefix, ok := row[1].(netip.Prefix); !ok || !want[prefix.String()] {
+			t.Errorf("copied address %#v, want one of %v", row[1], want)
+		}
+	}
+}
+
+func TestSynchronizeTableBool(t *testing.T) {
+	yes, no := true, false
+	described := []fakeColumn{
+		{name: "id", chType: "UInt32", scan: reflect.TypeOf(uint32(0))},
+		{name: "active", chType: "Bool", scan: reflect.TypeOf(false)},
+	}
+	// Bool columns are read cast to Nullable(Bool)
+	selected := []fakeColumn{described[0], {name: "active_cast", chType: "Nullable(Bool)", scan: reflect.TypeOf(&yes)}}
+
+	description := newFakeSource(described, nil)
+	pages := newFakeSource(selected, [][]any{{uint32(1), &yes}, {uint32(2), &no}})
+	source := &fakeReader{answer: func(query string, args []any) (*fakeRows, error) {
+		if strings.HasPrefix(query, "DESCRIBE") {
+			return description.answer(query, args)
+		}
+		return pages.answer(query, args)
+	}}
+
+	table := Table{
+		Source:      "accounts",
+		Destination: "accounts",
+		Columns: []Column{
+			{Source: "id", Destination: "id", Type: "bigint", Primary: true},
+			{Source: "active", Destination: "active"},
+		},
+	}
+
+	pool := newFakePool()
+	if _, err := SynchronizeTable(Config{BatchSize: 10}, table, source, pool); err != nil {
+		t.Fatal(err)
+	}
+
+	if create := pool.Statements("CREATE TABLE IF NOT EXISTS accounts"); len(create) != 1 || !strings.Contains(create[0], "active boolean") {
+		t.Errorf("created %q, want a boolean column", create)
+	}
+	if selects := source.Queries("CAST(active AS Nullable(Bool)) AS `active_cast`"); len(selects) == 0 {
+		t.Error("Bool column not read as a bool")
+	}
+
+	values := map[bool]bool{}
+	for _, row := range pool.Copied("accounts_") {
+		active, ok := row[1].(**bool)
+		if !ok {
+			t.Fatalf("copied %#v, want a bool", row[1])
+		}
+		values[**active] = true
+	}
+	if !values[true] || !values[false] {
+		t.Errorf("copied %v, want true and false", values)
+	}
+}
+
+func TestCheckColumnTypes(t *testing.T) {
+	hook := test.NewLocal(log.StandardLogger())
+	defer hook.Reset()
+
+	table := Table{
+		Source: "products",
+		Columns: []Column{
+			{Source: "id", Destination: "id", Type: "bigint"},
+			{Source: "price", Destination: "price", Type: "integer"},
+			{Source: "name", Destination: "name", Type: "varchar(50)"},
+			{Source: "rating", Destination: "rating", Type: "numeric(3, 1)"},
+		},
+	}
+	CheckColumnTypes(table, []driver.ColumnType{
+		fakeColumn{name: "id", chType: "UInt32", scan: reflect.TypeOf(uint32(0))},
+		fakeColumn{name: "price", chType: "Float64", scan: reflect.TypeOf(float64(0))},
+		fakeColumn{name: "name", chType: "String", scan: reflect.TypeOf("")},
+		fakeColumn{name: "rating", chType: "Float32", scan: reflect.TypeOf(float32(0))},
+	})
+
+	warnings := []string{}
+	for _, entry := range hook.AllEntries() {
+		warnings = append(warnings, entry.Message)
+	}
+	if want := []string{"Column price: scanned float64 but declared integer"}; !slices.Equal(warnings, want) {
+		t.Errorf("warned %q, want %q", warnings, want)
+	}
+}
+
+func TestBatchingFixedString(t *testing.T) {
+	columns := []fakeColumn{
+		{name: "id", chType: "UInt32", scan: reflect.TypeOf(uint32(0))},
+		{name: "code", chType: "FixedString(5)", scan: reflect.TypeOf("")},
+		{name: "hash", chType: "FixedString(5)", scan: reflect.TypeOf("")},
+		{name: "country", chType: "Nullable(FixedString(2))", scan: reflect.TypeOf((*string)(nil))},
+	}
+	source := newFakeSource(columns, [][]any{{uint32(1), "ab\x00\x00\x00", "ab\x00\x00\x00", (*string)(nil)}})
+
+	table := Table{
+		Source:      "codes",
+		Destination: "codes",
+		Columns: []Column{
+			{Source: "id", Destination: "id", Primary: true},
+			{Source: "code", Destination: "code", FixedStringAs: FixedStringAsChar},
+			{Source: "hash", Destination: "hash", FixedStringAs: FixedStringAsBytea},
+			{Source: "country", Destination: "country"},
+		},
+	}
+	if err := table.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := InferColumnTypes(&table, source); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"bigint", "char(5)", "bytea", "text"} {
+		if table.Columns[i].Type != want {
+			t.Errorf("column %s inferred as %s, want %s", table.Columns[i].Source, table.Columns[i].Type, want)
+		}
+	}
+
+	// The NUL padding Postgres text rejects is trimmed, unless copied as bytes
+	read := readAll(t, Config{BatchSize: 10}, table, source)
+	if len(read) != 1 {
+		t.Fatalf("read %d rows, want 1", len(read))
+	}
+	if read[0][1] != "ab" {
+		t.Errorf("read code %q, want the padding trimmed", read[0][1])
+	}
+	if value, ok := read[0][2].([]byte); !ok || string(value) != "ab\x00\x00\x00" {
+		t.Errorf("read hash %#v, want the padded bytes", read[0][2])
+	}
+	if read[0][3] != nil {
+		t.Errorf("read country %#v, want NULL", read[0][3])
+	}
+
+	table.Columns[1].FixedStringAs = "varchar"
+	if err := table.Validate(); err == nil {
+		t.Error("validated an unknown fixed_string_as")
+	}
+}
+
+func TestParseColumnType(t *testing.T) {
+	tests := []struct {
+		declared, base, collation string
+		invalid                   bool
+	}{
+		{declared: "varchar(50)", base: "varchar"},
+		{declared: "NUMERIC (10, 2)", base: "numeric"},
+		{declared: `text COLLATE "C"`, base: "text", collation: `"C"`},
+		{declared: "varchar(255) collate en_US.utf8", base: "varchar", collation: "en_US.utf8"},
+		{declared: "varchar()", invalid: true},
+		{declared: "varchar(50", invalid: true},
+		{declared: "text COLLATE", invalid: true},
+		{declared: "text; DROP TABLE events", invalid: true},
+	}
+
+	for _, test := range tests {
+		base, collation, err := ParseColumnType(test.declared)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("ParseColumnType(%q) accepted an invalid type", test.declared)
+			}
+			continue
+		}
+		if err != nil || base != test.base || collation != test.collation {
+			t.Errorf("ParseColumnType(%q) = %q, %q, %v, want %q, %q", test.declared, base, collation, err, test.base, test.collation)
+		}
+	}
+}
+
+func TestSynchronizeTableTypeModifiers(t *testing.T) {
+	table := eventsTable()
+	table.Columns[1].Type = `varchar(50) COLLATE "C"`
+	if err := table.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Modifiers are kept in the DDL and do not fail the type compatibility check of the copy
+	source := newFakeSource(eventColumns, eventRows(3))
+	if err := CheckSourceTypes(table, source); err != nil {
+		t.Errorf("CheckSourceTypes = %v", err)
+	}
+
+	pool := newFakePool()
+	if _, err := SynchronizeTable(Config{BatchSize: 10}, table, source, pool); err != nil {
+		t.Fatal(err)
+	}
+	if create := pool.Statements(`CREATE TABLE IF NOT EXISTS events (id bigint, name varchar(50) COLLATE "C")`); len(create) != 1 {
+		t.Errorf("created %q, want the name type with its modifiers", pool.Statements("CREATE TABLE"))
+	}
+	if copied := pool.Copied("events_"); len(copied) != 3 {
+		t.Errorf("copied %d rows, want 3", len(copied))
+	}
+
+	// Collations only apply to text types
+	table.Columns[0].Type = `bigint COLLATE "C"`
+	if err := table.Validate(); err == nil {
+		t.Error("validated a collation of a bigint column")
+	}
+}
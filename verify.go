@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// VerifyTable compares the row count and the cursor bounds of the source and destination
+func VerifyTable(table Table, conn Reader, db Executor) error {
+	// Append-only tables without a cursor insert every row again on each run, so the counts differ
+	if table.Mode == ModeAppend && table.Cursor.Column == "" {
+		log.Warn("Skipping verification of an append-only table without a cursor")
+		return nil
+	}
+
+	cursor := table.GetCursorDestination()
+
+	// Rows past the upper bound of the run are not synchronized yet, and rows past the retention are only
+	// deleted from the destination, so both sides are bounded alike
+	sourceConditions, destinationConditions := []string{}, []string{}
+	sourceArgs, destinationArgs := []interface{}{}, []interface{}{}
+	bound := func(operator string, name string, sourceValue any, value any) {
+		sourceConditions = append(sourceConditions, fmt.Sprintf("%s %s @%s", table.Cursor.Column, operator, name))
+		sourceArgs = append(sourceArgs, sourceValue)
+
+		destinationArgs = append(destinationArgs, value)
+		destinationConditions = append(destinationConditions, fmt.Sprintf("%s %s $%d", QuoteIdentifier(cursor), operator, len(destinationArgs)))
+	}
+
+	if !table.Cursor.Until.IsZero() || table.Cursor.UntilValue != 0 || table.Retention > 0 {
+		if cursor == "" {
+			log.Warn("Skipping verification of a bounded run, the cursor column not being replicated")
+			return nil
+		}
+	}
+
+	if table.Retention > 0 {
+		cutoff := time.Now().Add(-table.Retention)
+		bound(">=", "retention", clickhouse.DateNamed("retention", cutoff, clickhouse.NanoSeconds), cutoff)
+	}
+
+	if table.Cursor.IsSequence() && table.Cursor.UntilValue != 0 {
+		bound("<=", "untilValue", clickhouse.Named("untilValue", table.Cursor.UntilValue), table.Cursor.UntilValue)
+	}
+
+	if !table.Cursor.IsSequence() && !table.Cursor.Until.IsZero() {
+		bound("<=", "until", clickhouse.DateNamed("until", table.Cursor.Until, clickhouse.NanoSeconds), table.Cursor.Until)
+	}
+
+	sourceWhere, destinationWhere := table.GetWhereClause(), ""
+	if len(sourceConditions) > 0 {
+		if sourceWhere == "" {
+			sourceWhere = " WHERE "
+		} else {
+			sourceWhere += " AND "
+		}
+		sourceWhere += strings.Join(sourceConditions, " AND ")
+
+		destinationWhere = " WHERE " + strings.Join(destinationConditions, " AND ")
+	}
+
+	var sourceCount uint64
+	if err := conn.QueryRow(TableContext(table), fmt.Sprintf("SELECT COUNT(*) FROM %s%s", table.GetSourceExpression(), sourceWhere), sourceArgs...).Scan(&sourceCount); err != nil {
+		return err
+	}
+
+	var destinationCount int64
+	if err := db.QueryRow(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s%s", QuoteQualified(table.Destination), destinationWhere), destinationArgs...).Scan(&destinationCount); err != nil {
+		return err
+	}
+
+	if int64(sourceCount) != destinationCount {
+		return fmt.Errorf("row count mismatch: source has %d rows, destination has %d", sourceCount, destinationCount)
+	}
+
+	if cursor == "" {
+		log.WithField("rows", sourceCount).Info("Verification passed")
+		return nil
+	}
+
+	if table.Cursor.IsSequence() {
+		return verifySequence(table, conn, db, cursor, sourceCount, sourceWhere, sourceArgs, destinationWhere, destinationArgs)
+	}
+
+	var sourceMax time.Time
+	if err := conn.QueryRow(TableContext(table), fmt.Sprintf("SELECT max(%s) FROM %s%s", table.Cursor.Column, table.GetSourceExpression(), sourceWhere), sourceArgs...).Scan(&sourceMax); err != nil {
+		return err
+	}
+
+	var destinationMax time.Time
+	if err := db.QueryRow(ctx, fmt.Sprintf("SELECT COALESCE(max(%s), 'epoch') FROM %s%s", QuoteIdentifier(cursor), QuoteQualified(table.Destination), destinationWhere), destinationArgs...).Scan(&destinationMax); err != nil {
+		return err
+	}
+
+	if sourceCount > 0 && !sourceMax.Truncate(time.Microsecond).Equal(destinationMax) {
+		return fmt.Errorf("cursor mismatch: source max is %s, destination max is %s", sourceMax, destinationMax)
+	}
+
+	log.WithFields(log.Fields{
+		"rows":   sourceCount,
+		"cursor": sourceMax,
+	}).Info("Verification passed")
+
+	return nil
+}
+
+// verifySequence compares the sequence cursor bounds of the source and destination, bounded alike
+func verifySequence(table Table, conn Reader, db Executor, cursor string, sourceCount uint64, sourceWhere string, sourceArgs []interface{}, destinationWhere string, destinationArgs []interface{}) error {
+	var sourceMax int64
+	if err := conn.QueryRow(TableContext(table), fmt.Sprintf("SELECT toInt64(max(%s)) FROM %s%s", table.Cursor.Column, table.GetSourceExpression(), sourceWhere), sourceArgs...).Scan(&sourceMax); err != nil {
+		return err
+	}
+
+	var destinationMax int64
+	if err := db.QueryRow(ctx, fmt.Sprintf("SELECT COALESCE(max(%s), 0)::bigint FROM %s%s", QuoteIdentifier(cursor), QuoteQualified(table.Destination), destinationWhere), destinationArgs...).Scan(&destinationMax); err != nil {
+		return err
+	}
+
+	if sourceCount > 0 && sourceMax != destinationMax {
+		return fmt.Errorf("cursor mismatch: source max is %d, destination max is %d", sourceMax, destinationMax)
+	}
+
+	log.WithFields(log.Fields{
+		"rows":   sourceCount,
+		"cursor": sourceMax,
+	}).Info("Verification passed")
+
+	return nil
+}
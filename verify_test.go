@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// verifySource fakes a source whose counts and cursor max are fixed
+func verifySource(count uint64, max time.Time) *fakeReader {
+	return &fakeReader{answer: func(query string, args []any) (*fakeRows, error) {
+		if strings.HasPrefix(query, "SELECT COUNT(*)") {
+			return &fakeRows{rows: [][]any{{count}}}, nil
+		}
+		return &fakeRows{rows: [][]any{{max}}}, nil
+	}}
+}
+
+func TestVerifyTableDroppedRow(t *testing.T) {
+	db := newFakeDB()
+	db.rows["SELECT COUNT(*)"] = [][]any{{int64(2)}}
+
+	err := VerifyTable(eventsTable(), verifySource(3, time.Time{}), db)
+	if err == nil || !strings.Contains(err.Error(), "source has 3 rows, destination has 2") {
+		t.Errorf("VerifyTable = %v, want a row count mismatch", err)
+	}
+}
+
+func TestVerifyTableCursor(t *testing.T) {
+	max := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	table := syncedTable()
+	table.Columns = append(table.Columns, Column{Source: "UpdatedAt", Destination: "updated_at", Type: "timestamptz"})
+	table.Cursor.Column = "UpdatedAt"
+
+	db := newFakeDB()
+	db.rows["SELECT COUNT(*)"] = [][]any{{int64(3)}}
+	db.rows["SELECT COALESCE(max(updated_at)"] = [][]any{{max}}
+	if err := VerifyTable(table, verifySource(3, max), db); err != nil {
+		t.Errorf("VerifyTable = %v, want passed", err)
+	}
+
+	db.rows["SELECT COALESCE(max(updated_at)"] = [][]any{{max.Add(-time.Hour)}}
+	if err := VerifyTable(table, verifySource(3, max), db); err == nil || !strings.Contains(err.Error(), "cursor mismatch") {
+		t.Errorf("VerifyTable = %v, want a cursor mismatch", err)
+	}
+}
+
+func TestVerifyTableUntil(t *testing.T) {
+	until := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)
+	table := eventsTable()
+	table.Columns = append(table.Columns, Column{Source: "UpdatedAt", Destination: "updated_at", Type: "timestamptz"})
+	table.Cursor = Cursor{Column: "UpdatedAt", Until: until}
+
+	source := verifySource(3, until)
+	db := newFakeDB()
+	db.rows["SELECT COUNT(*)"] = [][]any{{int64(3)}}
+	db.rows["SELECT COALESCE(max(updated_at)"] = [][]any{{until}}
+	if err := VerifyTable(table, source, db); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, query := range source.queries {
+		if !strings.HasSuffix(query, "WHERE UpdatedAt <= @until") {
+			t.Errorf("source query not bounded: %s", query)
+		}
+	}
+
+	for i, statement := range db.statements {
+		if !strings.HasSuffix(statement, "WHERE updated_at <= $1") || len(db.args[i]) != 1 || db.args[i][0] != until {
+			t.Errorf("destination query not bounded: %s %v", statement, db.args[i])
+		}
+	}
+}
+
+func TestVerifyTableRetention(t *testing.T) {
+	table := eventsTable()
+	table.Columns = append(table.Columns, Column{Source: "UpdatedAt", Destination: "updated_at", Type: "timestamptz"})
+	table.Cursor = Cursor{Column: "UpdatedAt"}
+	table.Retention = 24 * time.Hour
+
+	// Rows deleted by the retention still exist in the source, so both sides start at the cutoff
+	max := time.Now().Truncate(time.Microsecond)
+	source := verifySource(3, max)
+	db := newFakeDB()
+	db.rows["SELECT COUNT(*)"] = [][]any{{int64(3)}}
+	db.rows["SELECT COALESCE(max(updated_at)"] = [][]any{{max}}
+	if err := VerifyTable(table, source, db); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, query := range source.queries {
+		if !strings.HasSuffix(query, "WHERE UpdatedAt >= @retention") {
+			t.Errorf("source query not bounded by the retention: %s", query)
+		}
+	}
+	for i, statement := range db.statements {
+		cutoff, ok := db.args[i][0].(time.Time)
+		if !strings.HasSuffix(statement, "WHERE updated_at >= $1") || !ok || time.Since(cutoff) < table.Retention {
+			t.Errorf("destination query not bounded by the retention: %s %v", statement, db.args[i])
+		}
+	}
+}
+
+func TestVerifyTableSequenceUntil(t *testing.T) {
+	table := eventsTable()
+	table.Cursor = Cursor{Column: "id", Type: CursorTypeSequence, UntilValue: 5}
+
+	source := &fakeReader{answer: func(query string, args []any) (*fakeRows, error) {
+		if strings.HasPrefix(query, "SELECT COUNT(*)") {
+			return &fakeRows{rows: [][]any{{uint64(5)}}}, nil
+		}
+		return &fakeRows{rows: [][]any{{int64(5)}}}, nil
+	}}
+	db := newFakeDB()
+	db.rows["SELECT COUNT(*)"] = [][]any{{int64(5)}}
+	db.rows["SELECT COALESCE(max(id)"] = [][]any{{int64(5)}}
+	if err := VerifyTable(table, source, db); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ids past the saved end are left to the next run on both sides
+	if len(source.queries) != 2 || len(db.statements) != 2 {
+		t.Fatalf("ran %q and %q, want the counts and maxes", source.queries, db.statements)
+	}
+	for _, query := range source.queries {
+		if !strings.HasSuffix(query, "WHERE id <= @untilValue") {
+			t.Errorf("source query not bounded: %s", query)
+		}
+	}
+	for i, statement := range db.statements {
+		if !strings.HasSuffix(statement, "WHERE id <= $1") || len(db.args[i]) != 1 || db.args[i][0] != int64(5) {
+			t.Errorf("destination query not bounded: %s %v", statement, db.args[i])
+		}
+	}
+}
+
+func TestVerifyTableSkipsAppend(t *testing.T) {
+	table := eventsTable()
+	table.Mode = ModeAppend
+
+	source := verifySource(3, time.Time{})
+	db := newFakeDB()
+	if err := VerifyTable(table, source, db); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(source.queries) != 0 || len(db.statements) != 0 {
+		t.Error("append-only table without a cursor verified")
+	}
+}